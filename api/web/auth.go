@@ -0,0 +1,139 @@
+package web
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Roles of the API clients, every role can do everything the previous one can
+const (
+	RoleReader = "reader"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+var roleLevels = map[string]int{
+	RoleReader: 1,
+	RoleEditor: 2,
+	RoleAdmin:  3,
+}
+
+// routeRoles are roles required by the routes, the empty role makes the route public.
+// Routes which aren't listed need the reader for GET and the editor for the rest.
+var routeRoles = map[string]string{
+	"Index":          "",
+	"OpenAPI":        "",
+	"Docs":           "",
+	"Metrics":        "",
+	"Healthz":        "",
+	"Readyz":         "",
+	"BookFilter":     RoleReader,
+	"GraphQL":        RoleReader,
+	"Replication":    RoleAdmin,
+	"WebhooksIndex":  RoleAdmin,
+	"WebhookCreate":  RoleAdmin,
+	"RemoveWebhook":  RoleAdmin,
+	"DeadLetters":    RoleAdmin,
+	"ReplayDelivery": RoleAdmin,
+	"RatesImport":    RoleAdmin,
+	"SetRate":        RoleAdmin,
+	"RemoveRate":     RoleAdmin,
+}
+
+var errForbidden = errors.New("the client isn't allowed to change the catalog")
+
+// WithAuth makes the API require bearer tokens, tokens are mapped to the roles of the clients
+func WithAuth(tokens map[string]string) Option {
+	return func(h *handler) {
+		h.tokens = tokens
+	}
+}
+
+// WithClientRoles maps the subjects of the verified client certificates to the roles of the clients,
+// a subject is either the common name or the whole distinguished name of the certificate
+func WithClientRoles(subjects map[string]string) Option {
+	return func(h *handler) {
+		h.clientRoles = subjects
+	}
+}
+
+// authEnabled reports whether the clients have to authenticate
+func (h *handler) authEnabled() bool {
+	return len(h.tokens) > 0 || len(h.clientRoles) > 0
+}
+
+// requiredRole returns the role needed for the route
+func requiredRole(route Route) string {
+	if role, ok := routeRoles[route.Name]; ok {
+		return role
+	}
+	if route.Method == "GET" {
+		return RoleReader
+	}
+	return RoleEditor
+}
+
+type roleKey struct{}
+
+// allowed reports whether the client of the request has the role.
+// Everything is allowed when the API doesn't require authentication.
+func allowed(ctx context.Context, role string) bool {
+	granted, ok := ctx.Value(roleKey{}).(string)
+	if !ok {
+		return true
+	}
+	return roleLevels[granted] >= roleLevels[role]
+}
+
+// clientRole returns the role of the client certificate or of the bearer token of the request
+func (h *handler) clientRole(r *http.Request) (string, bool) {
+	if role, ok := h.certificateRole(r); ok {
+		return role, true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return "", false
+	}
+	for known, role := range h.tokens {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+			return role, true
+		}
+	}
+	return "", false
+}
+
+// certificateRole returns the role of the subject of the client certificate,
+// only certificates verified by the TLS handshake are trusted
+func (h *handler) certificateRole(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if role, ok := h.clientRoles[subject.CommonName]; ok && subject.CommonName != "" {
+		return role, true
+	}
+	role, ok := h.clientRoles[subject.String()]
+	return role, ok
+}
+
+// authorize rejects the requests of the clients which don't have the role,
+// the role of the client is kept in the context for the checks inside of the handler
+func (h *handler) authorize(role string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		granted, ok := h.clientRole(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="library"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), roleKey{}, granted)
+		if !allowed(ctx, role) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,107 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/ssOlexBaiko/library/storage"
+)
+
+// maxBatchOperations bounds the operations of a single batch, so one request can't hold the storage for long
+const maxBatchOperations = 1000
+
+// batchRequest is the body of the batch request
+type batchRequest struct {
+	Operations []storage.Operation `json:"operations"`
+}
+
+// batchResult is the outcome of a single operation, Status is the one the single request would get
+type batchResult struct {
+	Status int           `json:"status"`
+	Op     string        `json:"op"`
+	ID     string        `json:"id,omitempty"`
+	Book   *storage.Book `json:"book,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+// batchResponse is the body of the batch response
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+// operationStatus returns the status of the operation result
+func operationStatus(result storage.OperationResult) int {
+	switch {
+	case result.Err == nil && result.Op == storage.OpCreate:
+		return http.StatusCreated
+	case result.Err == nil && result.Op == storage.OpDelete:
+		return http.StatusNoContent
+	case result.Err == nil:
+		return http.StatusOK
+	case errors.Is(result.Err, storage.ErrRolledBack):
+		return http.StatusFailedDependency
+	case errors.Is(result.Err, storage.ErrInvalid):
+		return http.StatusBadRequest
+	case errors.Is(result.Err, storage.ErrNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// BookBatchHandler handles requests with POST method.
+// The operations are applied all or none, the response has the result of every operation.
+// The failed batch gets the status of the operation which failed, the others are 424.
+func (h *handler) BookBatchHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("BookBatch - call")
+
+	var batch batchRequest
+	err := json.NewDecoder(r.Body).Decode(&batch)
+	if err != nil || len(batch.Operations) == 0 || len(batch.Operations) > maxBatchOperations {
+		if err != nil {
+			log.Println(err)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	results, err := h.storage.Batch(r.Context(), batch.Operations)
+	if err != nil && canceled(w, err) {
+		return
+	}
+	if err != nil && results == nil {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+
+	status := http.StatusOK
+	response := batchResponse{Results: make([]batchResult, len(results))}
+	for i, result := range results {
+		response.Results[i] = batchResult{
+			Status: operationStatus(result),
+			Op:     result.Op,
+			ID:     result.ID,
+			Book:   result.Book,
+		}
+		if result.Err != nil {
+			response.Results[i].Error = result.Err.Error()
+			if !errors.Is(result.Err, storage.ErrRolledBack) {
+				status = response.Results[i].Status
+			}
+		}
+	}
+	if err != nil {
+		log.Println(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if err = json.NewEncoder(w).Encode(response); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,93 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultCachePolicies are Cache-Control values of the routes by their names.
+// Catalog responses have to be revalidated, so the clients get the changes immediately
+// and only pay for the 304 response when nothing has changed.
+var defaultCachePolicies = map[string]string{
+	"BooksIndex": "no-cache",
+	"GetBook":    "no-cache",
+	"BookFilter": "no-cache",
+	"OpenAPI":    "public, max-age=3600",
+	"Docs":       "public, max-age=3600",
+	"Metrics":    "no-store",
+	"Healthz":    "no-store",
+	"Readyz":     "no-store",
+}
+
+// WithCachePolicy sets the Cache-Control value for the route with given name,
+// the empty policy removes the header
+func WithCachePolicy(route, policy string) Option {
+	return func(h *handler) {
+		h.cachePolicies[route] = policy
+	}
+}
+
+// cacheControl sets Cache-Control header for every response of the route
+func cacheControl(policy string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", policy)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// catalogETag returns the ETag of the catalog state, parts distinguish different views of it
+func catalogETag(seq uint64, parts ...string) string {
+	if len(parts) == 0 {
+		return fmt.Sprintf(`"catalog-%d"`, seq)
+	}
+	return fmt.Sprintf(`"catalog-%d-%s"`, seq, hash([]byte(strings.Join(parts, "\x00"))))
+}
+
+// contentETag returns the strong ETag of the representation
+func contentETag(body []byte) string {
+	return `"` + hash(body) + `"`
+}
+
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+// notModified sets validators of the response and reports whether the client already has it.
+// In this case 304 is written and the handler mustn't write anything else.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		if !etagMatches(match, etag) {
+			return false
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.IsZero() || modified.Truncate(time.Second).After(since) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatches checks If-None-Match header against the ETag using the weak comparison
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
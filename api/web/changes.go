@@ -0,0 +1,80 @@
+package web
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/ssOlexBaiko/library/storage"
+)
+
+// errInvalidToken describes the sync token which can't be decoded
+var errInvalidToken = errors.New("sync token is not valid")
+
+// changeFeed is the body of the change feed response
+type changeFeed struct {
+	Changes storage.Changes `json:"changes"`
+	// Token has to be passed as since parameter to get the next changes
+	Token string `json:"token"`
+}
+
+// encodeToken makes the opaque sync token of the sequence number
+func encodeToken(seq uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(seq, 10)))
+}
+
+// decodeToken returns the sequence number of the sync token, the empty token means the full sync
+func decodeToken(token string) (uint64, error) {
+	if token == "" {
+		return storage.FullSync, nil
+	}
+
+	seq, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, errInvalidToken
+	}
+	n, err := strconv.ParseUint(string(seq), 10, 64)
+	if err != nil {
+		return 0, errInvalidToken
+	}
+	return n, nil
+}
+
+// ChangesHandler handles requests with GET method and returns changes made since the given token
+func (h *handler) ChangesHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Changes - call")
+
+	since, err := decodeToken(r.URL.Query().Get("since"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	changes, last, err := h.storage.Changes(r.Context(), since)
+	if err != nil {
+		if canceled(w, err) {
+			return
+		}
+		if err == storage.ErrInvalidSince {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if changes == nil {
+		changes = storage.Changes{}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err = json.NewEncoder(w).Encode(changeFeed{Changes: changes, Token: encodeToken(last)})
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,36 @@
+package web
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ssOlexBaiko/library/circulation"
+)
+
+// errNoCirculation describes the change of the circulation when the desk isn't configured
+var errNoCirculation = errors.New("circulation isn't configured")
+
+// Circulation keeps the authors of the books and the loans of their copies,
+// the lookups take the IDs of all the books of the page at once
+type Circulation interface {
+	AddAuthor(author circulation.Author) (circulation.Author, error)
+	Authors() []circulation.Author
+	Author(id string) (circulation.Author, error)
+	AuthorsOf(bookIDs []string) map[string]circulation.Author
+	AddCopy(bookID, barcode string) (circulation.Copy, error)
+	Copies(bookIDs []string) map[string][]circulation.Copy
+	PlaceHold(bookID, patron string) (circulation.Hold, error)
+	CancelHold(id string) error
+	Holds(bookIDs []string) map[string][]circulation.Hold
+	Checkout(copyID, patron string, due time.Time) (circulation.Loan, error)
+	Return(loanID string) (circulation.Loan, error)
+	Loans(bookIDs []string) map[string][]circulation.Loan
+	LoanCounts(now time.Time) (active, overdue int)
+}
+
+// WithCirculation enables the authors, copies, holds and loans of the books in the GraphQL schema
+func WithCirculation(c Circulation) Option {
+	return func(h *handler) {
+		h.circulation = c
+	}
+}
@@ -0,0 +1,185 @@
+package web
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// CORSOptions describes which browser front-ends may call the API from other origins
+type CORSOptions struct {
+	// AllowedOrigins are scheme://host[:port] of the front-ends, * allows any origin
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	AllowCredentials bool
+	// MaxAge is how long the browsers cache the preflight response
+	MaxAge time.Duration
+}
+
+// exposedHeaders are the response headers the front-ends may read besides the simple ones
+var exposedHeaders = []string{"Location", "ETag", "Last-Modified", "Deprecation", "Sunset", "Link", "WWW-Authenticate", "Idempotent-Replayed"}
+
+// WithCORS lets the front-ends from the allowed origins call the API,
+// the routes answer the preflight requests as well
+func WithCORS(options CORSOptions) Option {
+	return func(h *handler) {
+		if len(options.AllowedOrigins) > 0 {
+			h.cors = &options
+		}
+	}
+}
+
+// allowedOrigin returns the value of Access-Control-Allow-Origin for the origin of the request
+func (c *CORSOptions) allowedOrigin(origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			// the wildcard isn't accepted by the browsers together with credentials, so the origin is echoed
+			if c.AllowCredentials {
+				return origin, true
+			}
+			return "*", true
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+// allowedHeaders reports whether the front-end may send all the headers,
+// requested is the comma separated list of Access-Control-Request-Headers
+func (c *CORSOptions) allowedHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		allowed := false
+		for _, h := range c.AllowedHeaders {
+			if h == "*" || strings.EqualFold(h, header) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// allowOrigin sets the headers shared by the preflight and the actual responses
+func (c *CORSOptions) allowOrigin(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Add("Vary", "Origin")
+	origin, ok := c.allowedOrigin(r.Header.Get("Origin"))
+	if !ok {
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if c.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	return true
+}
+
+// corsHeaders lets the front-ends read the responses of the route
+func (h *handler) corsHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.cors.allowOrigin(w, r) {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(exposedHeaders, ", "))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routeMethods returns the methods of the routes mounted on the path which the front-ends may use
+func (h *handler) routeMethods(path string) []string {
+	var methods []string
+	for _, route := range h.routes {
+		if route.Path != path {
+			continue
+		}
+		method := strings.ToUpper(route.Method)
+		for _, allowed := range h.cors.AllowedMethods {
+			if strings.EqualFold(allowed, method) {
+				methods = append(methods, method)
+				break
+			}
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// mountPreflights registers the OPTIONS route of every path after the route table, the literal paths first.
+// The router takes the first matching route, so /books/{id} would answer the preflight of /books/filter otherwise.
+func (h *handler) mountPreflights(router *mux.Router, versions map[string]*mux.Router) {
+	routes := append([]mountedRoute(nil), h.routes...)
+	sort.SliceStable(routes, func(i, j int) bool {
+		return !strings.Contains(routes[i].Pattern, "{") && strings.Contains(routes[j].Pattern, "{")
+	})
+
+	mounted := map[string]bool{}
+	for _, route := range routes {
+		if mounted[route.Path] {
+			continue
+		}
+		mounted[route.Path] = true
+		target := router
+		if route.Version != "" && !route.Deprecated {
+			target = versions[route.Version]
+		}
+		target.Methods("OPTIONS").Path(route.Pattern).Handler(h.preflight(route.Path))
+	}
+}
+
+// preflight answers OPTIONS requests of the path, the methods are looked up when the request comes,
+// so every route mounted on the path is included. Browsers don't send credentials with the preflight,
+// so it isn't authorized.
+func (h *handler) preflight(path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods := h.routeMethods(path)
+		w.Header().Set("Allow", strings.Join(append(methods, "OPTIONS"), ", "))
+
+		method := strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+		if method == "" {
+			// plain OPTIONS request, not a preflight
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !h.cors.allowOrigin(w, r) || !listed(methods, method) ||
+			!h.cors.allowedHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			w.Header().Set("Access-Control-Allow-Headers", requested)
+		}
+		if h.cors.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(h.cors.MaxAge/time.Second)))
+		}
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// listed reports whether the value is in the list
+func listed(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
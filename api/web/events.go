@@ -0,0 +1,269 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ssOlexBaiko/library/storage"
+)
+
+// keepAliveInterval is how often the comment is sent to the idle stream
+const keepAliveInterval = 15 * time.Second
+
+// eventReset is sent first when the stream can't be resumed from Last-Event-ID,
+// the client has to sync the catalog again, e.g. with GET /changes
+const eventReset = "reset"
+
+// streamEvent is the catalog event with its position in the stream
+type streamEvent struct {
+	ID uint64
+	storage.Event
+}
+
+// EventStream keeps the bounded log of the catalog events and fans them out to the listeners
+type EventStream struct {
+	mu          sync.Mutex
+	size        int
+	log         []streamEvent
+	lastID      uint64
+	subscribers map[chan streamEvent]struct{}
+	closed      bool
+}
+
+// NewEventStream constructor for EventStream struct, size is the number of events kept for resuming.
+// The IDs start from the current time in microseconds, so the IDs of the stream before the restart
+// aren't taken for the IDs of the new one.
+func NewEventStream(size int) *EventStream {
+	return &EventStream{
+		size:        size,
+		lastID:      uint64(time.Now().UnixNano() / int64(time.Microsecond)),
+		subscribers: map[chan streamEvent]struct{}{},
+	}
+}
+
+// Publish adds the event to the log and sends it to the subscribers.
+// It's supposed to be registered as the listener of the library.
+func (s *EventStream) Publish(event storage.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastID++
+	e := streamEvent{ID: s.lastID, Event: event}
+	s.log = append(s.log, e)
+	if len(s.log) > s.size {
+		s.log = s.log[len(s.log)-s.size:]
+	}
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- e:
+		default:
+			// the subscriber is too slow, it will resume from its last event after reconnect
+			delete(s.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns events logged after the given ID and the channel with next events.
+// The backlog is the reset event instead when the events after the ID were dropped from the log
+// or the ID isn't of this stream, e.g. it was sent before the restart.
+func (s *EventStream) subscribe(after uint64) ([]streamEvent, chan streamEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var backlog []streamEvent
+	if after != 0 && !s.resumable(after) {
+		backlog = append(backlog, streamEvent{ID: s.lastID, Event: storage.Event{Type: eventReset, Time: time.Now().UTC()}})
+	} else {
+		for _, e := range s.log {
+			if e.ID > after {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	ch := make(chan streamEvent, 64)
+	if s.closed {
+		close(ch)
+		return backlog, ch
+	}
+	s.subscribers[ch] = struct{}{}
+	return backlog, ch
+}
+
+// resumable reports whether all the events after the ID are in the log, it has to be called with the lock held
+func (s *EventStream) resumable(after uint64) bool {
+	if after > s.lastID {
+		return false
+	}
+	if len(s.log) == 0 {
+		return after == s.lastID
+	}
+	return after >= s.log[0].ID-1
+}
+
+// Close ends all the streams, the clients resume from their last events after reconnect.
+// It's called on shutdown, because the server waits for the open streams otherwise.
+func (s *EventStream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for ch := range s.subscribers {
+		delete(s.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (s *EventStream) unsubscribe(ch chan streamEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.subscribers[ch]; ok {
+		delete(s.subscribers, ch)
+		close(ch)
+	}
+}
+
+// eventFilter selects events by their types and genres of the books, empty lists match everything
+type eventFilter struct {
+	types  []string
+	genres []string
+}
+
+func newEventFilter(r *http.Request) eventFilter {
+	split := func(values []string) []string {
+		var result []string
+		for _, value := range values {
+			for _, v := range strings.Split(value, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					result = append(result, v)
+				}
+			}
+		}
+		return result
+	}
+
+	query := r.URL.Query()
+	return eventFilter{
+		types:  split(query["type"]),
+		genres: split(query["genre"]),
+	}
+}
+
+func (f eventFilter) match(event storage.Event) bool {
+	return contains(f.types, event.Type) && (len(f.genres) == 0 || intersects(f.genres, event.Book.Genres))
+}
+
+// contains reports whether the value is in the list, the empty list contains everything
+func contains(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func intersects(a, b []string) bool {
+	for _, v := range b {
+		for _, w := range a {
+			if v == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// EventsHandler handles requests with GET method and streams the catalog events as Server-Sent Events
+func (h *handler) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("Events - call")
+	if h.events == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var lastID uint64
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		var err error
+		lastID, err = strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	filter := newEventFilter(r)
+	backlog, ch := h.events.subscribe(lastID)
+	defer h.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(e streamEvent) bool {
+		if e.Type == eventReset {
+			_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: {}\n\n", e.ID, e.Type)
+			return err == nil
+		}
+		if !filter.match(e.Event) {
+			return true
+		}
+		data, err := json.Marshal(e.Event)
+		if err != nil {
+			log.Println(err)
+			return false
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		if err != nil {
+			log.Println(err)
+			return false
+		}
+		return true
+	}
+
+	for _, e := range backlog {
+		if !write(e) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !write(e) {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,853 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	"github.com/graph-gophers/graphql-go/relay"
+	"github.com/ssOlexBaiko/library/circulation"
+	"github.com/ssOlexBaiko/library/storage"
+)
+
+// graphqlSchema describes the catalog and its circulation available through the GraphQL endpoint.
+// The prices are decimal strings, so they keep every digit, the times are in RFC 3339.
+const graphqlSchema = `
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+type Query {
+	book(id: ID!): Book
+	books(ids: [ID!]): [Book!]!
+	filter(price: String!, currency: String): [Book!]!
+	author(id: ID!): Author
+	authors: [Author!]!
+}
+
+type Mutation {
+	createBook(input: BookInput!): Book!
+	changeBook(id: ID!, input: BookChange!): Book!
+	removeBook(id: ID!): Boolean!
+	addAuthor(name: String!, books: [ID!]): Author!
+	addCopy(book: ID!, barcode: String): Copy!
+	placeHold(book: ID!, patron: String!): Hold!
+	cancelHold(id: ID!): Boolean!
+	checkout(copy: ID!, patron: String!, due: String): Loan!
+	returnLoan(id: ID!): Loan!
+}
+
+type Book {
+	id: ID!
+	title: String!
+	genres: [String!]!
+	pages: Int!
+	price: String!
+	currency: String!
+	author: Author
+	copies: [Copy!]!
+	holds: [Hold!]!
+	loans(active: Boolean): [Loan!]!
+}
+
+type Author {
+	id: ID!
+	name: String!
+	books: [Book!]!
+}
+
+type Copy {
+	id: ID!
+	barcode: String!
+	added: String!
+	available: Boolean!
+	loan: Loan
+}
+
+type Hold {
+	id: ID!
+	patron: String!
+	placed: String!
+}
+
+type Loan {
+	id: ID!
+	copyId: ID!
+	book: Book
+	patron: String!
+	borrowed: String!
+	due: String!
+	returned: String
+	overdue: Boolean!
+}
+
+input BookInput {
+	title: String!
+	genres: [String!]!
+	pages: Int!
+	price: String!
+	currency: String
+}
+
+input BookChange {
+	title: String
+	genres: [String!]
+	pages: Int
+	price: String
+	currency: String
+}
+`
+
+// errInvalidID describes the ID which is not a valid UUID
+var errInvalidID = errors.New("ID is not a valid UUID")
+
+type loaderKey struct{}
+
+// bookLoader loads the books and their circulation once per request, so resolving many books
+// doesn't end up with a storage call per book. The first single book is fetched by ID,
+// any other book makes the loader read the whole catalog once, so a request costs
+// at most one GetBook and one GetBooks call however many IDs it asks for.
+// The circulation of all the books resolved so far is looked up in one call.
+type bookLoader struct {
+	storage     Storage
+	circulation Circulation
+
+	mu    sync.Mutex
+	books storage.Books
+	index map[string]int
+	err   error
+	// byID keeps the books fetched one by one, nil for the missing ones
+	byID map[string]*storage.Book
+
+	// seen keeps the IDs of the resolved books in order, the circulation is loaded for all of them
+	seen    []string
+	known   map[string]bool
+	authors map[string]*circulation.Author
+	copies  map[string][]circulation.Copy
+	holds   map[string][]circulation.Hold
+	loans   map[string][]circulation.Loan
+}
+
+func newBookLoader(s Storage, c Circulation) *bookLoader {
+	return &bookLoader{storage: s, circulation: c}
+}
+
+func withBookLoader(ctx context.Context, s Storage, c Circulation) context.Context {
+	return context.WithValue(ctx, loaderKey{}, newBookLoader(s, c))
+}
+
+func loaderFrom(ctx context.Context, s Storage, c Circulation) *bookLoader {
+	if loader, ok := ctx.Value(loaderKey{}).(*bookLoader); ok {
+		return loader
+	}
+	return newBookLoader(s, c)
+}
+
+// loadBooks reads the catalog, it has to be called with the lock held
+func (l *bookLoader) loadBooks(ctx context.Context) error {
+	if l.index != nil || l.err != nil {
+		return l.err
+	}
+
+	l.books, l.err = l.storage.GetBooks(ctx)
+	if l.err != nil {
+		return l.err
+	}
+	l.index = make(map[string]int, len(l.books))
+	for i, book := range l.books {
+		l.index[book.ID] = i
+	}
+	return nil
+}
+
+// Books returns all books, the storage is called only for the first time
+func (l *bookLoader) Books(ctx context.Context) (storage.Books, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.loadBooks(ctx); err != nil {
+		return nil, err
+	}
+	return l.books, nil
+}
+
+// Book returns the book by ID, ok is false when there is no such book
+func (l *bookLoader) Book(ctx context.Context, id string) (storage.Book, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.book(ctx, id)
+}
+
+// BooksByID returns the books with given IDs in the same order, the missing ones are left out
+func (l *bookLoader) BooksByID(ctx context.Context, ids []string) (storage.Books, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(ids) > 1 {
+		if err := l.loadBooks(ctx); err != nil {
+			return nil, err
+		}
+	}
+	books := make(storage.Books, 0, len(ids))
+	for _, id := range ids {
+		book, ok, err := l.book(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			books = append(books, book)
+		}
+	}
+	return books, nil
+}
+
+// book returns the book by ID, it has to be called with the lock held
+func (l *bookLoader) book(ctx context.Context, id string) (storage.Book, bool, error) {
+	if book, ok := l.byID[id]; ok {
+		if book == nil {
+			return storage.Book{}, false, nil
+		}
+		return *book, true, nil
+	}
+	// only the first book is worth the call by ID, the catalog answers the rest at once
+	if l.index != nil || len(l.byID) > 0 {
+		if err := l.loadBooks(ctx); err != nil {
+			return storage.Book{}, false, err
+		}
+		i, ok := l.index[id]
+		if !ok {
+			return storage.Book{}, false, nil
+		}
+		return l.books[i], true, nil
+	}
+
+	book, err := l.storage.GetBook(ctx, id)
+	if err != nil && err != storage.ErrNotFound {
+		return storage.Book{}, false, err
+	}
+	if l.byID == nil {
+		l.byID = map[string]*storage.Book{}
+	}
+	if err == storage.ErrNotFound {
+		l.byID[id] = nil
+		return storage.Book{}, false, nil
+	}
+	l.byID[id] = &book
+	return book, true, nil
+}
+
+// see remembers the resolved books, so their circulation is looked up together
+func (l *bookLoader) see(books storage.Books) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.known == nil {
+		l.known = map[string]bool{}
+	}
+	for _, book := range books {
+		if !l.known[book.ID] {
+			l.known[book.ID] = true
+			l.seen = append(l.seen, book.ID)
+		}
+	}
+}
+
+// loadCirculation looks up the circulation of all the seen books which isn't loaded yet
+// together with the given book, it has to be called with the lock held
+func (l *bookLoader) loadCirculation(id string) {
+	if _, ok := l.copies[id]; ok {
+		return
+	}
+
+	ids := []string{id}
+	for _, seen := range l.seen {
+		if _, ok := l.copies[seen]; !ok && seen != id {
+			ids = append(ids, seen)
+		}
+	}
+
+	authors := l.circulation.AuthorsOf(ids)
+	copies := l.circulation.Copies(ids)
+	holds := l.circulation.Holds(ids)
+	loans := l.circulation.Loans(ids)
+	if l.copies == nil {
+		l.authors = map[string]*circulation.Author{}
+		l.copies = map[string][]circulation.Copy{}
+		l.holds = map[string][]circulation.Hold{}
+		l.loans = map[string][]circulation.Loan{}
+	}
+	for _, id := range ids {
+		if author, ok := authors[id]; ok {
+			l.authors[id] = &author
+		} else {
+			l.authors[id] = nil
+		}
+		l.copies[id] = copies[id]
+		l.holds[id] = holds[id]
+		l.loans[id] = loans[id]
+	}
+}
+
+// Author returns the author of the book, it's nil for the book without the author
+func (l *bookLoader) Author(id string) *circulation.Author {
+	if l.circulation == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.loadCirculation(id)
+	return l.authors[id]
+}
+
+// Copies returns the copies of the book
+func (l *bookLoader) Copies(id string) []circulation.Copy {
+	if l.circulation == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.loadCirculation(id)
+	return l.copies[id]
+}
+
+// Holds returns the queue for the book
+func (l *bookLoader) Holds(id string) []circulation.Hold {
+	if l.circulation == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.loadCirculation(id)
+	return l.holds[id]
+}
+
+// Loans returns the loans of the book
+func (l *bookLoader) Loans(id string) []circulation.Loan {
+	if l.circulation == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.loadCirculation(id)
+	return l.loans[id]
+}
+
+// reset drops loaded books and their circulation, it's called after every mutation
+func (l *bookLoader) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.books, l.index, l.err, l.byID = nil, nil, nil, nil
+	l.authors, l.copies, l.holds, l.loans = nil, nil, nil, nil
+}
+
+type graphqlResolver struct {
+	storage     Storage
+	circulation Circulation
+}
+
+func (r *graphqlResolver) loader(ctx context.Context) *bookLoader {
+	return loaderFrom(ctx, r.storage, r.circulation)
+}
+
+// graphqlTime formats the time of the GraphQL schema
+func graphqlTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+type bookResolver struct {
+	book   storage.Book
+	loader *bookLoader
+}
+
+func (r *bookResolver) ID() graphql.ID   { return graphql.ID(r.book.ID) }
+func (r *bookResolver) Title() string    { return r.book.Title }
+func (r *bookResolver) Genres() []string { return append([]string{}, r.book.Genres...) }
+func (r *bookResolver) Pages() int32     { return int32(r.book.Pages) }
+func (r *bookResolver) Price() string    { return r.book.Price.String() }
+func (r *bookResolver) Currency() string { return r.book.Money().Currency }
+
+// Author resolves the author of the book, it's null when the book has no author
+func (r *bookResolver) Author() *authorResolver {
+	author := r.loader.Author(r.book.ID)
+	if author == nil {
+		return nil
+	}
+	return &authorResolver{*author, r.loader}
+}
+
+// Copies resolves the copies of the book in the order they were added
+func (r *bookResolver) Copies() []*copyResolver {
+	copies := r.loader.Copies(r.book.ID)
+	resolvers := make([]*copyResolver, 0, len(copies))
+	for _, c := range copies {
+		resolvers = append(resolvers, &copyResolver{c, r.loader})
+	}
+	return resolvers
+}
+
+// Holds resolves the queue for the book, the first hold was placed first
+func (r *bookResolver) Holds() []*holdResolver {
+	holds := r.loader.Holds(r.book.ID)
+	resolvers := make([]*holdResolver, 0, len(holds))
+	for _, hold := range holds {
+		resolvers = append(resolvers, &holdResolver{hold})
+	}
+	return resolvers
+}
+
+// Loans resolves the loans of the book, only the active or the returned ones when active is given
+func (r *bookResolver) Loans(args struct{ Active *bool }) []*loanResolver {
+	loans := r.loader.Loans(r.book.ID)
+	resolvers := make([]*loanResolver, 0, len(loans))
+	for _, loan := range loans {
+		if args.Active == nil || *args.Active == loan.Active() {
+			resolvers = append(resolvers, &loanResolver{loan, r.loader})
+		}
+	}
+	return resolvers
+}
+
+func (l *bookLoader) resolvers(books storage.Books) []*bookResolver {
+	l.see(books)
+	resolvers := make([]*bookResolver, 0, len(books))
+	for _, book := range books {
+		resolvers = append(resolvers, &bookResolver{book, l})
+	}
+	return resolvers
+}
+
+func (l *bookLoader) resolver(book storage.Book) *bookResolver {
+	return l.resolvers(storage.Books{book})[0]
+}
+
+type authorResolver struct {
+	author circulation.Author
+	loader *bookLoader
+}
+
+func (r *authorResolver) ID() graphql.ID { return graphql.ID(r.author.ID) }
+func (r *authorResolver) Name() string   { return r.author.Name }
+
+// Books resolves the books of the author which are in the catalog
+func (r *authorResolver) Books(ctx context.Context) ([]*bookResolver, error) {
+	books, err := r.loader.BooksByID(ctx, r.author.Books)
+	if err != nil {
+		return nil, err
+	}
+	return r.loader.resolvers(books), nil
+}
+
+type copyResolver struct {
+	copy   circulation.Copy
+	loader *bookLoader
+}
+
+func (r *copyResolver) ID() graphql.ID  { return graphql.ID(r.copy.ID) }
+func (r *copyResolver) Barcode() string { return r.copy.Barcode }
+func (r *copyResolver) Added() string   { return graphqlTime(r.copy.Added) }
+
+// Available resolves whether the copy isn't on loan
+func (r *copyResolver) Available() bool {
+	return r.Loan() == nil
+}
+
+// Loan resolves the active loan of the copy, it's null when the copy is available
+func (r *copyResolver) Loan() *loanResolver {
+	for _, loan := range r.loader.Loans(r.copy.BookID) {
+		if loan.CopyID == r.copy.ID && loan.Active() {
+			return &loanResolver{loan, r.loader}
+		}
+	}
+	return nil
+}
+
+type holdResolver struct {
+	hold circulation.Hold
+}
+
+func (r *holdResolver) ID() graphql.ID { return graphql.ID(r.hold.ID) }
+func (r *holdResolver) Patron() string { return r.hold.Patron }
+func (r *holdResolver) Placed() string { return graphqlTime(r.hold.Placed) }
+
+type loanResolver struct {
+	loan   circulation.Loan
+	loader *bookLoader
+}
+
+func (r *loanResolver) ID() graphql.ID     { return graphql.ID(r.loan.ID) }
+func (r *loanResolver) CopyID() graphql.ID { return graphql.ID(r.loan.CopyID) }
+func (r *loanResolver) Patron() string     { return r.loan.Patron }
+func (r *loanResolver) Borrowed() string   { return graphqlTime(r.loan.Borrowed) }
+func (r *loanResolver) Due() string        { return graphqlTime(r.loan.Due) }
+func (r *loanResolver) Overdue() bool      { return r.loan.Overdue(time.Now()) }
+
+// Returned resolves the time the copy was returned, it's null for the active loan
+func (r *loanResolver) Returned() *string {
+	if r.loan.Returned == nil {
+		return nil
+	}
+	returned := graphqlTime(*r.loan.Returned)
+	return &returned
+}
+
+// Book resolves the lent book, it's null when the book is removed from the catalog
+func (r *loanResolver) Book(ctx context.Context) (*bookResolver, error) {
+	book, ok, err := r.loader.Book(ctx, r.loan.BookID)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return r.loader.resolver(book), nil
+}
+
+// Book resolves a single book, it's null when there is no such book
+func (r *graphqlResolver) Book(ctx context.Context, args struct{ ID graphql.ID }) (*bookResolver, error) {
+	if !validID(string(args.ID)) {
+		return nil, errInvalidID
+	}
+
+	loader := r.loader(ctx)
+	book, ok, err := loader.Book(ctx, string(args.ID))
+	if err != nil || !ok {
+		return nil, err
+	}
+	return loader.resolver(book), nil
+}
+
+// Books resolves all books or only the books with given IDs
+func (r *graphqlResolver) Books(ctx context.Context, args struct{ IDs *[]graphql.ID }) ([]*bookResolver, error) {
+	loader := r.loader(ctx)
+	if args.IDs == nil {
+		books, err := loader.Books(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return loader.resolvers(books), nil
+	}
+
+	ids := make([]string, 0, len(*args.IDs))
+	for _, id := range *args.IDs {
+		ids = append(ids, string(id))
+	}
+	books, err := loader.BooksByID(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	return loader.resolvers(books), nil
+}
+
+// Filter resolves books matching the price filter, the prices are converted into the currency when it's given
+func (r *graphqlResolver) Filter(ctx context.Context, args struct {
+	Price    string
+	Currency *string
+}) ([]*bookResolver, error) {
+	filter := storage.BookFilter{Price: args.Price}
+	if args.Currency != nil {
+		filter.Currency = *args.Currency
+	}
+	books, err := r.storage.PriceFilter(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return r.loader(ctx).resolvers(books), nil
+}
+
+// Author resolves the author by ID, it's null when there is no such author
+func (r *graphqlResolver) Author(ctx context.Context, args struct{ ID graphql.ID }) (*authorResolver, error) {
+	if r.circulation == nil {
+		return nil, nil
+	}
+	author, err := r.circulation.Author(string(args.ID))
+	if err == circulation.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &authorResolver{author, r.loader(ctx)}, nil
+}
+
+// Authors resolves all the authors ordered by the name
+func (r *graphqlResolver) Authors(ctx context.Context) []*authorResolver {
+	if r.circulation == nil {
+		return []*authorResolver{}
+	}
+	loader := r.loader(ctx)
+	authors := r.circulation.Authors()
+	resolvers := make([]*authorResolver, 0, len(authors))
+	for _, author := range authors {
+		resolvers = append(resolvers, &authorResolver{author, loader})
+	}
+	return resolvers
+}
+
+type bookInput struct {
+	Title    string
+	Genres   []string
+	Pages    int32
+	Price    string
+	Currency *string
+}
+
+type bookChange struct {
+	Title    *string
+	Genres   *[]string
+	Pages    *int32
+	Price    *string
+	Currency *string
+}
+
+// graphqlPrice parses the decimal string of the GraphQL schema to the exact price
+func graphqlPrice(price string) (storage.Decimal, error) {
+	d, err := storage.ParseDecimal(price)
+	if err != nil {
+		return storage.Decimal{}, fmt.Errorf("%w: %v", storage.ErrInvalid, err)
+	}
+	return d, nil
+}
+
+// CreateBook creates a book, validation is the same as in BookCreateHandler
+func (r *graphqlResolver) CreateBook(ctx context.Context, args struct{ Input bookInput }) (*bookResolver, error) {
+	if !allowed(ctx, RoleEditor) {
+		return nil, errForbidden
+	}
+	price, err := graphqlPrice(args.Input.Price)
+	if err != nil {
+		return nil, err
+	}
+	book := storage.Book{
+		Title:  args.Input.Title,
+		Genres: args.Input.Genres,
+		Pages:  int(args.Input.Pages),
+		Price:  price,
+	}
+	if args.Input.Currency != nil {
+		book.Currency = *args.Input.Currency
+	}
+	book, err = r.storage.CreateBook(ctx, book)
+	if err != nil {
+		return nil, err
+	}
+	loader := r.loader(ctx)
+	loader.reset()
+	return loader.resolver(book), nil
+}
+
+// ChangeBook changes given fields of the book like ChangeBookHandler does
+func (r *graphqlResolver) ChangeBook(ctx context.Context, args struct {
+	ID    graphql.ID
+	Input bookChange
+}) (*bookResolver, error) {
+	if !allowed(ctx, RoleEditor) {
+		return nil, errForbidden
+	}
+	id := string(args.ID)
+	if !validID(id) {
+		return nil, errInvalidID
+	}
+
+	book, err := r.storage.GetBook(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if args.Input.Title != nil {
+		book.Title = *args.Input.Title
+	}
+	if args.Input.Genres != nil {
+		book.Genres = *args.Input.Genres
+	}
+	if args.Input.Pages != nil {
+		book.Pages = int(*args.Input.Pages)
+	}
+	if args.Input.Price != nil {
+		if book.Price, err = graphqlPrice(*args.Input.Price); err != nil {
+			return nil, err
+		}
+	}
+	if args.Input.Currency != nil {
+		book.Currency = *args.Input.Currency
+	}
+
+	err = r.storage.ChangeBook(ctx, id, book)
+	if err != nil {
+		return nil, err
+	}
+	loader := r.loader(ctx)
+	loader.reset()
+	return loader.resolver(book), nil
+}
+
+// RemoveBook removes the book like RemoveBookHandler does
+func (r *graphqlResolver) RemoveBook(ctx context.Context, args struct{ ID graphql.ID }) (bool, error) {
+	if !allowed(ctx, RoleEditor) {
+		return false, errForbidden
+	}
+	id := string(args.ID)
+	if !validID(id) {
+		return false, errInvalidID
+	}
+
+	err := r.storage.RemoveBook(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	r.loader(ctx).reset()
+	return true, nil
+}
+
+// changeCirculation checks the client may change the circulation and the book exists
+func (r *graphqlResolver) changeCirculation(ctx context.Context, bookIDs ...graphql.ID) error {
+	if !allowed(ctx, RoleEditor) {
+		return errForbidden
+	}
+	if r.circulation == nil {
+		return errNoCirculation
+	}
+	for _, id := range bookIDs {
+		if !validID(string(id)) {
+			return errInvalidID
+		}
+		if _, ok, err := r.loader(ctx).Book(ctx, string(id)); err != nil || !ok {
+			if err == nil {
+				err = storage.ErrNotFound
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// AddAuthor adds the author of the books from the catalog
+func (r *graphqlResolver) AddAuthor(ctx context.Context, args struct {
+	Name  string
+	Books *[]graphql.ID
+}) (*authorResolver, error) {
+	var ids []graphql.ID
+	if args.Books != nil {
+		ids = *args.Books
+	}
+	if err := r.changeCirculation(ctx, ids...); err != nil {
+		return nil, err
+	}
+
+	author := circulation.Author{Name: args.Name}
+	for _, id := range ids {
+		author.Books = append(author.Books, string(id))
+	}
+	author, err := r.circulation.AddAuthor(author)
+	if err != nil {
+		return nil, err
+	}
+	loader := r.loader(ctx)
+	loader.reset()
+	return &authorResolver{author, loader}, nil
+}
+
+// AddCopy adds the copy of the book which can be lent
+func (r *graphqlResolver) AddCopy(ctx context.Context, args struct {
+	Book    graphql.ID
+	Barcode *string
+}) (*copyResolver, error) {
+	if err := r.changeCirculation(ctx, args.Book); err != nil {
+		return nil, err
+	}
+
+	var barcode string
+	if args.Barcode != nil {
+		barcode = *args.Barcode
+	}
+	c, err := r.circulation.AddCopy(string(args.Book), barcode)
+	if err != nil {
+		return nil, err
+	}
+	loader := r.loader(ctx)
+	loader.reset()
+	return &copyResolver{c, loader}, nil
+}
+
+// PlaceHold puts the patron in the queue for the book
+func (r *graphqlResolver) PlaceHold(ctx context.Context, args struct {
+	Book   graphql.ID
+	Patron string
+}) (*holdResolver, error) {
+	if err := r.changeCirculation(ctx, args.Book); err != nil {
+		return nil, err
+	}
+
+	hold, err := r.circulation.PlaceHold(string(args.Book), args.Patron)
+	if err != nil {
+		return nil, err
+	}
+	r.loader(ctx).reset()
+	return &holdResolver{hold}, nil
+}
+
+// CancelHold removes the patron from the queue
+func (r *graphqlResolver) CancelHold(ctx context.Context, args struct{ ID graphql.ID }) (bool, error) {
+	if err := r.changeCirculation(ctx); err != nil {
+		return false, err
+	}
+
+	if err := r.circulation.CancelHold(string(args.ID)); err != nil {
+		return false, err
+	}
+	r.loader(ctx).reset()
+	return true, nil
+}
+
+// Checkout lends the copy to the patron, the due date is circulation.LoanPeriod from now when it's not given
+func (r *graphqlResolver) Checkout(ctx context.Context, args struct {
+	Copy   graphql.ID
+	Patron string
+	Due    *string
+}) (*loanResolver, error) {
+	if err := r.changeCirculation(ctx); err != nil {
+		return nil, err
+	}
+
+	var due time.Time
+	if args.Due != nil {
+		var err error
+		if due, err = time.Parse(time.RFC3339, *args.Due); err != nil {
+			return nil, fmt.Errorf("%w: %v", storage.ErrInvalid, err)
+		}
+	}
+	loan, err := r.circulation.Checkout(string(args.Copy), args.Patron, due)
+	if err != nil {
+		return nil, err
+	}
+	loader := r.loader(ctx)
+	loader.reset()
+	return &loanResolver{loan, loader}, nil
+}
+
+// ReturnLoan takes the copy back from the patron
+func (r *graphqlResolver) ReturnLoan(ctx context.Context, args struct{ ID graphql.ID }) (*loanResolver, error) {
+	if err := r.changeCirculation(ctx); err != nil {
+		return nil, err
+	}
+
+	loan, err := r.circulation.Return(string(args.ID))
+	if err != nil {
+		return nil, err
+	}
+	loader := r.loader(ctx)
+	loader.reset()
+	return &loanResolver{loan, loader}, nil
+}
+
+// newGraphQLHandler returns handler of the GraphQL queries over the storage and the circulation, which may be nil
+func newGraphQLHandler(s Storage, c Circulation) http.Handler {
+	return &relay.Handler{
+		Schema: graphql.MustParseSchema(graphqlSchema, &graphqlResolver{storage: s, circulation: c}),
+	}
+}
+
+// GraphQLHandler handles requests with POST method and executes GraphQL queries
+func (h *handler) GraphQLHandler(w http.ResponseWriter, r *http.Request) {
+	h.graphql.ServeHTTP(w, r.WithContext(withBookLoader(r.Context(), h.storage, h.circulation)))
+}
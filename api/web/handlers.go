@@ -1,10 +1,15 @@
 package web
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"path"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/ssOlexBaiko/library/storage"
@@ -12,22 +17,122 @@ import (
 )
 
 type handler struct {
-	storage Storage
+	storage     Storage
+	metrics     http.Handler
+	graphql     http.Handler
+	webhooks    Webhooks
+	rates       Rates
+	circulation Circulation
+	events      *EventStream
+	replication Replication
+	routes      []mountedRoute
+
+	cachePolicies  map[string]string
+	timeouts       map[string]time.Duration
+	defaultTimeout time.Duration
+	tokens         map[string]string
+	clientRoles    map[string]string
+	maxBodyBytes   int64
+	cors           *CORSOptions
+	idempotency    *idempotencyStore
 }
 
 type Storage interface {
-	GetBooks() (storage.Books, error)
-	CreateBook(book storage.Book) error
-	GetBook(id string) (storage.Book, error)
-	RemoveBook(id string) error
-	ChangeBook(id string, changedBook storage.Book) error
-	PriceFilter(filter storage.BookFilter) (storage.Books, error)
+	GetBooks(ctx context.Context) (storage.Books, error)
+	CreateBook(ctx context.Context, book storage.Book) (storage.Book, error)
+	GetBook(ctx context.Context, id string) (storage.Book, error)
+	RemoveBook(ctx context.Context, id string) error
+	ChangeBook(ctx context.Context, id string, changedBook storage.Book) error
+	PriceFilter(ctx context.Context, filter storage.BookFilter) (storage.Books, error)
+	Batch(ctx context.Context, ops []storage.Operation) ([]storage.OperationResult, error)
+	Reprice(ctx context.Context, reprice storage.Reprice) (storage.RepriceResult, error)
+	PriceHistory(ctx context.Context, id string) (storage.PriceRecords, error)
+	Checks() []storage.Check
+	Changes(ctx context.Context, since uint64) (storage.Changes, uint64, error)
+	Version(ctx context.Context) (uint64, time.Time, error)
+}
+
+// StorageMiddleware wraps the storage with a cross-cutting concern like HTTP middleware wraps handlers
+type StorageMiddleware func(Storage) Storage
+
+// ChainStorage wraps the storage with the middlewares, the first one is the outermost,
+// so it sees the calls first and the results last
+func ChainStorage(storage Storage, middlewares ...StorageMiddleware) Storage {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		storage = middlewares[i](storage)
+	}
+	return storage
+}
+
+// Option configures optional parts of the handler
+type Option func(*handler)
+
+// WithWebhooks enables management of the webhook subscriptions
+func WithWebhooks(webhooks Webhooks) Option {
+	return func(h *handler) {
+		h.webhooks = webhooks
+	}
+}
+
+// WithEventStream enables streaming of the catalog events
+func WithEventStream(events *EventStream) Option {
+	return func(h *handler) {
+		h.events = events
+	}
+}
+
+// WithReplication enables the replication status
+func WithReplication(replication Replication) Option {
+	return func(h *handler) {
+		h.replication = replication
+	}
 }
 
-func NewHandler(storage Storage) *handler {
-	return &handler{
+// WithMaxBodyBytes rejects the request bodies larger than n bytes
+func WithMaxBodyBytes(n int64) Option {
+	return func(h *handler) {
+		h.maxBodyBytes = n
+	}
+}
+
+func NewHandler(storage Storage, options ...Option) *handler {
+	h := &handler{
 		storage: storage,
+
+		cachePolicies:  map[string]string{},
+		timeouts:       map[string]time.Duration{},
+		defaultTimeout: defaultTimeout,
+		idempotency:    newIdempotencyStore(defaultIdempotencyRetention),
+	}
+	for route, policy := range defaultCachePolicies {
+		h.cachePolicies[route] = policy
+	}
+	for route, timeout := range defaultRouteTimeouts {
+		h.timeouts[route] = timeout
+	}
+	for _, option := range options {
+		option(h)
 	}
+	h.metrics = newMetricsHandler(storage, h.circulation)
+	h.graphql = newGraphQLHandler(storage, h.circulation)
+	return h
+}
+
+// created writes the resource made by the POST request to the collection,
+// Location points to the resource under the path of the collection, so the versioned routes keep their version
+func created(w http.ResponseWriter, r *http.Request, id string, resource interface{}) {
+	w.Header().Set("Location", path.Join(r.URL.Path, id))
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(resource); err != nil {
+		log.Println(err)
+	}
+}
+
+// validID checks that id of the book is a valid UUID
+func validID(id string) bool {
+	_, err := uuid.Parse(id)
+	return err == nil
 }
 
 // IndexHandler handles requests with GET method
@@ -43,14 +148,38 @@ func (h *handler) IndexHandler(w http.ResponseWriter, _ *http.Request) {
 }
 
 // BooksIndexHandler handles requests with GET method
-func (h *handler) BooksIndexHandler(w http.ResponseWriter, _ *http.Request) {
+func (h *handler) BooksIndexHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("BooksIndex - call")
-	books, err := h.storage.GetBooks()
+	seq, modified, err := h.storage.Version(r.Context())
+	var parts []string
+	currency := listingCurrency(r)
+	if currency != "" {
+		var rates string
+		rates, modified = h.ratesVersion(modified)
+		parts = append(parts, "currency="+currency, rates)
+	}
+	if err != nil {
+		log.Println(err)
+	} else if notModified(w, r, catalogETag(seq, parts...), modified) {
+		return
+	}
+
+	books, err := h.storage.GetBooks(r.Context())
 	if err != nil {
+		if canceled(w, err) {
+			return
+		}
 		log.Println(err)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if currency != "" {
+		if books, err = h.convertBooks(books, currency); err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
 
 	err = json.NewEncoder(w).Encode(books)
 	if err != nil {
@@ -73,16 +202,23 @@ func (h *handler) BookCreateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.storage.CreateBook(book)
+	book, err = h.storage.CreateBook(r.Context(), book)
 	if err != nil {
+		if canceled(w, err) {
+			return
+		}
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		if errors.Is(err, storage.ErrInvalid) {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Println(err)
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Println(err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusCreated)
+	created(w, r, book.ID, book)
 }
 
 // GetBookHandler handles requests with GET method
@@ -91,14 +227,16 @@ func (h *handler) GetBookHandler(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
 	id, ok := vars["id"]
-	_, err := uuid.Parse(id)
-	if !ok || err != nil {
+	if !ok || !validID(id) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	book, err := h.storage.GetBook(id)
+	book, err := h.storage.GetBook(r.Context(), id)
 	if err != nil {
+		if canceled(w, err) {
+			return
+		}
 		if err == storage.ErrNotFound {
 			w.WriteHeader(http.StatusNotFound)
 			return
@@ -108,12 +246,26 @@ func (h *handler) GetBookHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = json.NewEncoder(w).Encode(book)
+	var body bytes.Buffer
+	err = json.NewEncoder(&body).Encode(book)
 	if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+
+	_, modified, err := h.storage.Version(r.Context())
+	if err != nil {
+		log.Println(err)
+	}
+	if notModified(w, r, contentETag(body.Bytes()), modified) {
+		return
+	}
+
+	_, err = w.Write(body.Bytes())
+	if err != nil {
+		log.Println(err)
+	}
 }
 
 // RemoveBookHandler handles requests with DELETE method
@@ -122,14 +274,16 @@ func (h *handler) RemoveBookHandler(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
 	id, ok := vars["id"]
-	_, err := uuid.Parse(id)
-	if !ok || err != nil {
+	if !ok || !validID(id) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	err = h.storage.RemoveBook(id)
+	err := h.storage.RemoveBook(r.Context(), id)
 	if err != nil {
+		if canceled(w, err) {
+			return
+		}
 		if err == storage.ErrNotFound {
 			w.WriteHeader(http.StatusNotFound)
 			return
@@ -152,8 +306,11 @@ func (h *handler) ChangeBookHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	book, err := h.storage.GetBook(id)
+	book, err := h.storage.GetBook(r.Context(), id)
 	if err != nil {
+		if canceled(w, err) {
+			return
+		}
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
@@ -166,12 +323,20 @@ func (h *handler) ChangeBookHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.storage.ChangeBook(id, book)
+	err = h.storage.ChangeBook(r.Context(), id, book)
 	if err != nil {
+		if canceled(w, err) {
+			return
+		}
 		if err == storage.ErrNotFound {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		if errors.Is(err, storage.ErrInvalid) {
+			w.WriteHeader(http.StatusBadRequest)
+			log.Println(err)
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		log.Println(err)
 		return
@@ -191,13 +356,48 @@ func (h *handler) BookFilterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	books, err := h.storage.PriceFilter(filter)
+	// the prices are compared in the currency of the listing unless the filter has its own
+	currency := listingCurrency(r)
+	if filter.Currency == "" {
+		filter.Currency = currency
+	}
+
+	// the filter is a safe query, so it's answered with 304 like GET requests
+	seq, modified, err := h.storage.Version(r.Context())
+	parts := []string{filter.Key()}
+	if filter.Currency != "" {
+		var rates string
+		rates, modified = h.ratesVersion(modified)
+		parts = append(parts, "currency="+currency, rates)
+	}
 	if err != nil {
 		log.Println(err)
+	} else if notModified(w, r, catalogETag(seq, parts...), modified) {
+		return
+	}
+
+	books, err := h.storage.PriceFilter(r.Context(), filter)
+	if err != nil {
+		if canceled(w, err) {
+			return
+		}
+		log.Println(err)
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		if errors.Is(err, storage.ErrInvalid) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if currency != "" {
+		if books, err = h.convertBooks(books, currency); err != nil {
+			log.Println(err)
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
 
 	err = json.NewEncoder(w).Encode(books)
 	if err != nil {
@@ -206,3 +406,8 @@ func (h *handler) BookFilterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// MetricsHandler handles requests with GET method and exposes metrics in the Prometheus format
+func (h *handler) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	h.metrics.ServeHTTP(w, r)
+}
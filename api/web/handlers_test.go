@@ -2,15 +2,34 @@ package web
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/ssOlexBaiko/library/circulation"
+	"github.com/ssOlexBaiko/library/rates"
 	"github.com/ssOlexBaiko/library/storage"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 // add flag for setting path to the storage and for using sql db
@@ -19,8 +38,7 @@ var (
 	sqlUse      = flag.Bool("sqlUse", false, "use sql db instead of json file")
 )
 
-func getTestBooks(t *testing.T) (storage.Books, error) {
-	//t.Helper() //is available in go1.9 release
+func getTestBooks(library Storage) (storage.Books, error) {
 	req, err := http.NewRequest("GET", "/books", nil)
 	if err != nil {
 		return nil, err
@@ -29,7 +47,7 @@ func getTestBooks(t *testing.T) (storage.Books, error) {
 	rr := httptest.NewRecorder()
 
 	handler := NewRouter(NewHandler(
-		storage.NewLibrary(*testLibPath, *sqlUse)),
+		library),
 	)
 	handler.ServeHTTP(rr, req)
 	if rr.Code != http.StatusOK {
@@ -56,7 +74,7 @@ func TestIndexHandler(t *testing.T) {
 	rr := httptest.NewRecorder()
 
 	handler := NewRouter(NewHandler(
-		storage.NewLibrary(*testLibPath, *sqlUse)),
+		testLibrary(t)),
 	)
 	handler.ServeHTTP(rr, req)
 	if status := rr.Code; status != http.StatusOK {
@@ -73,13 +91,15 @@ func TestIndexHandler(t *testing.T) {
 
 func TestBooksIndexHandler(t *testing.T) {
 	test := assert.New(t)
-	_, err := getTestBooks(t)
+	library := testLibrary(t)
+	_, err := getTestBooks(library)
 	test.NoError(err, "test failed")
 }
 
 func TestGetBookHandler(t *testing.T) {
 	test := assert.New(t)
-	books, err := getTestBooks(t)
+	library := testLibrary(t)
+	books, err := getTestBooks(library)
 	test.NoError(err, "test failed")
 
 	url := "/books/" + books[0].ID
@@ -91,7 +111,7 @@ func TestGetBookHandler(t *testing.T) {
 	rr := httptest.NewRecorder()
 
 	handler := NewRouter(NewHandler(
-		storage.NewLibrary(*testLibPath, *sqlUse)),
+		library),
 	)
 	handler.ServeHTTP(rr, req)
 
@@ -103,11 +123,12 @@ func TestGetBookHandler(t *testing.T) {
 }
 
 func TestBookCreateHandler(t *testing.T) {
+	library := testLibrary(t)
 	testBook := storage.Book{
 		Title:  "TestBook",
 		Genres: []string{"test1", "test2"},
 		Pages:  777,
-		Price:  777,
+		Price:  storage.MustDecimal("777"),
 	}
 
 	book, err := json.Marshal(testBook)
@@ -124,7 +145,7 @@ func TestBookCreateHandler(t *testing.T) {
 	rr := httptest.NewRecorder()
 
 	handler := NewRouter(NewHandler(
-		storage.NewLibrary(*testLibPath, *sqlUse)),
+		library),
 	)
 	handler.ServeHTTP(rr, req)
 	if status := rr.Code; status != http.StatusCreated {
@@ -132,11 +153,20 @@ func TestBookCreateHandler(t *testing.T) {
 			status, http.StatusCreated)
 	}
 
+	// the created book comes back with its ID and location
+	var created storage.Book
+	if err = json.NewDecoder(rr.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, validID(created.ID), "handler returned no ID")
+	assert.Equal(t, testBook.Title, created.Title)
+	assert.Equal(t, "/books/"+created.ID, rr.Header().Get("Location"))
+
 	// Check data!
-	books, err := getTestBooks(t)
+	books, err := getTestBooks(library)
 	addedBook := false
 	for _, b := range books {
-		if b.Title == testBook.Title {
+		if b.ID == created.ID && b.Title == testBook.Title {
 			addedBook = true
 		}
 	}
@@ -146,7 +176,8 @@ func TestBookCreateHandler(t *testing.T) {
 }
 
 func TestRemoveBookHandler(t *testing.T) {
-	books, err := getTestBooks(t)
+	library := testLibrary(t)
+	books, err := getTestBooks(library)
 	if err != nil {
 		t.Errorf("test failed: %v", err)
 	}
@@ -161,7 +192,7 @@ func TestRemoveBookHandler(t *testing.T) {
 
 	handler := NewRouter(
 		NewHandler(
-			storage.NewLibrary(*testLibPath, *sqlUse)),
+			library),
 	)
 	handler.ServeHTTP(rr, req)
 	if status := rr.Code; status != http.StatusNoContent {
@@ -171,7 +202,8 @@ func TestRemoveBookHandler(t *testing.T) {
 }
 
 func TestChangeBookHandler(t *testing.T) {
-	books, err := getTestBooks(t)
+	library := testLibrary(t)
+	books, err := getTestBooks(library)
 	if err != nil {
 		t.Errorf("test failed: %v", err)
 	}
@@ -192,7 +224,7 @@ func TestChangeBookHandler(t *testing.T) {
 	rr := httptest.NewRecorder()
 
 	handler := NewRouter(NewHandler(
-		storage.NewLibrary(*testLibPath, *sqlUse)),
+		library),
 	)
 	handler.ServeHTTP(rr, req)
 	if status := rr.Code; status != http.StatusOK {
@@ -218,7 +250,7 @@ func TestBookFilterHandler(t *testing.T) {
 
 	handler := NewRouter(
 		NewHandler(
-			storage.NewLibrary(*testLibPath, *sqlUse)),
+			testLibrary(t)),
 	)
 	handler.ServeHTTP(rr, req)
 	if status := rr.Code; status != http.StatusOK {
@@ -227,6 +259,1222 @@ func TestBookFilterHandler(t *testing.T) {
 	}
 }
 
+func TestMetricsHandler(t *testing.T) {
+	test := assert.New(t)
+	library := tempLibrary(t, `[
+		{"id": "0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1", "title": "Emma", "genres": ["novel"], "pages": 300, "price": 12}
+	]`)
+	handler := NewRouter(NewHandler(library))
+	scrape := func() string {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+		test.Equal(http.StatusOK, rr.Code, "handler returned wrong status code")
+		return rr.Body.String()
+	}
+
+	// the counters are shared by the whole package, so only their growth is checked
+	const (
+		requests   = `library_http_requests_total{code="200",method="GET",route="BooksIndex",version=""}`
+		operations = `library_storage_operation_duration_seconds_count{backend="json",method="GetBooks"}`
+	)
+	before := scrape()
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/books", nil))
+	test.Equal(http.StatusOK, rr.Code)
+	after := scrape()
+
+	test.Equal(1.0, metricValue(t, after, requests)-metricValue(t, before, requests))
+	test.True(metricValue(t, after, operations) > metricValue(t, before, operations))
+	test.Equal(1.0, metricValue(t, after, "library_books"))
+	test.NotContains(after, "library_loans_active", "the loans aren't there without the circulation")
+
+	dir, err := ioutil.TempDir("", "circulation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	desk, err := circulation.NewDesk(filepath.Join(dir, "circulation.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, due := range []time.Time{time.Now().Add(time.Hour), time.Now().Add(-time.Hour), {}} {
+		copy, err := desk.AddCopy("0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1", strconv.Itoa(i))
+		test.NoError(err)
+		loan, err := desk.Checkout(copy.ID, "alice", due)
+		test.NoError(err)
+		if due.IsZero() {
+			_, err = desk.Return(loan.ID)
+			test.NoError(err)
+		}
+	}
+	handler = NewRouter(NewHandler(library, WithCirculation(desk)))
+	after = scrape()
+	test.Equal(2.0, metricValue(t, after, "library_loans_active"))
+	test.Equal(1.0, metricValue(t, after, "library_loans_overdue"))
+}
+
+// metricValue returns the value of the sample in the Prometheus text format, it's zero when the sample isn't there
+func metricValue(t *testing.T, body, sample string) float64 {
+	for _, line := range strings.Split(body, "\n") {
+		if !strings.HasPrefix(line, sample+" ") {
+			continue
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimPrefix(line, sample)), 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	return 0
+}
+
+func TestReadyzHandler(t *testing.T) {
+	test := assert.New(t)
+
+	req, err := http.NewRequest("GET", "/readyz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler := NewRouter(NewHandler(
+		testLibrary(t)),
+	)
+	handler.ServeHTTP(rr, req)
+
+	test.Equal(http.StatusOK, rr.Code, "handler returned wrong status code")
+
+	var result readiness
+	err = json.NewDecoder(rr.Body).Decode(&result)
+	test.NoError(err, "handler returned wrong data")
+	test.Equal(statusOK, result.Status)
+	test.Len(result.Checks, 2)
+}
+
+func TestGraphQLHandler(t *testing.T) {
+	test := assert.New(t)
+	library := testLibrary(t)
+	books, err := getTestBooks(library)
+	test.NoError(err, "test failed")
+
+	query, err := json.Marshal(map[string]interface{}{
+		"query":     `query($id: ID!) { book(id: $id) { id title } books { id } }`,
+		"variables": map[string]interface{}{"id": books[0].ID},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/v1/graphql", bytes.NewReader(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler := NewRouter(NewHandler(
+		library),
+	)
+	handler.ServeHTTP(rr, req)
+
+	test.Equal(http.StatusOK, rr.Code, "handler returned wrong status code")
+
+	var result struct {
+		Data struct {
+			Book  storage.Book
+			Books storage.Books
+		}
+		Errors []interface{}
+	}
+	err = json.NewDecoder(rr.Body).Decode(&result)
+	test.NoError(err, "handler returned wrong data")
+	test.Empty(result.Errors)
+	test.Equal(books[0].ID, result.Data.Book.ID)
+	test.Len(result.Data.Books, len(books))
+}
+
+// readCounting counts the reads of the catalog
+type readCounting struct {
+	Storage
+	getBooks, getBook int
+}
+
+func (s *readCounting) GetBooks(ctx context.Context) (storage.Books, error) {
+	s.getBooks++
+	return s.Storage.GetBooks(ctx)
+}
+
+func (s *readCounting) GetBook(ctx context.Context, id string) (storage.Book, error) {
+	s.getBook++
+	return s.Storage.GetBook(ctx, id)
+}
+
+func TestGraphQLBookLoader(t *testing.T) {
+	test := assert.New(t)
+	counting := &readCounting{Storage: tempLibrary(t, `[
+		{"id": "0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1", "title": "Emma", "genres": ["novel"], "pages": 300, "price": 12},
+		{"id": "6c4a9e0e-3f4b-4b8e-8a53-62e2d5f0c7a2", "title": "Ulysses", "genres": ["novel"], "pages": 700, "price": 20}
+	]`)}
+	handler := NewRouter(NewHandler(counting))
+	query := func(q string) string {
+		body, err := json.Marshal(map[string]interface{}{"query": q})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/graphql", bytes.NewReader(body)))
+		test.Equal(http.StatusOK, rr.Code)
+		return rr.Body.String()
+	}
+
+	// the single book is fetched by ID
+	body := query(`{ book(id: "0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1") { title price } }`)
+	test.Contains(body, `"book":{"title":"Emma","price":"12"}`)
+	test.Equal(0, counting.getBooks, "the catalog isn't loaded for the single book")
+	test.Equal(1, counting.getBook)
+
+	// any other book is answered by the catalog, so the request costs one call of each kind at most
+	counting.getBook = 0
+	body = query(`{ a: book(id: "0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1") { title } b: book(id: "0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1") { title }
+		c: book(id: "6c4a9e0e-3f4b-4b8e-8a53-62e2d5f0c7a2") { title } missing: book(id: "9b2f6c1d-5e7a-4f3b-8c9d-0a1b2c3d4e5f") { title } }`)
+	test.Contains(body, `"a":{"title":"Emma"}`)
+	test.Contains(body, `"c":{"title":"Ulysses"}`)
+	test.Contains(body, `"missing":null`)
+	test.Equal(1, counting.getBook)
+	test.Equal(1, counting.getBooks)
+
+	// the books with many IDs are read from the catalog at once
+	counting.getBook, counting.getBooks = 0, 0
+	body = query(`{ books(ids: ["0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1", "9b2f6c1d-5e7a-4f3b-8c9d-0a1b2c3d4e5f", "6c4a9e0e-3f4b-4b8e-8a53-62e2d5f0c7a2"]) { title } }`)
+	test.Contains(body, `"books":[{"title":"Emma"},{"title":"Ulysses"}]`)
+	test.Equal(0, counting.getBook)
+	test.Equal(1, counting.getBooks)
+}
+
+// circulationCounting counts the lookups of the circulation
+type circulationCounting struct {
+	*circulation.Desk
+	copies int
+}
+
+func (c *circulationCounting) Copies(bookIDs []string) map[string][]circulation.Copy {
+	c.copies++
+	return c.Desk.Copies(bookIDs)
+}
+
+func TestGraphQLCirculation(t *testing.T) {
+	test := assert.New(t)
+	dir, err := ioutil.TempDir("", "circulation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	desk, err := circulation.NewDesk(filepath.Join(dir, "circulation.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &circulationCounting{Desk: desk}
+
+	handler := NewRouter(NewHandler(tempLibrary(t, `[
+		{"id": "0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1", "title": "Emma", "genres": ["novel"], "pages": 300, "price": 12},
+		{"id": "6c4a9e0e-3f4b-4b8e-8a53-62e2d5f0c7a2", "title": "Ulysses", "genres": ["novel"], "pages": 700, "price": 20}
+	]`), WithCirculation(counting)))
+	query := func(q string) string {
+		body, err := json.Marshal(map[string]interface{}{"query": q})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/graphql", bytes.NewReader(body)))
+		test.Equal(http.StatusOK, rr.Code)
+		test.NotContains(rr.Body.String(), `"errors"`)
+		return rr.Body.String()
+	}
+
+	query(`mutation { addAuthor(name: "Jane Austen", books: ["0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1"]) { id } }`)
+	copy, err := desk.AddCopy("0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1", "0001")
+	test.NoError(err)
+	body := query(`mutation { addCopy(book: "6c4a9e0e-3f4b-4b8e-8a53-62e2d5f0c7a2", barcode: "0002") { barcode available } }`)
+	test.Contains(body, `"addCopy":{"barcode":"0002","available":true}`)
+	query(`mutation { placeHold(book: "0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1", patron: "alice") { id } }`)
+	query(`mutation { placeHold(book: "0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1", patron: "bob") { id } }`)
+	body = query(`mutation { checkout(copy: "` + copy.ID + `", patron: "alice", due: "2000-01-01T00:00:00Z") { patron due overdue book { title } } }`)
+	test.Contains(body, `"checkout":{"patron":"alice","due":"2000-01-01T00:00:00Z","overdue":true,"book":{"title":"Emma"}}`)
+
+	// the book, its author, copies, holds and loans come in one round trip
+	counting.copies = 0
+	body = query(`{ books { title author { name books { title } } copies { barcode available loan { patron } } holds { patron } loans(active: true) { patron } } }`)
+	test.Contains(body, `{"title":"Emma","author":{"name":"Jane Austen","books":[{"title":"Emma"}]},`+
+		`"copies":[{"barcode":"0001","available":false,"loan":{"patron":"alice"}}],"holds":[{"patron":"bob"}],"loans":[{"patron":"alice"}]}`)
+	test.Contains(body, `{"title":"Ulysses","author":null,"copies":[{"barcode":"0002","available":true,"loan":null}],"holds":[],"loans":[]}`)
+	test.Equal(1, counting.copies, "the circulation of all the books is looked up at once")
+
+	// the authors are listed by the name, the unknown author is null
+	body = query(`{ authors { name } author(id: "9b2f6c1d-5e7a-4f3b-8c9d-0a1b2c3d4e5f") { name } }`)
+	test.Contains(body, `"authors":[{"name":"Jane Austen"}],"author":null`)
+}
+
+func TestEventsHandler(t *testing.T) {
+	test := assert.New(t)
+
+	events := NewEventStream(2)
+	events.Publish(storage.Event{Type: storage.EventBookCreated, Book: storage.Book{Title: "first"}})
+	events.Publish(storage.Event{Type: storage.EventBookCreated, Book: storage.Book{Title: "second", Genres: []string{"adventure"}}})
+	events.Publish(storage.Event{Type: storage.EventBookDeleted, Book: storage.Book{Title: "third", Genres: []string{"adventure"}}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest("GET", "/v1/events?genre=adventure&type=book.created", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(ctx)
+	first := events.lastID - 2
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(first, 10))
+
+	rr := httptest.NewRecorder()
+
+	handler := NewRouter(NewHandler(
+		testLibrary(t),
+		WithEventStream(events),
+	))
+	handler.ServeHTTP(rr, req)
+
+	test.Equal(http.StatusOK, rr.Code, "handler returned wrong status code")
+	test.Equal("text/event-stream", rr.Header().Get("Content-Type"))
+	test.Contains(rr.Body.String(), fmt.Sprintf("id: %d\nevent: book.created\n", first+1))
+	test.NotContains(rr.Body.String(), "third")
+	test.NotContains(rr.Body.String(), "event: reset")
+}
+
+func TestEventsReset(t *testing.T) {
+	events := NewEventStream(2)
+	for _, title := range []string{"first", "second", "third"} {
+		events.Publish(storage.Event{Type: storage.EventBookCreated, Book: storage.Book{Title: title}})
+	}
+	handler := NewRouter(NewHandler(
+		testLibrary(t),
+		WithEventStream(events),
+	))
+
+	cases := []struct {
+		name   string
+		lastID uint64
+	}{
+		{"evicted", events.lastID - 3},
+		{"before restart", 1},
+		{"unknown", events.lastID + 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			test := assert.New(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			req, err := http.NewRequest("GET", "/v1/events", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req = req.WithContext(ctx)
+			req.Header.Set("Last-Event-ID", strconv.FormatUint(c.lastID, 10))
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			test.Equal(http.StatusOK, rr.Code, "handler returned wrong status code")
+			test.True(strings.HasPrefix(rr.Body.String(), fmt.Sprintf("id: %d\nevent: reset\n", events.lastID)), rr.Body.String())
+			test.NotContains(rr.Body.String(), "book.created", "the stream doesn't resume from the tail")
+		})
+	}
+}
+
+func TestEventStreamClose(t *testing.T) {
+	events := NewEventStream(2)
+	handler := NewRouter(NewHandler(
+		testLibrary(t),
+		WithEventStream(events),
+	))
+
+	req, err := http.NewRequest("GET", "/v1/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	events.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the stream wasn't ended by Close")
+	}
+}
+
+func TestChangesHandler(t *testing.T) {
+	test := assert.New(t)
+
+	handler := NewRouter(NewHandler(tempLibrary(t, `[
+		{"id": "0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1", "title": "Emma", "genres": ["novel"], "pages": 300, "price": 12},
+		{"id": "6c4a9e0e-3f4b-4b8e-8a53-62e2d5f0c7a2", "title": "Ulysses", "genres": ["novel"], "pages": 700, "price": 20}
+	]`)))
+	changes := func(token string) changeFeed {
+		req, err := http.NewRequest("GET", "/v1/changes?since="+token, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		test.Equal(http.StatusOK, rr.Code, "handler returned wrong status code")
+
+		var feed changeFeed
+		err = json.NewDecoder(rr.Body).Decode(&feed)
+		test.NoError(err, "handler returned wrong data")
+		return feed
+	}
+
+	full := changes("")
+	test.Len(full.Changes, 2)
+
+	testBook := storage.Book{Title: "ChangesBook", Genres: []string{"test"}, Pages: 1, Price: storage.MustDecimal("1")}
+	body, err := json.Marshal(testBook)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "/v1/books", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	next := changes(full.Token)
+	if test.Len(next.Changes, 1) {
+		test.Equal(storage.EventBookCreated, next.Changes[0].Type)
+		test.Equal(testBook.Title, next.Changes[0].Book.Title)
+	}
+	test.Empty(changes(next.Token).Changes)
+}
+
+func TestConditionalGet(t *testing.T) {
+	test := assert.New(t)
+	library := testLibrary(t)
+	books, err := getTestBooks(library)
+	test.NoError(err, "test failed")
+
+	handler := NewRouter(NewHandler(
+		library),
+	)
+
+	for _, url := range []string{"/v1/books", "/v1/books/" + books[0].ID} {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		test.Equal(http.StatusOK, rr.Code, "handler returned wrong status code")
+		test.Equal("no-cache", rr.Header().Get("Cache-Control"))
+		etag := rr.Header().Get("ETag")
+		test.NotEmpty(etag)
+
+		req, err = http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("If-None-Match", etag)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		test.Equal(http.StatusNotModified, rr.Code, "handler returned wrong status code")
+		test.Empty(rr.Body.String())
+	}
+}
+
+func TestVersionedRoutes(t *testing.T) {
+	test := assert.New(t)
+
+	handler := NewRouter(NewHandler(
+		testLibrary(t)),
+	)
+
+	req, err := http.NewRequest("GET", "/v1/books", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	test.Equal(http.StatusOK, rr.Code, "handler returned wrong status code")
+	test.Empty(rr.Header().Get("Deprecation"))
+
+	req, err = http.NewRequest("GET", "/books", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	test.Equal(http.StatusOK, rr.Code, "handler returned wrong status code")
+	test.NotEmpty(rr.Header().Get("Deprecation"))
+	test.NotEmpty(rr.Header().Get("Sunset"))
+	test.Equal(`</v1/books>; rel="successor-version"`, rr.Header().Get("Link"))
+}
+
+// slowStorage answers only when the context of the call is done
+type slowStorage struct {
+	Storage
+}
+
+func (s slowStorage) Version(ctx context.Context) (uint64, time.Time, error) {
+	return 0, time.Time{}, errors.New("unknown version")
+}
+
+func (s slowStorage) GetBooks(ctx context.Context) (storage.Books, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestRouteTimeout(t *testing.T) {
+	handler := NewRouter(NewHandler(
+		slowStorage{testLibrary(t)},
+		WithRouteTimeout("BooksIndex", 10*time.Millisecond),
+	))
+
+	req, err := http.NewRequest("GET", "/v1/books", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code, "handler returned wrong status code")
+}
+
+func TestTracing(t *testing.T) {
+	test := assert.New(t)
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+		log.SetOutput(os.Stderr)
+	})
+
+	handler := NewRouter(NewHandler(
+		testLibrary(t)),
+	)
+
+	req, err := http.NewRequest("GET", "/v1/books", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	test.Equal(http.StatusOK, rr.Code, "handler returned wrong status code")
+
+	spans := recorder.Ended()
+	if test.Len(spans, 1) {
+		test.Equal("GET /v1/books", spans[0].Name())
+		test.Equal("4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext().TraceID().String())
+		test.Equal("00f067aa0ba902b7", spans[0].Parent().SpanID().String())
+	}
+	test.Contains(logged.String(), "GET /v1/books 200 ")
+	test.Contains(logged.String(), "trace_id=4bf92f3577b34da6a3ce929d0e0e4736")
+
+	// the request outside of a trace is logged as well
+	otel.SetTracerProvider(noop.NewTracerProvider())
+	logged.Reset()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/books", nil))
+	test.Contains(logged.String(), "GET /v1/books 200 ")
+	test.NotContains(logged.String(), "trace_id")
+}
+
+func TestAuth(t *testing.T) {
+	test := assert.New(t)
+	handler := NewRouter(NewHandler(
+		testLibrary(t),
+		WithAuth(map[string]string{"reader-token": RoleReader}),
+	))
+
+	cases := []struct {
+		method, url, token, body string
+		code                     int
+	}{
+		{"GET", "/v1/books", "", "", http.StatusUnauthorized},
+		{"GET", "/v1/books", "unknown", "", http.StatusUnauthorized},
+		{"GET", "/v1/books", "reader-token", "", http.StatusOK},
+		{"POST", "/v1/books", "reader-token", "{}", http.StatusForbidden},
+		{"GET", "/v1/webhooks", "reader-token", "", http.StatusForbidden},
+		{"GET", "/healthz", "", "", http.StatusOK},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, c.url, bytes.NewBufferString(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		test.Equal(c.code, rr.Code, "%s %s with %q", c.method, c.url, c.token)
+	}
+
+	// readers can query but not change the catalog through GraphQL
+	req, err := http.NewRequest("POST", "/v1/graphql", bytes.NewBufferString(
+		`{"query": "mutation { removeBook(id: \"0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1\") }"}`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer reader-token")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	test.Equal(http.StatusOK, rr.Code)
+	test.Contains(rr.Body.String(), errForbidden.Error())
+}
+
+func TestClientCertificateRoles(t *testing.T) {
+	test := assert.New(t)
+	handler := NewRouter(NewHandler(
+		testLibrary(t),
+		WithClientRoles(map[string]string{
+			"ops":                RoleEditor,
+			"CN=catalog,O=Shelf": RoleReader,
+		}),
+	))
+
+	verified := func(subject pkix.Name) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: subject}}}}
+	}
+	cases := []struct {
+		state *tls.ConnectionState
+		code  int
+	}{
+		{nil, http.StatusUnauthorized},
+		{verified(pkix.Name{CommonName: "ops"}), 0},
+		{verified(pkix.Name{CommonName: "catalog", Organization: []string{"Shelf"}}), http.StatusForbidden},
+		{verified(pkix.Name{CommonName: "stranger"}), http.StatusUnauthorized},
+		// certificates which weren't verified by the handshake are ignored
+		{&tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "ops"}}}}, http.StatusUnauthorized},
+	}
+	for i, c := range cases {
+		// the empty book is rejected by the handler, only the editor gets that far
+		req, err := http.NewRequest("POST", "/v1/books", bytes.NewBufferString("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.TLS = c.state
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if c.code == 0 {
+			test.NotContains([]int{http.StatusUnauthorized, http.StatusForbidden}, rr.Code, "case %d", i)
+			continue
+		}
+		test.Equal(c.code, rr.Code, "case %d", i)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	test := assert.New(t)
+	handler := NewRouter(NewHandler(
+		testLibrary(t),
+		WithAuth(map[string]string{"reader-token": RoleReader}),
+		WithCORS(CORSOptions{
+			AllowedOrigins:   []string{"https://ui.example.com"},
+			AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE"},
+			AllowedHeaders:   []string{"Content-Type", "Authorization"},
+			AllowCredentials: true,
+			MaxAge:           10 * time.Minute,
+		}),
+	))
+
+	preflight := func(url, origin, method, headers string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("OPTIONS", url, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		req.Header.Set("Access-Control-Request-Headers", headers)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// preflight isn't authorized, the browsers don't send the credentials with it
+	rr := preflight("/v1/books/0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1", "https://ui.example.com", "DELETE", "Authorization")
+	test.Equal(http.StatusNoContent, rr.Code)
+	test.Equal("https://ui.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	test.Equal("true", rr.Header().Get("Access-Control-Allow-Credentials"))
+	test.Equal("DELETE, GET, PUT", rr.Header().Get("Access-Control-Allow-Methods"))
+	test.Equal("Authorization", rr.Header().Get("Access-Control-Allow-Headers"))
+	test.Equal("600", rr.Header().Get("Access-Control-Max-Age"))
+
+	// every route of the table answers the preflight, the legacy ones as well
+	for _, path := range []string{"/v1/books/filter", "/books", "/v1/webhooks/deliveries/1/replay", "/healthz"} {
+		test.Equal(http.StatusNoContent, preflight(path, "https://ui.example.com", "", "").Code, path)
+	}
+
+	// the literal paths aren't taken by the routes with the parameter
+	for _, path := range []string{"/v1/books/filter", "/v1/books/batch", "/v1/books/reprice", "/books/filter"} {
+		rr = preflight(path, "https://ui.example.com", "POST", "Content-Type")
+		test.Equal(http.StatusNoContent, rr.Code, path)
+		test.Equal("POST", rr.Header().Get("Access-Control-Allow-Methods"), path)
+	}
+	rr = preflight("/v1/rates/import", "https://ui.example.com", "POST", "")
+	test.Equal(http.StatusNoContent, rr.Code)
+	test.Equal("POST, OPTIONS", rr.Header().Get("Allow"))
+
+	test.Equal(http.StatusForbidden, preflight("/v1/books", "https://evil.example.com", "GET", "").Code)
+	test.Equal(http.StatusForbidden, preflight("/v1/books", "https://ui.example.com", "PATCH", "").Code)
+	test.Equal(http.StatusForbidden, preflight("/v1/books", "https://ui.example.com", "GET", "X-Debug").Code)
+
+	// the front-end can read the authorization errors of the actual requests
+	req := httptest.NewRequest("GET", "/v1/books", nil)
+	req.Header.Set("Origin", "https://ui.example.com")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	test.Equal(http.StatusUnauthorized, rr.Code)
+	test.Equal("https://ui.example.com", rr.Header().Get("Access-Control-Allow-Origin"))
+	test.Contains(rr.Header().Get("Access-Control-Expose-Headers"), "ETag")
+
+	req = httptest.NewRequest("GET", "/v1/books", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Authorization", "Bearer reader-token")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	test.Equal(http.StatusOK, rr.Code)
+	test.Empty(rr.Header().Get("Access-Control-Allow-Origin"))
+}
+
+// countingStorage counts the created books without storing them, failing fails the calls
+type countingStorage struct {
+	Storage
+	created int
+	failing bool
+}
+
+func (s *countingStorage) CreateBook(ctx context.Context, book storage.Book) (storage.Book, error) {
+	if s.failing {
+		return storage.Book{}, errors.New("storage is down")
+	}
+	s.created++
+	book.ID = "0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1"
+	return book, nil
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	test := assert.New(t)
+	store := &countingStorage{Storage: tempLibrary(t, "[]")}
+	handler := NewRouter(NewHandler(store))
+
+	post := func(key, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/books", bytes.NewBufferString(body))
+		req.Header.Set("Idempotency-Key", key)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	book := `{"title": "Dune", "author": "Frank Herbert", "price": 10, "pages": 412, "genres": ["sci-fi"]}`
+
+	rr := post("retry-1", "", book)
+	test.Equal(http.StatusCreated, rr.Code)
+	test.Empty(rr.Header().Get("Idempotent-Replayed"))
+
+	rr = post("retry-1", "", book)
+	test.Equal(http.StatusCreated, rr.Code)
+	test.Equal("true", rr.Header().Get("Idempotent-Replayed"))
+	test.Equal(1, store.created, "the retry doesn't create the book again")
+
+	test.Equal(http.StatusUnprocessableEntity, post("retry-1", "", `{"title": "Emma"}`).Code)
+
+	// keys of the other clients don't collide
+	test.Equal(http.StatusCreated, post("retry-1", "other-client", book).Code)
+	test.Equal(2, store.created)
+
+	// the failed response isn't kept, so the retry can succeed
+	store.failing = true
+	test.Equal(http.StatusInternalServerError, post("retry-2", "", book).Code)
+	store.failing = false
+	rr = post("retry-2", "", book)
+	test.Equal(http.StatusCreated, rr.Code)
+	test.Empty(rr.Header().Get("Idempotent-Replayed"))
+	test.Equal(3, store.created)
+
+	// the POST routes which only read don't keep the responses
+	for _, url := range []string{"/v1/books/filter", "/v1/graphql"} {
+		for _, body := range []string{`{"price": "<20"}`, `{"query": "{ books { id } }"}`} {
+			req := httptest.NewRequest("POST", url, bytes.NewBufferString(body))
+			req.Header.Set("Idempotency-Key", "read-only")
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			test.NotEqual(http.StatusUnprocessableEntity, rr.Code, "%s %s", url, body)
+			test.Empty(rr.Header().Get("Idempotent-Replayed"))
+		}
+	}
+}
+
+func TestGraphQLCreateBook(t *testing.T) {
+	test := assert.New(t)
+	store := &countingStorage{Storage: tempLibrary(t, "[]")}
+	handler := NewRouter(NewHandler(store))
+
+	req := httptest.NewRequest("POST", "/v1/graphql", bytes.NewBufferString(
+		`{"query": "mutation { createBook(input: {title: \"Dune\", genres: [\"sci-fi\"], pages: 412, price: \"10\"}) { id title } }"}`,
+	))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	test.Equal(http.StatusOK, rr.Code)
+
+	var result struct {
+		Data struct {
+			CreateBook storage.Book
+		}
+	}
+	test.NoError(json.NewDecoder(rr.Body).Decode(&result))
+	test.Equal("0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1", result.Data.CreateBook.ID)
+	test.Equal("Dune", result.Data.CreateBook.Title)
+	test.Equal(1, store.created)
+}
+
+func TestInvalidBookHandlers(t *testing.T) {
+	test := assert.New(t)
+	// the library rejects the invalid data by itself, without the validation middleware
+	handler := NewRouter(NewHandler(tempLibrary(t, "[]")))
+
+	cases := []struct {
+		url, body string
+	}{
+		{"/v1/books", `{"title": "Dune", "genres": ["sci-fi"], "price": "10"}`},
+		{"/v1/books/filter", `{"price": "10"}`},
+		{"/v1/books/filter", `{"price": "<"}`},
+		{"/v1/books/filter", `{"price": "<ten"}`},
+		{"/v1/books/filter", `{"price": "<10", "currency": "XXY"}`},
+	}
+	for _, c := range cases {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", c.url, bytes.NewBufferString(c.body)))
+		test.Equal(http.StatusBadRequest, rr.Code, "%s %s", c.url, c.body)
+	}
+}
+
+// testLibrary returns the library with the books of the test storage, the json one is a copy in a new file,
+// so the tests can change it and every test has its own
+func testLibrary(t *testing.T) Storage {
+	if *sqlUse {
+		return storage.NewLibrary(*testLibPath, true)
+	}
+	books, err := ioutil.ReadFile(*testLibPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tempLibrary(t, string(books))
+}
+
+// tempLibrary returns the json library in a new file, so the test can change it freely
+func tempLibrary(t *testing.T, books string) Storage {
+	dir, err := ioutil.TempDir("", "library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "storage.json")
+	if err = ioutil.WriteFile(path, []byte(books), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return storage.NewLibrary(path, false)
+}
+
+func TestBookBatchHandler(t *testing.T) {
+	test := assert.New(t)
+	library := tempLibrary(t, `[
+		{"id": "0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1", "title": "Emma", "genres": ["novel"], "pages": 300, "price": 12},
+		{"id": "6c4a9e0e-3f4b-4b8e-8a53-62e2d5f0c7a2", "title": "Ulysses", "genres": ["novel"], "pages": 700, "price": 20}
+	]`)
+	handler := NewRouter(NewHandler(library))
+	batch := func(body string) (int, batchResponse) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/books/batch", bytes.NewBufferString(body)))
+		var response batchResponse
+		if rr.Body.Len() > 0 {
+			test.NoError(json.NewDecoder(rr.Body).Decode(&response))
+		}
+		return rr.Code, response
+	}
+	statuses := func(response batchResponse) []int {
+		var codes []int
+		for _, result := range response.Results {
+			codes = append(codes, result.Status)
+		}
+		return codes
+	}
+
+	code, response := batch(`{"operations": [
+		{"op": "create", "book": {"title": "Dune", "genres": ["sci-fi"], "pages": 412, "price": 10}},
+		{"op": "update", "id": "0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1", "book": {"title": "Emma", "genres": ["novel"], "pages": 300, "price": 15}},
+		{"op": "delete", "id": "6c4a9e0e-3f4b-4b8e-8a53-62e2d5f0c7a2"}
+	]}`)
+	test.Equal(http.StatusOK, code)
+	test.Equal([]int{http.StatusCreated, http.StatusOK, http.StatusNoContent}, statuses(response))
+	test.True(validID(response.Results[0].ID))
+	test.Equal("15", response.Results[1].Book.Price.String())
+
+	ctx := context.Background()
+	books, err := library.GetBooks(ctx)
+	test.NoError(err)
+	test.Len(books, 2)
+	seq, _, err := library.Version(ctx)
+	test.NoError(err)
+	test.Equal(uint64(3), seq, "every operation is in the change log")
+
+	// the failed operation rolls the whole batch back
+	code, response = batch(`{"operations": [
+		{"op": "create", "book": {"title": "Emma 2", "genres": ["novel"], "pages": 300, "price": 12}},
+		{"op": "delete", "id": "6c4a9e0e-3f4b-4b8e-8a53-62e2d5f0c7a2"},
+		{"op": "delete", "id": "0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1"}
+	]}`)
+	test.Equal(http.StatusNotFound, code)
+	test.Equal([]int{http.StatusFailedDependency, http.StatusNotFound, http.StatusFailedDependency}, statuses(response))
+	test.NotEmpty(response.Results[1].Error)
+	after, err := library.GetBooks(ctx)
+	test.NoError(err)
+	test.Equal(books, after)
+	seq, _, err = library.Version(ctx)
+	test.NoError(err)
+	test.Equal(uint64(3), seq)
+
+	code, response = batch(`{"operations": [{"op": "move", "id": "0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1"}]}`)
+	test.Equal(http.StatusBadRequest, code)
+	test.Equal([]int{http.StatusBadRequest}, statuses(response))
+
+	code, _ = batch(`{"operations": []}`)
+	test.Equal(http.StatusBadRequest, code)
+}
+
+func TestBookRepriceHandler(t *testing.T) {
+	test := assert.New(t)
+	library := tempLibrary(t, `[
+		{"id": "0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1", "title": "Emma", "genres": ["novel"], "pages": 300, "price": 12},
+		{"id": "6c4a9e0e-3f4b-4b8e-8a53-62e2d5f0c7a2", "title": "Ulysses", "genres": ["Novel"], "pages": 700, "price": 20},
+		{"id": "9b2f6c1d-5e7a-4f3b-8c9d-0a1b2c3d4e5f", "title": "Dune", "genres": ["sci-fi"], "pages": 412, "price": 10}
+	]`)
+	handler := NewRouter(NewHandler(library))
+	reprice := func(body string) (int, storage.RepriceResult) {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/books/reprice", bytes.NewBufferString(body)))
+		var result storage.RepriceResult
+		if rr.Code == http.StatusOK {
+			test.NoError(json.NewDecoder(rr.Body).Decode(&result))
+		}
+		return rr.Code, result
+	}
+	ctx := context.Background()
+	books, err := library.GetBooks(ctx)
+	test.NoError(err)
+
+	code, preview := reprice(`{"filter": {"genre": "novel"}, "adjustment": {"kind": "percent", "value": 10}}`)
+	test.Equal(http.StatusOK, code)
+	test.False(preview.Applied)
+	test.Equal([]storage.PriceChange{
+		{ID: "0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1", Title: "Emma", OldPrice: storage.MustDecimal("12"), NewPrice: storage.MustDecimal("13.2"), Currency: "USD"},
+		{ID: "6c4a9e0e-3f4b-4b8e-8a53-62e2d5f0c7a2", Title: "Ulysses", OldPrice: storage.MustDecimal("20"), NewPrice: storage.MustDecimal("22"), Currency: "USD"},
+	}, preview.Changes)
+	after, err := library.GetBooks(ctx)
+	test.NoError(err)
+	test.Equal(books, after, "the preview doesn't change the prices")
+
+	code, applied := reprice(fmt.Sprintf(`{"filter": {"genre": "novel"}, "adjustment": {"kind": "percent", "value": 10},
+		"apply": true, "version": %d}`, preview.Version))
+	test.Equal(http.StatusOK, code)
+	test.True(applied.Applied)
+	test.Equal(preview.Changes, applied.Changes)
+	test.Equal(preview.Version+2, applied.Version, "every new price is in the change log")
+	book, err := library.GetBook(ctx, "6c4a9e0e-3f4b-4b8e-8a53-62e2d5f0c7a2")
+	test.NoError(err)
+	test.Equal("22", book.Price.String())
+
+	// the catalog has changed since the preview
+	code, _ = reprice(fmt.Sprintf(`{"filter": {"price": "<15"}, "adjustment": {"kind": "set", "value": 9.99},
+		"apply": true, "version": %d}`, applied.Version-1))
+	test.Equal(http.StatusConflict, code)
+
+	// a price which wouldn't be positive rolls the whole adjustment back
+	code, _ = reprice(`{"filter": {"price": ">0"}, "adjustment": {"kind": "amount", "value": -11}, "apply": true}`)
+	test.Equal(http.StatusBadRequest, code)
+	book, err = library.GetBook(ctx, "6c4a9e0e-3f4b-4b8e-8a53-62e2d5f0c7a2")
+	test.NoError(err)
+	test.Equal("22", book.Price.String())
+
+	code, _ = reprice(`{"filter": {"price": "=10"}, "adjustment": {"kind": "set", "value": 5}}`)
+	test.Equal(http.StatusBadRequest, code)
+	code, _ = reprice(`{"filter": {"price": ">10"}, "adjustment": {"kind": "double"}}`)
+	test.Equal(http.StatusBadRequest, code)
+}
+
+func TestBookPricesHandler(t *testing.T) {
+	test := assert.New(t)
+	library := tempLibrary(t, `[
+		{"id": "0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1", "title": "Emma", "genres": ["novel"], "pages": 300, "price": 12.43}
+	]`)
+	handler := NewRouter(NewHandler(library))
+	serve := func(method, url, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, url, bytes.NewBufferString(body)))
+		return rr
+	}
+	prices := func(id string) storage.PriceRecords {
+		rr := serve("GET", "/v1/books/"+id+"/prices", "")
+		test.Equal(http.StatusOK, rr.Code)
+		var records storage.PriceRecords
+		test.NoError(json.NewDecoder(rr.Body).Decode(&records))
+		return records
+	}
+
+	// the book older than the history has its current price with unknown date
+	old := prices("0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1")
+	if test.Len(old, 1) {
+		test.Equal(storage.Money{Amount: storage.MustDecimal("12.43"), Currency: storage.DefaultCurrency}, old[0].Price)
+		test.True(old[0].EffectiveAt.IsZero())
+	}
+
+	rr := serve("POST", "/v1/books", `{"title": "Dune", "genres": ["sci-fi"], "pages": 412, "price": 0.1, "currency": "EUR"}`)
+	test.Equal(http.StatusCreated, rr.Code)
+	test.Contains(rr.Body.String(), `"price":0.1,"currency":"EUR"`)
+	var book storage.Book
+	test.NoError(json.NewDecoder(rr.Body).Decode(&book))
+
+	rr = serve("PUT", "/v1/books/"+book.ID, `{"price": 0.3}`)
+	test.Equal(http.StatusOK, rr.Code)
+	rr = serve("PUT", "/v1/books/"+book.ID, `{"title": "Dune Messiah"}`)
+	test.Equal(http.StatusOK, rr.Code)
+
+	history := prices(book.ID)
+	if test.Len(history, 2, "only the changes of the price are in the history") {
+		test.Equal(storage.Money{Amount: storage.MustDecimal("0.1"), Currency: "EUR"}, history[0].Price)
+		test.Equal(storage.Money{Amount: storage.MustDecimal("0.3"), Currency: "EUR"}, history[1].Price)
+		test.Equal("0.2", history[1].Price.Amount.Sub(history[0].Price.Amount).String())
+		test.False(history[0].EffectiveAt.After(history[1].EffectiveAt))
+		test.NotZero(history[1].Seq)
+	}
+
+	// the amount has to fit the minor unit of the currency
+	rr = serve("POST", "/v1/books", `{"title": "Dune", "genres": ["sci-fi"], "pages": 412, "price": 10.5, "currency": "JPY"}`)
+	test.Equal(http.StatusBadRequest, rr.Code)
+	rr = serve("POST", "/v1/books", `{"title": "Dune", "genres": ["sci-fi"], "pages": 412, "price": 10, "currency": "ABC"}`)
+	test.Equal(http.StatusBadRequest, rr.Code)
+
+	test.Equal(http.StatusNotFound, serve("GET", "/v1/books/6c4a9e0e-3f4b-4b8e-8a53-62e2d5f0c7a2/prices", "").Code)
+	test.Equal(http.StatusBadRequest, serve("GET", "/v1/books/not-uuid/prices", "").Code)
+}
+
+func TestCurrencyConversion(t *testing.T) {
+	test := assert.New(t)
+	library := tempLibrary(t, `[
+		{"id": "0d1ed7a4-8a6f-4c3a-9a43-6b8a6bd8b5e1", "title": "Emma", "genres": ["novel"], "pages": 300, "price": 10.8},
+		{"id": "6c4a9e0e-3f4b-4b8e-8a53-62e2d5f0c7a2", "title": "Ulysses", "genres": ["novel"], "pages": 700, "price": 12, "currency": "EUR"},
+		{"id": "9b2f6c1d-5e7a-4f3b-8c9d-0a1b2c3d4e5f", "title": "Lalka", "genres": ["novel"], "pages": 680, "price": 64.8, "currency": "PLN"}
+	]`)
+	dir, err := ioutil.TempDir("", "rates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	table, err := rates.NewTable(filepath.Join(dir, "rates.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	library.(interface{ SetConverter(storage.Converter) }).SetConverter(table)
+
+	handler := NewRouter(NewHandler(library, WithRates(table)))
+	serve := func(method, url, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(method, url, bytes.NewBufferString(body)))
+		return rr
+	}
+	prices := func(rr *httptest.ResponseRecorder) map[string]string {
+		test.Equal(http.StatusOK, rr.Code)
+		var books storage.Books
+		test.NoError(json.NewDecoder(rr.Body).Decode(&books))
+		prices := map[string]string{}
+		for _, book := range books {
+			prices[book.Title] = book.Money().String()
+		}
+		return prices
+	}
+
+	// the books in the foreign currencies can't be converted without the rates
+	test.Equal(http.StatusBadRequest, serve("GET", "/v1/books?currency=EUR", "").Code)
+
+	rr := serve("POST", "/v1/rates/import", "Date, USD, PLN, \n10 May 2024, 1.08, 4.32, \n")
+	test.Equal(http.StatusOK, rr.Code)
+	test.Equal(http.StatusOK, serve("PUT", "/v1/rates/PLN", `{"rate": 4.32}`).Code)
+	test.Equal(http.StatusBadRequest, serve("PUT", "/v1/rates/EUR", `{"rate": 1}`).Code)
+	test.Equal(http.StatusBadRequest, serve("POST", "/v1/rates/import", "not rates").Code)
+
+	test.Equal(map[string]string{"Emma": "10 EUR", "Ulysses": "12 EUR", "Lalka": "15 EUR"},
+		prices(serve("GET", "/v1/books?currency=eur", "")))
+	test.Equal(map[string]string{"Emma": "10.8 USD", "Ulysses": "12 EUR", "Lalka": "64.8 PLN"},
+		prices(serve("GET", "/v1/books", "")), "the prices are kept in their currencies")
+
+	// the filter compares the prices converted into its currency
+	test.Equal(map[string]string{"Emma": "43.2 PLN", "Ulysses": "51.84 PLN"},
+		prices(serve("POST", "/v1/books/filter?currency=PLN", `{"price": "<60"}`)))
+	test.Equal(map[string]string{"Ulysses": "12 EUR", "Lalka": "64.8 PLN"},
+		prices(serve("POST", "/v1/books/filter", `{"price": ">11", "currency": "EUR"}`)))
+	test.Equal(http.StatusBadRequest, serve("POST", "/v1/books/filter", `{"price": ">11", "currency": "ABC"}`).Code)
+
+	// the ETag of the converted listing changes with the rates
+	etag := serve("GET", "/v1/books?currency=EUR", "").Header().Get("ETag")
+	test.NotEqual(etag, serve("GET", "/v1/books", "").Header().Get("ETag"))
+	req := httptest.NewRequest("GET", "/v1/books?currency=EUR", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	test.Equal(http.StatusNotModified, rr.Code)
+	test.Equal(http.StatusNoContent, serve("DELETE", "/v1/rates/PLN", "").Code)
+	test.NotEqual(etag, serve("GET", "/v1/books?currency=EUR", "").Header().Get("ETag"))
+	test.Equal(http.StatusBadRequest, serve("GET", "/v1/books?currency=EUR", "").Code, "PLN has no rate anymore")
+	test.Equal(http.StatusNotFound, serve("DELETE", "/v1/rates/PLN", "").Code)
+
+	rr = serve("GET", "/v1/rates", "")
+	test.Equal(http.StatusOK, rr.Code)
+	var list rates.Rates
+	test.NoError(json.NewDecoder(rr.Body).Decode(&list))
+	if test.Len(list, 1) {
+		test.Equal("USD", list[0].Currency)
+	}
+}
+
+func TestIdempotencyStoreExpiry(t *testing.T) {
+	test := assert.New(t)
+	now := time.Now()
+	store := newIdempotencyStore(time.Hour)
+	store.now = func() time.Time { return now }
+	fingerprint := [32]byte{1}
+
+	response, fresh := store.begin("key", fingerprint)
+	test.True(fresh)
+	_, fresh = store.begin("key", fingerprint)
+	test.False(fresh, "the key is in use till the response is complete")
+
+	store.finish("key", response, &recordingWriter{ResponseWriter: httptest.NewRecorder(), status: http.StatusCreated})
+	_, fresh = store.begin("key", fingerprint)
+	test.False(fresh)
+
+	now = now.Add(2 * time.Hour)
+	_, fresh = store.begin("key", fingerprint)
+	test.True(fresh, "the expired response is forgotten")
+}
+
+func TestIdempotencyStoreEviction(t *testing.T) {
+	test := assert.New(t)
+	store := newIdempotencyStore(time.Hour)
+	store.maxEntries = 3
+	store.maxBytes = 10
+	fingerprint := [32]byte{1}
+	complete := func(key, body string) {
+		response, fresh := store.begin(key, fingerprint)
+		test.True(fresh, key)
+		rec := &recordingWriter{ResponseWriter: httptest.NewRecorder()}
+		rec.Write([]byte(body))
+		store.finish(key, response, rec)
+	}
+
+	complete("a", "1")
+	complete("b", "2")
+	inProgress, _ := store.begin("c", fingerprint)
+	// the replayed response is used recently, so b is the least recently used one
+	_, fresh := store.begin("a", fingerprint)
+	test.False(fresh)
+
+	complete("d", "3")
+	test.Len(store.responses, 3)
+	test.NotContains(store.responses, "b", "the least recently used response is dropped above the count")
+	test.Contains(store.responses, "c", "the response in progress is kept")
+
+	complete("e", "123456789")
+	test.LessOrEqual(store.bytes, 10)
+	test.Contains(store.responses, "e")
+	test.Contains(store.responses, "c")
+	test.NotContains(store.responses, "a", "the responses are dropped above the size")
+
+	store.finish("c", inProgress, &recordingWriter{ResponseWriter: httptest.NewRecorder(), status: http.StatusInternalServerError})
+	test.NotContains(store.responses, "c")
+	test.Equal(len(store.responses), store.usage.Len())
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	test := assert.New(t)
+
+	cases := []struct {
+		method, url, port, location string
+		code                        int
+	}{
+		{"GET", "http://example.com/v1/books?price=lt:10", "443", "https://example.com/v1/books?price=lt:10", http.StatusMovedPermanently},
+		{"GET", "http://example.com:8080/v1/books", "8443", "https://example.com:8443/v1/books", http.StatusMovedPermanently},
+		{"POST", "http://example.com/v1/books", "443", "https://example.com/v1/books", http.StatusPermanentRedirect},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.url, nil)
+		rr := httptest.NewRecorder()
+		RedirectToHTTPS(c.port).ServeHTTP(rr, req)
+		test.Equal(c.code, rr.Code)
+		test.Equal(c.location, rr.Header().Get("Location"))
+	}
+}
+
+func TestRoutesHaveSpec(t *testing.T) {
+	handler := NewHandler(testLibrary(t))
+	routes := newServiceRoutes(handler)
+	for _, version := range newVersions(handler) {
+		routes = append(routes, version.Routes...)
+	}
+	for _, route := range routes {
+		if _, ok := routeSpecs[route.Name]; !ok {
+			t.Errorf("route %q has no spec metadata in routeSpecs", route.Name)
+		}
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	test := assert.New(t)
+
+	req, err := http.NewRequest("GET", "/openapi.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	handler := NewRouter(NewHandler(
+		testLibrary(t)),
+	)
+	handler.ServeHTTP(rr, req)
+
+	test.Equal(http.StatusOK, rr.Code, "handler returned wrong status code")
+
+	var spec struct {
+		OpenAPI string                            `json:"openapi"`
+		Paths   map[string]map[string]interface{} `json:"paths"`
+	}
+	err = json.NewDecoder(rr.Body).Decode(&spec)
+	test.NoError(err, "handler returned wrong data")
+	test.Equal("3.0.3", spec.OpenAPI)
+	test.Contains(spec.Paths["/v1/books/{id}"], "delete")
+	test.Contains(spec.Paths["/v1/books"], "post")
+	test.Contains(spec.Paths["/books"], "post")
+}
+
 // TODO:
 //func TestBookFilterHandler(t *testing.T) {
 //	type args struct {
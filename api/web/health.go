@@ -0,0 +1,67 @@
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	statusOK          = "ok"
+	statusUnavailable = "unavailable"
+)
+
+// checkResult describes the outcome of a single readiness check
+type checkResult struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+// readiness is the body of the readiness probe response
+type readiness struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks"`
+}
+
+// HealthzHandler handles requests with GET method and reports that the process is up
+func (h *handler) HealthzHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err := json.NewEncoder(w).Encode(readiness{Status: statusOK, Checks: []checkResult{}})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// ReadyzHandler handles requests with GET method and runs the storage checks
+func (h *handler) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	result := readiness{Status: statusOK, Checks: []checkResult{}}
+	for _, check := range h.storage.Checks() {
+		start := time.Now()
+		err := check.Run(r.Context())
+
+		res := checkResult{
+			Name:    check.Name,
+			Status:  statusOK,
+			Latency: time.Since(start).String(),
+		}
+		if err != nil {
+			log.Println(check.Name, err)
+			res.Status = statusUnavailable
+			res.Error = err.Error()
+			result.Status = statusUnavailable
+		}
+		result.Checks = append(result.Checks, res)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if result.Status != statusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(result)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,249 @@
+package web
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultIdempotencyRetention is how long the responses of the POST requests with Idempotency-Key are kept
+const defaultIdempotencyRetention = 24 * time.Hour
+
+// maxIdempotencyKeyLength bounds the keys the clients may send
+const maxIdempotencyKeyLength = 255
+
+// the kept responses are bounded by their number and the size of their bodies,
+// the least recently used ones are dropped above them before they expire
+const (
+	maxIdempotencyEntries = 10000
+	maxIdempotencyBytes   = 32 << 20
+)
+
+// readOnlyPOSTRoutes are the POST routes which don't change anything, so there is nothing to do once
+var readOnlyPOSTRoutes = map[string]bool{
+	"BookFilter": true,
+	"GraphQL":    true,
+}
+
+// WithIdempotencyRetention sets how long the responses are replayed for the retried POST requests,
+// zero makes the API ignore Idempotency-Key
+func WithIdempotencyRetention(retention time.Duration) Option {
+	return func(h *handler) {
+		h.idempotency = newIdempotencyStore(retention)
+	}
+}
+
+// storedResponse is the first response to the request with the key
+type storedResponse struct {
+	fingerprint [sha256.Size]byte
+	// done is closed when the response is complete, till then the key is in use
+	done    chan struct{}
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+	// element is the place of the response in the usage order
+	element *list.Element
+}
+
+// idempotencyStore keeps the responses by the keys of the clients
+type idempotencyStore struct {
+	retention  time.Duration
+	maxEntries int
+	maxBytes   int
+
+	mu        sync.Mutex
+	responses map[string]*storedResponse
+	// usage has the keys from the most recently used, the responses in progress are never dropped
+	usage *list.List
+	bytes int
+	swept time.Time
+	now   func() time.Time
+}
+
+func newIdempotencyStore(retention time.Duration) *idempotencyStore {
+	return &idempotencyStore{
+		retention:  retention,
+		maxEntries: maxIdempotencyEntries,
+		maxBytes:   maxIdempotencyBytes,
+		responses:  map[string]*storedResponse{},
+		usage:      list.New(),
+		now:        time.Now,
+	}
+}
+
+// remove forgets the response of the key, it must be called with the lock held
+func (s *idempotencyStore) remove(key string, response *storedResponse) {
+	delete(s.responses, key)
+	s.usage.Remove(response.element)
+	s.bytes -= len(response.body)
+}
+
+// evict drops the least recently used complete responses above the limits.
+// Must be called with the lock held.
+func (s *idempotencyStore) evict() {
+	for e := s.usage.Back(); e != nil && (len(s.responses) > s.maxEntries || s.bytes > s.maxBytes); {
+		prev := e.Prev()
+		key := e.Value.(string)
+		if response := s.responses[key]; isDone(response) {
+			s.remove(key, response)
+		}
+		e = prev
+	}
+}
+
+// sweep removes the expired responses, it's done at most once a minute.
+// Must be called with the lock held.
+func (s *idempotencyStore) sweep(now time.Time) {
+	if now.Sub(s.swept) < time.Minute {
+		return
+	}
+	s.swept = now
+	for key, response := range s.responses {
+		if isDone(response) && now.After(response.expires) {
+			s.remove(key, response)
+		}
+	}
+}
+
+func isDone(response *storedResponse) bool {
+	select {
+	case <-response.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// begin returns the response stored for the key, or reserves the key when there is none
+func (s *idempotencyStore) begin(key string, fingerprint [sha256.Size]byte) (*storedResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	s.sweep(now)
+	response, ok := s.responses[key]
+	if ok && (!isDone(response) || now.Before(response.expires)) {
+		s.usage.MoveToFront(response.element)
+		return response, false
+	}
+	if ok {
+		s.remove(key, response)
+	}
+	response = &storedResponse{fingerprint: fingerprint, done: make(chan struct{})}
+	response.element = s.usage.PushFront(key)
+	s.responses[key] = response
+	s.evict()
+	return response, true
+}
+
+// finish keeps the response for the retention window, the failed ones are forgotten,
+// so the client can retry them
+func (s *idempotencyStore) finish(key string, response *storedResponse, rec *recordingWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	close(response.done)
+	if rec.status >= 500 || rec.status == 0 {
+		s.remove(key, response)
+		return
+	}
+	response.status = rec.status
+	response.header = rec.Header().Clone()
+	response.body = rec.body.Bytes()
+	response.expires = s.now().Add(s.retention)
+	s.bytes += len(response.body)
+	s.evict()
+}
+
+// recordingWriter keeps a copy of the response which is written to the client
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+// clientScope returns the identity of the client the keys belong to,
+// so the clients can't see the responses of each other
+func clientScope(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		return "cert:" + r.TLS.VerifiedChains[0][0].Subject.String()
+	}
+	return "auth:" + r.Header.Get("Authorization")
+}
+
+// idempotent replays the stored response when the POST request is retried with the same Idempotency-Key.
+// The key reused for the different request is rejected with 422, the request still in progress with 409.
+func (h *handler) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		fingerprint := sha256.Sum256([]byte(r.Method + " " + r.URL.RequestURI() + "\n" + string(body)))
+
+		scoped := sha256.Sum256([]byte(clientScope(r)))
+		storeKey := string(scoped[:]) + key
+		response, fresh := h.idempotency.begin(storeKey, fingerprint)
+		if !fresh {
+			if response.fingerprint != fingerprint {
+				http.Error(w, "Idempotency-Key was used for a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			if !isDone(response) {
+				http.Error(w, "request with the Idempotency-Key is in progress", http.StatusConflict)
+				return
+			}
+			for name, values := range response.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(response.status)
+			w.Write(response.body)
+			return
+		}
+
+		rec := &recordingWriter{ResponseWriter: w}
+		defer h.idempotency.finish(storeKey, response, rec)
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// idempotentRoute reports whether the route honors Idempotency-Key, only the POST routes which change something do
+func idempotentRoute(route Route) bool {
+	return strings.ToUpper(route.Method) == "POST" && !readOnlyPOSTRoutes[route.Name]
+}
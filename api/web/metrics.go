@@ -0,0 +1,133 @@
+package web
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "library_http_requests_total",
+			Help: "Number of handled HTTP requests by route, API version, method and status code.",
+		},
+		[]string{"route", "version", "method", "code"},
+	)
+	requestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "library_http_request_duration_seconds",
+			Help:    "Latency of HTTP requests by route, API version and method.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"route", "version", "method"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration)
+}
+
+// statusRecorder keeps the status code written by the wrapped handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streaming handlers work through the recorder
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// instrument wraps the handler of the route with the request counter and latency histogram
+func instrument(name, version string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		requestDuration.WithLabelValues(name, version, r.Method).Observe(time.Since(start).Seconds())
+		requestsTotal.WithLabelValues(name, version, r.Method, strconv.Itoa(rec.status)).Inc()
+	})
+}
+
+// catalogCollector exposes business gauges which are calculated from the storage
+// and the circulation on every scrape, the loan gauges are left out without the circulation
+type catalogCollector struct {
+	storage      Storage
+	circulation  Circulation
+	books        *prometheus.Desc
+	activeLoans  *prometheus.Desc
+	overdueLoans *prometheus.Desc
+}
+
+func newCatalogCollector(storage Storage, circulation Circulation) *catalogCollector {
+	return &catalogCollector{
+		storage:     storage,
+		circulation: circulation,
+		books: prometheus.NewDesc(
+			"library_books",
+			"Number of books in the catalog.",
+			nil, nil,
+		),
+		activeLoans: prometheus.NewDesc(
+			"library_loans_active",
+			"Number of the lent copies which aren't returned yet.",
+			nil, nil,
+		),
+		overdueLoans: prometheus.NewDesc(
+			"library_loans_overdue",
+			"Number of the lent copies which aren't returned after the due date.",
+			nil, nil,
+		),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *catalogCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.books
+	if c.circulation != nil {
+		ch <- c.activeLoans
+		ch <- c.overdueLoans
+	}
+}
+
+// Collect implements prometheus.Collector
+func (c *catalogCollector) Collect(ch chan<- prometheus.Metric) {
+	if c.circulation != nil {
+		active, overdue := c.circulation.LoanCounts(time.Now())
+		ch <- prometheus.MustNewConstMetric(c.activeLoans, prometheus.GaugeValue, float64(active))
+		ch <- prometheus.MustNewConstMetric(c.overdueLoans, prometheus.GaugeValue, float64(overdue))
+	}
+
+	books, err := c.storage.GetBooks(context.Background())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.books, prometheus.GaugeValue, float64(len(books)))
+}
+
+// newMetricsHandler returns handler which serves process, HTTP and storage metrics
+// together with the catalog gauges of the given storage and circulation, which may be nil
+func newMetricsHandler(storage Storage, circulation Circulation) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newCatalogCollector(storage, circulation))
+
+	return promhttp.HandlerFor(
+		prometheus.Gatherers{prometheus.DefaultGatherer, registry},
+		promhttp.HandlerOpts{},
+	)
+}
@@ -0,0 +1,568 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ssOlexBaiko/library/rates"
+	"github.com/ssOlexBaiko/library/replication"
+	"github.com/ssOlexBaiko/library/storage"
+	"github.com/ssOlexBaiko/library/webhook"
+)
+
+// responseSpec describes a single response of an operation
+type responseSpec struct {
+	Code        int
+	Description string
+	// Schema is a name of the component schema of the body, if any
+	Schema string
+	// ContentType of the body, application/json is used when empty
+	ContentType string
+}
+
+// paramSpec describes a query parameter of an operation
+type paramSpec struct {
+	Name        string
+	Description string
+}
+
+// operationSpec contains OpenAPI metadata of a route
+type operationSpec struct {
+	Summary string
+	Tags    []string
+	Query   []paramSpec
+	// RequestBody is a name of the component schema of the request body, if any
+	RequestBody string
+	// RequestTypes are the content types of the request body without the schema, e.g. the imported files
+	RequestTypes []string
+	Responses    []responseSpec
+}
+
+// currencyParam converts the prices of the listing at the exchange rates
+var currencyParam = paramSpec{"currency", "ISO 4217 currency the prices are converted into at the exchange rates"}
+
+// routeSpecs describes every route of the Routes table by its name
+var routeSpecs = map[string]operationSpec{
+	"Index": {
+		Summary:   "Greeting of the library resource",
+		Tags:      []string{"service"},
+		Responses: []responseSpec{{http.StatusOK, "Greeting", "", "text/plain"}},
+	},
+	"BooksIndex": {
+		Summary: "List all books",
+		Tags:    []string{"books"},
+		Query:   []paramSpec{currencyParam},
+		Responses: []responseSpec{
+			{http.StatusOK, "All books of the catalog", "Books", ""},
+			{http.StatusNotModified, "Catalog matches If-None-Match or If-Modified-Since", "", ""},
+			{http.StatusBadRequest, "Currency is unknown or a price can't be converted into it", "", ""},
+			{http.StatusNotFound, "Books can't be read from the storage", "", ""},
+		},
+	},
+	"BookCreate": {
+		Summary:     "Create a book",
+		Tags:        []string{"books"},
+		RequestBody: "Book",
+		Responses: []responseSpec{
+			{http.StatusCreated, "Created book with the generated ID, Location header points to it", "Book", ""},
+			{http.StatusBadRequest, "Body is not a valid book", "", ""},
+			{http.StatusInternalServerError, "Book can't be stored", "", ""},
+		},
+	},
+	"GetBook": {
+		Summary: "Get a book by ID",
+		Tags:    []string{"books"},
+		Responses: []responseSpec{
+			{http.StatusOK, "Wanted book", "Book", ""},
+			{http.StatusNotModified, "Book matches If-None-Match or If-Modified-Since", "", ""},
+			{http.StatusBadRequest, "ID is not a valid UUID", "", ""},
+			{http.StatusNotFound, "Book doesn't exist", "", ""},
+		},
+	},
+	"RemoveBook": {
+		Summary: "Remove a book by ID",
+		Tags:    []string{"books"},
+		Responses: []responseSpec{
+			{http.StatusNoContent, "Book is removed", "", ""},
+			{http.StatusBadRequest, "ID is not a valid UUID", "", ""},
+			{http.StatusNotFound, "Book doesn't exist", "", ""},
+		},
+	},
+	"ChangeBook": {
+		Summary:     "Change a book by ID",
+		Tags:        []string{"books"},
+		RequestBody: "Book",
+		Responses: []responseSpec{
+			{http.StatusOK, "Book is changed", "", ""},
+			{http.StatusBadRequest, "Body is not a valid book", "", ""},
+			{http.StatusNotFound, "Book doesn't exist", "", ""},
+		},
+	},
+	"BookPrices": {
+		Summary: "Price history of a book, from the oldest price to the current one",
+		Tags:    []string{"books"},
+		Responses: []responseSpec{
+			{http.StatusOK, "Prices with the dates they took effect", "PriceRecords", ""},
+			{http.StatusBadRequest, "ID is not a valid UUID", "", ""},
+			{http.StatusNotFound, "Book doesn't exist", "", ""},
+		},
+	},
+	"BookFilter": {
+		Summary:     "Filter books by price",
+		Tags:        []string{"books"},
+		Query:       []paramSpec{currencyParam},
+		RequestBody: "BookFilter",
+		Responses: []responseSpec{
+			{http.StatusOK, "Books matching the filter", "Books", ""},
+			{http.StatusNotModified, "Catalog matches If-None-Match or If-Modified-Since", "", ""},
+			{http.StatusBadRequest, "Body is not a valid filter or a price can't be converted into its currency", "", ""},
+		},
+	},
+	"BookBatch": {
+		Summary:     "Create, update and delete books in one transaction, all operations are applied or none",
+		Tags:        []string{"books"},
+		RequestBody: "BatchRequest",
+		Responses: []responseSpec{
+			{http.StatusOK, "All operations are applied, results are in order of the operations", "BatchResponse", ""},
+			{http.StatusBadRequest, "Body or an operation is not valid, nothing is applied", "BatchResponse", ""},
+			{http.StatusNotFound, "Book of an operation doesn't exist, nothing is applied", "BatchResponse", ""},
+			{http.StatusInternalServerError, "Batch can't be stored", "", ""},
+		},
+	},
+	"BookReprice": {
+		Summary:     "Preview or apply the price adjustment of the books matching the filter in one transaction",
+		Tags:        []string{"books"},
+		RequestBody: "Reprice",
+		Responses: []responseSpec{
+			{http.StatusOK, "Changed prices, applied or previewed", "RepriceResult", ""},
+			{http.StatusBadRequest, "Filter or adjustment is not valid, or a price would not be positive", "", ""},
+			{http.StatusConflict, "Catalog has changed since the previewed version, nothing is applied", "", ""},
+			{http.StatusInternalServerError, "Prices can't be stored", "", ""},
+		},
+	},
+	"GraphQL": {
+		Summary:     "Execute a GraphQL query over the catalog",
+		Tags:        []string{"graphql"},
+		RequestBody: "GraphQLRequest",
+		Responses:   []responseSpec{{http.StatusOK, "Result of the query", "GraphQLResponse", ""}},
+	},
+	"Events": {
+		Summary: "Stream of the catalog changes as Server-Sent Events, filtered by type and genre query parameters",
+		Tags:    []string{"events"},
+		Responses: []responseSpec{
+			{http.StatusOK, "Event stream, resumable with Last-Event-ID header, it starts with the reset event when the events after it are gone", "", "text/event-stream"},
+			{http.StatusBadRequest, "Last-Event-ID is not valid", "", ""},
+		},
+	},
+	"Changes": {
+		Summary: "Changes of the catalog since the sync token given as since query parameter, full catalog without it",
+		Tags:    []string{"events"},
+		Responses: []responseSpec{
+			{http.StatusOK, "Ordered changes with tombstones and the next token", "ChangeFeed", ""},
+			{http.StatusBadRequest, "Token is not valid", "", ""},
+		},
+	},
+	"Replication": {
+		Summary:   "Status of the replication from other instances",
+		Tags:      []string{"events"},
+		Responses: []responseSpec{{http.StatusOK, "Status of every peer", "PeerStatuses", ""}},
+	},
+	"WebhooksIndex": {
+		Summary:   "List webhook subscriptions",
+		Tags:      []string{"webhooks"},
+		Responses: []responseSpec{{http.StatusOK, "All subscriptions without secrets", "Subscriptions", ""}},
+	},
+	"WebhookCreate": {
+		Summary:     "Subscribe to the catalog events",
+		Tags:        []string{"webhooks"},
+		RequestBody: "Subscription",
+		Responses: []responseSpec{
+			{http.StatusCreated, "Created subscription with the generated ID, Location header points to it", "Subscription", ""},
+			{http.StatusBadRequest, "URL or secret is not valid", "", ""},
+		},
+	},
+	"RemoveWebhook": {
+		Summary: "Remove a webhook subscription",
+		Tags:    []string{"webhooks"},
+		Responses: []responseSpec{
+			{http.StatusNoContent, "Subscription is removed", "", ""},
+			{http.StatusNotFound, "Subscription doesn't exist", "", ""},
+		},
+	},
+	"DeadLetters": {
+		Summary:   "List deliveries which have run out of attempts",
+		Tags:      []string{"webhooks"},
+		Responses: []responseSpec{{http.StatusOK, "Dead deliveries", "Deliveries", ""}},
+	},
+	"ReplayDelivery": {
+		Summary: "Send a delivery again",
+		Tags:    []string{"webhooks"},
+		Responses: []responseSpec{
+			{http.StatusAccepted, "Delivery is scheduled", "", ""},
+			{http.StatusNotFound, "Delivery doesn't exist", "", ""},
+		},
+	},
+	"RatesIndex": {
+		Summary:   "List the exchange rates to the base currency EUR",
+		Tags:      []string{"rates"},
+		Responses: []responseSpec{{http.StatusOK, "All rates ordered by the currency", "Rates", ""}},
+	},
+	"SetRate": {
+		Summary:     "Set the exchange rate of the currency",
+		Tags:        []string{"rates"},
+		RequestBody: "Rate",
+		Responses: []responseSpec{
+			{http.StatusOK, "Stored rate", "Rate", ""},
+			{http.StatusBadRequest, "Currency is unknown or the base one, or the rate isn't positive", "", ""},
+		},
+	},
+	"RemoveRate": {
+		Summary: "Remove the exchange rate of the currency",
+		Tags:    []string{"rates"},
+		Responses: []responseSpec{
+			{http.StatusNoContent, "Rate is removed", "", ""},
+			{http.StatusNotFound, "Currency has no rate", "", ""},
+		},
+	},
+	"RatesImport": {
+		Summary:      "Import the ECB reference rates of the latest day in the file",
+		Tags:         []string{"rates"},
+		RequestTypes: []string{"application/xml", "text/csv"},
+		Responses: []responseSpec{
+			{http.StatusOK, "Imported rates", "Rates", ""},
+			{http.StatusBadRequest, "Body is not the ECB XML or CSV of the reference rates", "", ""},
+		},
+	},
+	"Metrics": {
+		Summary:   "Metrics in the Prometheus format",
+		Tags:      []string{"service"},
+		Responses: []responseSpec{{http.StatusOK, "Metrics", "", "text/plain"}},
+	},
+	"Healthz": {
+		Summary:   "Liveness probe",
+		Tags:      []string{"service"},
+		Responses: []responseSpec{{http.StatusOK, "Process is up", "Readiness", ""}},
+	},
+	"Readyz": {
+		Summary: "Readiness probe checking the storage backend",
+		Tags:    []string{"service"},
+		Responses: []responseSpec{
+			{http.StatusOK, "All checks passed", "Readiness", ""},
+			{http.StatusServiceUnavailable, "Some checks failed", "Readiness", ""},
+		},
+	},
+	"OpenAPI": {
+		Summary:   "This OpenAPI document",
+		Tags:      []string{"service"},
+		Responses: []responseSpec{{http.StatusOK, "OpenAPI 3 document", "", ""}},
+	},
+	"Docs": {
+		Summary:   "Interactive API documentation",
+		Tags:      []string{"service"},
+		Responses: []responseSpec{{http.StatusOK, "Documentation page", "", "text/html"}},
+	},
+}
+
+// specSchemas are component schemas which can be referred by name in routeSpecs
+var specSchemas = map[string]interface{}{
+	"Book":          schemaOf(reflect.TypeOf(storage.Book{})),
+	"Books":         map[string]interface{}{"type": "array", "items": schemaRef("Book")},
+	"BookFilter":    schemaOf(reflect.TypeOf(storage.BookFilter{})),
+	"BatchRequest":  schemaOf(reflect.TypeOf(batchRequest{})),
+	"BatchResponse": schemaOf(reflect.TypeOf(batchResponse{})),
+	"Reprice":       schemaOf(reflect.TypeOf(storage.Reprice{})),
+	"RepriceResult": schemaOf(reflect.TypeOf(storage.RepriceResult{})),
+	"PriceRecords":  schemaOf(reflect.TypeOf(storage.PriceRecords{})),
+	"Readiness":     schemaOf(reflect.TypeOf(readiness{})),
+	"ChangeFeed":    schemaOf(reflect.TypeOf(changeFeed{})),
+	"PeerStatuses":  schemaOf(reflect.TypeOf([]replication.PeerStatus{})),
+	"Subscription":  schemaOf(reflect.TypeOf(webhook.Subscription{})),
+	"Subscriptions": map[string]interface{}{"type": "array", "items": schemaRef("Subscription")},
+	"Delivery":      schemaOf(reflect.TypeOf(webhook.Delivery{})),
+	"Deliveries":    map[string]interface{}{"type": "array", "items": schemaRef("Delivery")},
+	"Rate":          schemaOf(reflect.TypeOf(rates.Rate{})),
+	"Rates":         map[string]interface{}{"type": "array", "items": schemaRef("Rate")},
+	"GraphQLRequest": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"query":         map[string]interface{}{"type": "string"},
+			"operationName": map[string]interface{}{"type": "string"},
+			"variables":     map[string]interface{}{"type": "object"},
+		},
+	},
+	"GraphQLResponse": map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"data":   map[string]interface{}{"type": "object"},
+			"errors": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "object"}},
+		},
+	},
+}
+
+var pathParam = regexp.MustCompile(`\{(\w+)(:[^}]*)?\}`)
+
+func schemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// schemaOf builds JSON schema of the type using its json tags
+func schemaOf(t reflect.Type) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{}
+	case reflect.TypeOf(storage.Decimal{}):
+		// the exact decimal is written as a JSON number
+		return map[string]interface{}{"type": "number"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			name := strings.TrimSpace(strings.Split(field.Tag.Get("json"), ",")[0])
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = schemaOf(field.Type)
+		}
+		return map[string]interface{}{"type": "object", "properties": properties}
+	}
+	return map[string]interface{}{}
+}
+
+// newSpec builds OpenAPI 3 document of the mounted routes
+func newSpec(routes []mountedRoute) (map[string]interface{}, error) {
+	paths := map[string]map[string]interface{}{}
+	for _, route := range routes {
+		spec, ok := routeSpecs[route.Name]
+		if !ok {
+			return nil, fmt.Errorf("route %q has no spec metadata", route.Name)
+		}
+
+		operation := map[string]interface{}{
+			"operationId": route.fullName(),
+			"summary":     spec.Summary,
+			"tags":        spec.Tags,
+		}
+		if route.Deprecated {
+			operation["deprecated"] = true
+		}
+
+		var parameters []interface{}
+		for _, match := range pathParam.FindAllStringSubmatch(route.Path, -1) {
+			parameters = append(parameters, map[string]interface{}{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, param := range spec.Query {
+			parameters = append(parameters, map[string]interface{}{
+				"name":        param.Name,
+				"in":          "query",
+				"description": param.Description,
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+		if idempotentRoute(route.Route) {
+			parameters = append(parameters, map[string]interface{}{
+				"name":        "Idempotency-Key",
+				"in":          "header",
+				"description": "Retries with the same key replay the first response instead of repeating the request",
+				"schema":      map[string]interface{}{"type": "string", "maxLength": maxIdempotencyKeyLength},
+			})
+		}
+		if parameters != nil {
+			operation["parameters"] = parameters
+		}
+
+		if spec.RequestBody != "" {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schemaRef(spec.RequestBody)},
+				},
+			}
+		}
+		if len(spec.RequestTypes) > 0 {
+			content := map[string]interface{}{}
+			for _, contentType := range spec.RequestTypes {
+				content[contentType] = map[string]interface{}{}
+			}
+			operation["requestBody"] = map[string]interface{}{"required": true, "content": content}
+		}
+
+		responses := map[string]interface{}{}
+		for _, resp := range spec.Responses {
+			r := map[string]interface{}{"description": resp.Description}
+			if resp.Schema != "" || resp.ContentType != "" {
+				contentType := resp.ContentType
+				if contentType == "" {
+					contentType = "application/json"
+				}
+				media := map[string]interface{}{}
+				if resp.Schema != "" {
+					media["schema"] = schemaRef(resp.Schema)
+				}
+				r["content"] = map[string]interface{}{contentType: media}
+			}
+			responses[strconv.Itoa(resp.Code)] = r
+		}
+		if idempotentRoute(route.Route) {
+			responses[strconv.Itoa(http.StatusConflict)] = map[string]interface{}{"description": "Request with the Idempotency-Key is in progress"}
+			responses[strconv.Itoa(http.StatusUnprocessableEntity)] = map[string]interface{}{"description": "Idempotency-Key was used for a different request"}
+		}
+		operation["responses"] = responses
+
+		path := pathParam.ReplaceAllString(route.Path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Library",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": specSchemas,
+		},
+	}, nil
+}
+
+// OpenAPIHandler handles requests with GET method and returns the OpenAPI document of the app
+func (h *handler) OpenAPIHandler(w http.ResponseWriter, _ *http.Request) {
+	spec, err := newSpec(h.routes)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err = json.NewEncoder(w).Encode(spec)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// DocsHandler handles requests with GET method and returns the page rendering the OpenAPI document
+func (h *handler) DocsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	_, err := fmt.Fprint(w, docsPage)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// docsPage is a self-contained page which renders /openapi.json and lets to try the operations
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Library API</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+.op { border: 1px solid #ccc; border-radius: 4px; margin: 1em 0; padding: 0.5em 1em; }
+.method { display: inline-block; width: 5em; font-weight: bold; text-transform: uppercase; }
+textarea { width: 100%; height: 6em; font-family: monospace; }
+pre { background: #f5f5f5; padding: 0.5em; overflow: auto; }
+</style>
+</head>
+<body>
+<h1>Library API</h1>
+<div id="ops"></div>
+<script>
+function el(tag, text) {
+	var e = document.createElement(tag);
+	if (text) { e.textContent = text; }
+	return e;
+}
+
+fetch("openapi.json").then(function (r) { return r.json(); }).then(function (spec) {
+	var ops = document.getElementById("ops");
+	Object.keys(spec.paths).sort().forEach(function (path) {
+		Object.keys(spec.paths[path]).forEach(function (method) {
+			var op = spec.paths[path][method];
+			var box = el("div");
+			box.className = "op";
+
+			var title = el("div");
+			var m = el("span", method);
+			m.className = "method";
+			title.appendChild(m);
+			title.appendChild(el("code", path));
+			title.appendChild(el("span", " - " + op.summary));
+			box.appendChild(title);
+
+			var inputs = {};
+			(op.parameters || []).forEach(function (p) {
+				var input = el("input");
+				input.placeholder = p.name;
+				inputs[p.name] = input;
+				box.appendChild(input);
+			});
+			var body;
+			if (op.requestBody) {
+				body = el("textarea");
+				body.placeholder = "JSON body";
+				box.appendChild(body);
+			}
+
+			var out = el("pre");
+			var send = el("button", "Try it");
+			send.onclick = function () {
+				var url = path.replace(/\{(\w+)\}/g, function (_, name) {
+					return encodeURIComponent(inputs[name].value);
+				});
+				fetch(url, {method: method.toUpperCase(), body: body ? body.value : undefined})
+					.then(function (r) {
+						return r.text().then(function (text) { out.textContent = r.status + "\n" + text; });
+					});
+			};
+			box.appendChild(send);
+			box.appendChild(out);
+			ops.appendChild(box);
+		});
+	});
+});
+</script>
+</body>
+</html>
+`
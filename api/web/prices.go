@@ -0,0 +1,49 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/ssOlexBaiko/library/storage"
+)
+
+// BookPricesHandler handles requests with GET method.
+// The prices of the book are listed from the oldest one, every one with the date it took effect.
+func (h *handler) BookPricesHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("BookPrices - call")
+
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok || !validID(id) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	prices, err := h.storage.PriceHistory(r.Context(), id)
+	if err != nil {
+		if canceled(w, err) {
+			return
+		}
+		switch {
+		case errors.Is(err, storage.ErrNotFound):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, storage.ErrInvalid):
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	if prices == nil {
+		prices = storage.PriceRecords{}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err = json.NewEncoder(w).Encode(prices); err != nil {
+		log.Println(err)
+	}
+}
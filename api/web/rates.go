@@ -0,0 +1,184 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ssOlexBaiko/library/rates"
+	"github.com/ssOlexBaiko/library/storage"
+)
+
+// Rates manages the exchange-rate table the prices of the listings are converted at
+type Rates interface {
+	Rates() (rates.Rates, error)
+	Set(rate rates.Rate) (rates.Rate, error)
+	Remove(currency string) error
+	Import(r io.Reader) (rates.Rates, error)
+	Convert(price storage.Money, currency string) (storage.Money, error)
+	Updated() time.Time
+}
+
+// WithRates enables the exchange-rate table and the conversion of the listings by ?currency=
+func WithRates(rates Rates) Option {
+	return func(h *handler) {
+		h.rates = rates
+	}
+}
+
+// RatesIndexHandler handles requests with GET method
+func (h *handler) RatesIndexHandler(w http.ResponseWriter, _ *http.Request) {
+	log.Println("RatesIndex - call")
+	if h.rates == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	list, err := h.rates.Rates()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err = json.NewEncoder(w).Encode(list)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// SetRateHandler handles requests with PUT method
+func (h *handler) SetRateHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("SetRate - call")
+	if h.rates == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var rate rates.Rate
+	err := json.NewDecoder(r.Body).Decode(&rate)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rate.Currency = mux.Vars(r)["currency"]
+
+	rate, err = h.rates.Set(rate)
+	if err != nil {
+		if errors.Is(err, rates.ErrInvalidRate) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err = json.NewEncoder(w).Encode(rate)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// RemoveRateHandler handles requests with DELETE method
+func (h *handler) RemoveRateHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("RemoveRate - call")
+	if h.rates == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err := h.rates.Remove(mux.Vars(r)["currency"])
+	if err != nil {
+		if errors.Is(err, rates.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RatesImportHandler handles requests with POST method.
+// The body is the ECB reference rates file in XML or CSV, the imported rates are returned.
+func (h *handler) RatesImportHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("RatesImport - call")
+	if h.rates == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	imported, err := h.rates.Import(r.Body)
+	if err != nil {
+		if errors.Is(err, rates.ErrInvalidImport) || errors.Is(err, rates.ErrInvalidRate) {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err = json.NewEncoder(w).Encode(imported)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// listingCurrency returns the currency given by ?currency= the listing is converted into
+func listingCurrency(r *http.Request) string {
+	return strings.ToUpper(r.URL.Query().Get("currency"))
+}
+
+// ratesVersion returns the ETag part of the rates and the later of the catalog and the rates modification times.
+// The converted prices change with the rates as well, so the validators take both into account.
+func (h *handler) ratesVersion(modified time.Time) (string, time.Time) {
+	var updated time.Time
+	if h.rates != nil {
+		updated = h.rates.Updated()
+	}
+	if updated.After(modified) {
+		modified = updated
+	}
+	return "rates=" + updated.Format(time.RFC3339Nano), modified
+}
+
+// convertBooks returns the books with their prices in the currency, the books aren't changed.
+// The error wraps storage.ErrInvalid when the currency is unknown or it has no rate.
+func (h *handler) convertBooks(books storage.Books, currency string) (storage.Books, error) {
+	if _, ok := storage.CurrencyPlaces(currency); !ok {
+		return nil, fmt.Errorf("%w: unknown currency %q", storage.ErrInvalid, currency)
+	}
+
+	converted := make(storage.Books, 0, len(books))
+	for _, book := range books {
+		price := book.Money()
+		if price.Currency != currency {
+			if h.rates == nil {
+				return nil, fmt.Errorf("%w: no exchange rates to convert the %s price of book %s", storage.ErrInvalid, price.Currency, book.ID)
+			}
+			var err error
+			if price, err = h.rates.Convert(price, currency); err != nil {
+				return nil, fmt.Errorf("%w: book %s: %v", storage.ErrInvalid, book.ID, err)
+			}
+		}
+		book.Price, book.Currency = price.Amount, price.Currency
+		converted = append(converted, book)
+	}
+	return converted, nil
+}
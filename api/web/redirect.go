@@ -0,0 +1,28 @@
+package web
+
+import (
+	"net"
+	"net/http"
+)
+
+// RedirectToHTTPS redirects the plain HTTP requests to the same URL on the HTTPS port,
+// the default port 443 is left out of the URL
+func RedirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+
+		// 308 makes the clients repeat the other methods with the same body
+		code := http.StatusMovedPermanently
+		if r.Method != "GET" && r.Method != "HEAD" {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, target, code)
+	})
+}
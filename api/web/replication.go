@@ -0,0 +1,32 @@
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/ssOlexBaiko/library/replication"
+)
+
+// Replication reports how the changes are pulled from other instances
+type Replication interface {
+	Status() []replication.PeerStatus
+}
+
+// ReplicationHandler handles requests with GET method and returns the replication status of every peer
+func (h *handler) ReplicationHandler(w http.ResponseWriter, _ *http.Request) {
+	log.Println("Replication - call")
+
+	statuses := []replication.PeerStatus{}
+	if h.replication != nil {
+		statuses = h.replication.Status()
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err := json.NewEncoder(w).Encode(statuses)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
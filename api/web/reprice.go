@@ -0,0 +1,50 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/ssOlexBaiko/library/storage"
+)
+
+// BookRepriceHandler handles requests with POST method.
+// The prices of the books matching the filter are adjusted by the rule, all or none.
+// Without apply the response is the preview of the changes, its version can be sent with the apply,
+// so the prices aren't changed when the catalog has changed since the preview.
+func (h *handler) BookRepriceHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("BookReprice - call")
+
+	var reprice storage.Reprice
+	err := json.NewDecoder(r.Body).Decode(&reprice)
+	if err != nil {
+		log.Println(err)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.storage.Reprice(r.Context(), reprice)
+	if err != nil {
+		if canceled(w, err) {
+			return
+		}
+		log.Println(err)
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		switch {
+		case errors.Is(err, storage.ErrInvalid):
+			w.WriteHeader(http.StatusBadRequest)
+		case errors.Is(err, storage.ErrConflict):
+			w.WriteHeader(http.StatusConflict)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err = json.NewEncoder(w).Encode(result); err != nil {
+		log.Println(err)
+	}
+}
@@ -1,7 +1,9 @@
 package web
 
 import (
+	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -17,26 +19,182 @@ type Route struct {
 // Routes contains route objects
 type Routes []Route
 
-// NewRouter initialize app routers
-func NewRouter(handler *handler) *mux.Router {
-	var routes = Routes{
+// Version groups the routes of a single API version which are mounted under /<Name>
+type Version struct {
+	Name   string
+	Routes Routes
+}
+
+// mountedRoute describes the route as it's served by the router
+type mountedRoute struct {
+	Route
+	Path       string
+	Version    string
+	Deprecated bool
+}
+
+// fullName returns the unique name of the mounted route,
+// versioned routes are prefixed by the version name
+func (r mountedRoute) fullName() string {
+	if r.Version == "" || r.Deprecated {
+		return r.Name
+	}
+	return r.Version + "." + r.Name
+}
+
+// legacyVersion is the version served by the deprecated unversioned routes
+const legacyVersion = "v1"
+
+var (
+	// legacyDeprecation is the date since the unversioned routes are deprecated
+	legacyDeprecation = time.Date(2026, time.October, 15, 0, 0, 0, 0, time.UTC)
+	// legacySunset is the date after which the unversioned routes will be removed
+	legacySunset = time.Date(2027, time.April, 15, 0, 0, 0, 0, time.UTC)
+)
+
+// newServiceRoutes returns routes which are not part of the versioned API.
+// Every route has to be described in routeSpecs as well.
+func newServiceRoutes(handler *handler) Routes {
+	return Routes{
+		{"Metrics", "GET", "/metrics", handler.MetricsHandler},
+		{"Healthz", "GET", "/healthz", handler.HealthzHandler},
+		{"Readyz", "GET", "/readyz", handler.ReadyzHandler},
+	}
+}
+
+// newV1Routes returns the routes of the first API version.
+// Every route has to be described in routeSpecs as well.
+func newV1Routes(handler *handler) Routes {
+	return Routes{
 		{"Index", "GET", "/", handler.IndexHandler},
 		{"BooksIndex", "GET", "/books", handler.BooksIndexHandler},
 		{"BookCreate", "POST", "/books", handler.BookCreateHandler},
 		{"GetBook", "GET", "/books/{id}", handler.GetBookHandler},
 		{"RemoveBook", "Delete", "/books/{id}", handler.RemoveBookHandler},
 		{"ChangeBook", "PUT", "/books/{id}", handler.ChangeBookHandler},
+		{"BookPrices", "GET", "/books/{id}/prices", handler.BookPricesHandler},
 		{"BookFilter", "POST", "/books/filter", handler.BookFilterHandler},
+		{"BookBatch", "POST", "/books/batch", handler.BookBatchHandler},
+		{"BookReprice", "POST", "/books/reprice", handler.BookRepriceHandler},
+		{"GraphQL", "POST", "/graphql", handler.GraphQLHandler},
+		{"Events", "GET", "/events", handler.EventsHandler},
+		{"Changes", "GET", "/changes", handler.ChangesHandler},
+		{"Replication", "GET", "/replication", handler.ReplicationHandler},
+		{"WebhooksIndex", "GET", "/webhooks", handler.WebhooksIndexHandler},
+		{"WebhookCreate", "POST", "/webhooks", handler.WebhookCreateHandler},
+		{"RemoveWebhook", "DELETE", "/webhooks/{id}", handler.RemoveWebhookHandler},
+		{"DeadLetters", "GET", "/webhooks/dead-letters", handler.DeadLettersHandler},
+		{"ReplayDelivery", "POST", "/webhooks/deliveries/{id}/replay", handler.ReplayDeliveryHandler},
+		{"RatesIndex", "GET", "/rates", handler.RatesIndexHandler},
+		{"RatesImport", "POST", "/rates/import", handler.RatesImportHandler},
+		{"SetRate", "PUT", "/rates/{currency}", handler.SetRateHandler},
+		{"RemoveRate", "DELETE", "/rates/{currency}", handler.RemoveRateHandler},
+		{"OpenAPI", "GET", "/openapi.json", handler.OpenAPIHandler},
+		{"Docs", "GET", "/docs", handler.DocsHandler},
+	}
+}
+
+// newVersions returns all API versions.
+// A new version is added here with its own routes table, so it can use different handlers.
+func newVersions(handler *handler) []Version {
+	return []Version{
+		{"v1", newV1Routes(handler)},
 	}
+}
 
+// NewRouter initialize app routers
+func NewRouter(handler *handler) *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
-	for _, route := range routes {
-		router.
-			Methods(route.Method).
-			Path(route.Pattern).
-			Name(route.Name).
-			Handler(route.HandlerFunc)
+	handler.routes = nil
+
+	for _, route := range newServiceRoutes(handler) {
+		handler.mount(router, mountedRoute{Route: route, Path: route.Pattern})
 	}
 
+	subrouters := map[string]*mux.Router{}
+	for _, version := range newVersions(handler) {
+		subrouter := router.PathPrefix("/" + version.Name).Subrouter()
+		subrouters[version.Name] = subrouter
+		for _, route := range version.Routes {
+			handler.mount(subrouter, mountedRoute{
+				Route:   route,
+				Path:    "/" + version.Name + route.Pattern,
+				Version: version.Name,
+			})
+		}
+
+		if version.Name != legacyVersion {
+			continue
+		}
+		// old clients still call the routes without version prefix
+		for _, route := range version.Routes {
+			handler.mount(router, mountedRoute{
+				Route:      route,
+				Path:       route.Pattern,
+				Version:    version.Name,
+				Deprecated: true,
+			})
+		}
+	}
+
+	if handler.cors != nil {
+		handler.mountPreflights(router, subrouters)
+	}
 	return router
 }
+
+// mount registers the route in the router and remembers it for the API specification
+func (h *handler) mount(router *mux.Router, route mountedRoute) {
+	version := route.Version
+	var handler http.Handler = route.HandlerFunc
+	if timeout := h.routeTimeout(route.Name); timeout > 0 {
+		handler = withTimeout(timeout, handler)
+	}
+	if policy := h.cachePolicies[route.Name]; policy != "" {
+		handler = cacheControl(policy, handler)
+	}
+	if idempotentRoute(route.Route) && h.idempotency.retention > 0 {
+		handler = h.idempotent(handler)
+	}
+	if h.maxBodyBytes > 0 {
+		handler = limitBody(h.maxBodyBytes, handler)
+	}
+	if role := requiredRole(route.Route); role != "" && h.authEnabled() {
+		handler = h.authorize(role, handler)
+	}
+	if route.Deprecated {
+		handler = deprecated(route.Version, handler)
+		version = ""
+	}
+	if h.cors != nil {
+		// the front-ends have to read the authorization errors as well
+		handler = h.corsHeaders(handler)
+	}
+
+	router.
+		Methods(route.Method).
+		Path(route.Pattern).
+		Name(route.fullName()).
+		Handler(traced(route, instrument(route.Name, version, handler)))
+
+	h.routes = append(h.routes, route)
+}
+
+// deprecated adds headers which announce that the route is going to be removed
+// in favour of the same route of the given version
+func deprecated(version string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", legacyDeprecation.Unix()))
+		w.Header().Set("Sunset", legacySunset.Format(http.TimeFormat))
+		w.Header().Set("Link", fmt.Sprintf(`</%s%s>; rel="successor-version"`, version, r.URL.Path))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitBody makes reading of the request body fail after n bytes
+func limitBody(n int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,69 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// defaultTimeout limits the routes which aren't listed in defaultRouteTimeouts unless it's configured
+const defaultTimeout = 10 * time.Second
+
+// defaultRouteTimeouts are deadlines of the request contexts by route names, zero means no deadline.
+// The deadline cancels the storage calls of the request, the client disconnect cancels them as well.
+var defaultRouteTimeouts = map[string]time.Duration{
+	"Events":  0,
+	"Changes": 30 * time.Second,
+	"GraphQL": 30 * time.Second,
+	"Metrics": 30 * time.Second,
+	"Healthz": time.Second,
+	"Readyz":  5 * time.Second,
+}
+
+// WithRouteTimeout sets the deadline of the requests of the route with given name,
+// zero removes the deadline
+func WithRouteTimeout(route string, timeout time.Duration) Option {
+	return func(h *handler) {
+		h.timeouts[route] = timeout
+	}
+}
+
+// WithDefaultTimeout sets the deadline of the routes which don't have their own
+func WithDefaultTimeout(timeout time.Duration) Option {
+	return func(h *handler) {
+		h.defaultTimeout = timeout
+	}
+}
+
+// routeTimeout returns the deadline of the route with given name
+func (h *handler) routeTimeout(route string) time.Duration {
+	if timeout, ok := h.timeouts[route]; ok {
+		return timeout
+	}
+	return h.defaultTimeout
+}
+
+// withTimeout cancels the context of the request after the timeout
+func withTimeout(timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// canceled reports whether the storage call failed because the request context is done.
+// The timed out request gets 503, nothing is written for the client which is gone.
+func canceled(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		log.Println(err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return true
+	case errors.Is(err, context.Canceled):
+		return true
+	}
+	return false
+}
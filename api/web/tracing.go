@@ -0,0 +1,51 @@
+package web
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ssOlexBaiko/library/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans, the tracer is taken from the global provider
+// for every span, so the provider which is set after the package is loaded is used as well
+const tracerName = "github.com/ssOlexBaiko/library/api/web"
+
+// traced starts the server span of every request of the route, the span is named after the route.
+// The trace is continued when the client sends traceparent header,
+// the request is logged with the trace ID when it has one, so the log line leads to the trace.
+func traced(route mountedRoute, next http.Handler) http.Handler {
+	name := route.Method + " " + route.Path
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := otel.Tracer(tracerName).Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route.Path),
+				attribute.String("library.route", route.fullName()),
+			),
+		)
+		defer span.End()
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+		if traceID := tracing.TraceID(ctx); traceID != "" {
+			log.Printf("%s %s %d %s trace_id=%s", r.Method, r.URL.Path, rec.status, time.Since(start), traceID)
+		} else {
+			log.Printf("%s %s %d %s", r.Method, r.URL.Path, rec.status, time.Since(start))
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/ssOlexBaiko/library/webhook"
+)
+
+// Webhooks manages subscriptions to the catalog events and their deliveries
+type Webhooks interface {
+	Subscriptions() (webhook.Subscriptions, error)
+	Subscribe(sub webhook.Subscription) (webhook.Subscription, error)
+	Unsubscribe(id string) error
+	DeadLetters() (webhook.Deliveries, error)
+	Replay(id string) error
+}
+
+// WebhooksIndexHandler handles requests with GET method
+func (h *handler) WebhooksIndexHandler(w http.ResponseWriter, _ *http.Request) {
+	log.Println("WebhooksIndex - call")
+	if h.webhooks == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	subs, err := h.webhooks.Subscriptions()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err = json.NewEncoder(w).Encode(subs)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// WebhookCreateHandler handles requests with POST method
+func (h *handler) WebhookCreateHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("WebhookCreate - call")
+	if h.webhooks == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var sub webhook.Subscription
+	err := json.NewDecoder(r.Body).Decode(&sub)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	sub, err = h.webhooks.Subscribe(sub)
+	if err != nil {
+		if err == webhook.ErrInvalidSubscription {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	created(w, r, sub.ID, sub)
+}
+
+// RemoveWebhookHandler handles requests with DELETE method
+func (h *handler) RemoveWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("RemoveWebhook - call")
+	if h.webhooks == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err := h.webhooks.Unsubscribe(mux.Vars(r)["id"])
+	if err != nil {
+		if err == webhook.ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeadLettersHandler handles requests with GET method
+func (h *handler) DeadLettersHandler(w http.ResponseWriter, _ *http.Request) {
+	log.Println("DeadLetters - call")
+	if h.webhooks == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	deliveries, err := h.webhooks.DeadLetters()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	err = json.NewEncoder(w).Encode(deliveries)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// ReplayDeliveryHandler handles requests with POST method
+func (h *handler) ReplayDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println("ReplayDelivery - call")
+	if h.webhooks == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err := h.webhooks.Replay(mux.Vars(r)["id"])
+	if err != nil {
+		if err == webhook.ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
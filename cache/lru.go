@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"container/list"
+	"time"
+)
+
+// entry is the cached value together with the time it expires
+type entry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// lru keeps at most size entries and evicts the least recently used one first.
+// It isn't safe for concurrent use, Storage guards it with its lock.
+type lru struct {
+	size  int
+	ttl   time.Duration
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newLRU(size int, ttl time.Duration) *lru {
+	return &lru{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+// get returns the value which hasn't expired yet
+func (c *lru) get(key string) (interface{}, bool) {
+	element, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := element.Value.(*entry)
+	if c.ttl > 0 && time.Now().After(e.expires) {
+		c.remove(element)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return e.value, true
+}
+
+// add stores the value and returns the number of evicted entries
+func (c *lru) add(key string, value interface{}) int {
+	expires := time.Now().Add(c.ttl)
+	if element, ok := c.items[key]; ok {
+		e := element.Value.(*entry)
+		e.value = value
+		e.expires = expires
+		c.order.MoveToFront(element)
+		return 0
+	}
+
+	c.items[key] = c.order.PushFront(&entry{key: key, value: value, expires: expires})
+	evicted := 0
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		evicted++
+	}
+	return evicted
+}
+
+// drop removes the key, it's fine when the key isn't cached
+func (c *lru) drop(key string) {
+	if element, ok := c.items[key]; ok {
+		c.remove(element)
+	}
+}
+
+// each calls fn for every cached entry, the entries can be dropped from fn
+func (c *lru) each(fn func(key string, value interface{})) {
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		e := element.Value.(*entry)
+		fn(e.key, e.value)
+		element = next
+	}
+}
+
+func (c *lru) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.items, element.Value.(*entry).key)
+}
@@ -0,0 +1,23 @@
+package cache
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	requestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "library_cache_requests_total",
+			Help: "Number of cache lookups by kind of the cached value and result.",
+		},
+		[]string{"kind", "result"},
+	)
+	evictionsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "library_cache_evictions_total",
+			Help: "Number of entries evicted from the cache because it was full.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, evictionsTotal)
+}
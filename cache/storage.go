@@ -0,0 +1,241 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ssOlexBaiko/library/api/web"
+	"github.com/ssOlexBaiko/library/storage"
+)
+
+// filterResult is the cached answer of the price filter
+type filterResult struct {
+	filter storage.BookFilter
+	books  storage.Books
+}
+
+// Storage is the read-through cache in front of any storage of the handlers.
+// Single books and filter results are cached, the rest of the methods go straight to the wrapped storage.
+// Writes made through the cache invalidate only the entries they can affect,
+// writes made around it, like the replicated ones, have to be passed to Invalidate
+// and the changes of the exchange rates to InvalidateRates.
+type Storage struct {
+	web.Storage
+
+	mu    sync.Mutex
+	cache *lru
+	// generation is moved by every invalidation, so a value loaded before it isn't cached
+	generation uint64
+}
+
+// NewStorage constructor for Storage struct, it keeps at most size entries for ttl each
+func NewStorage(next web.Storage, size int, ttl time.Duration) *Storage {
+	return &Storage{
+		Storage: next,
+		cache:   newLRU(size, ttl),
+	}
+}
+
+func bookKey(id string) string {
+	return "book:" + id
+}
+
+func filterKey(filter storage.BookFilter) string {
+	return "filter:" + filter.Key()
+}
+
+// lookup returns the cached value and the generation the missed value has to be loaded in
+func (s *Storage) lookup(kind, key string) (interface{}, uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.cache.get(key)
+	if ok {
+		requestsTotal.WithLabelValues(kind, "hit").Inc()
+	} else {
+		requestsTotal.WithLabelValues(kind, "miss").Inc()
+	}
+	return value, s.generation, ok
+}
+
+// store caches the loaded value unless something was invalidated while it was loading
+func (s *Storage) store(key string, value interface{}, generation uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if generation != s.generation {
+		return
+	}
+	evictionsTotal.Add(float64(s.cache.add(key, value)))
+}
+
+// GetBook returns the book from the cache or loads it from the wrapped storage
+func (s *Storage) GetBook(ctx context.Context, id string) (storage.Book, error) {
+	value, generation, ok := s.lookup("book", bookKey(id))
+	if ok {
+		return copyBook(value.(storage.Book)), nil
+	}
+
+	book, err := s.Storage.GetBook(ctx, id)
+	if err != nil {
+		return book, err
+	}
+	s.store(bookKey(id), copyBook(book), generation)
+	return book, nil
+}
+
+// PriceFilter returns the filtered books from the cache or loads them from the wrapped storage
+func (s *Storage) PriceFilter(ctx context.Context, filter storage.BookFilter) (storage.Books, error) {
+	value, generation, ok := s.lookup("filter", filterKey(filter))
+	if ok {
+		return copyBooks(value.(filterResult).books), nil
+	}
+
+	books, err := s.Storage.PriceFilter(ctx, filter)
+	if err != nil {
+		return books, err
+	}
+	s.store(filterKey(filter), filterResult{filter: filter, books: copyBooks(books)}, generation)
+	return books, nil
+}
+
+// CreateBook creates the book and drops the filter results the new book belongs to
+func (s *Storage) CreateBook(ctx context.Context, book storage.Book) (storage.Book, error) {
+	created, err := s.Storage.CreateBook(ctx, book)
+	if err != nil {
+		// the failed call may still have stored the book, e.g. when only the commit result is lost
+		s.invalidate(book, false)
+		return created, err
+	}
+	s.invalidate(created, false)
+	return created, nil
+}
+
+// ChangeBook changes the book and drops it together with the filter results it was or is in now
+func (s *Storage) ChangeBook(ctx context.Context, id string, changedBook storage.Book) error {
+	err := s.Storage.ChangeBook(ctx, id, changedBook)
+	changedBook.ID = id
+	s.invalidate(changedBook, false)
+	return err
+}
+
+// RemoveBook removes the book and drops it together with the filter results it was in
+func (s *Storage) RemoveBook(ctx context.Context, id string) error {
+	err := s.Storage.RemoveBook(ctx, id)
+	s.invalidate(storage.Book{ID: id}, true)
+	return err
+}
+
+// Batch applies the operations and drops the entries of every book they touched,
+// the failed batch drops them as well like the failed single writes do
+func (s *Storage) Batch(ctx context.Context, ops []storage.Operation) ([]storage.OperationResult, error) {
+	results, err := s.Storage.Batch(ctx, ops)
+	for i, op := range ops {
+		book := op.Book
+		book.ID = op.ID
+		if err == nil && results[i].Book != nil {
+			book = *results[i].Book
+		}
+		s.invalidate(book, op.Op == storage.OpDelete)
+	}
+	return results, err
+}
+
+// Reprice adjusts the prices and drops the entries of the repriced books once they are applied,
+// the failed apply is rolled back, so nothing is dropped
+func (s *Storage) Reprice(ctx context.Context, reprice storage.Reprice) (storage.RepriceResult, error) {
+	result, err := s.Storage.Reprice(ctx, reprice)
+	if err != nil || !result.Applied {
+		return result, err
+	}
+	for _, change := range result.Changes {
+		// the filter results are matched against the whole book, so it's read back with its genres
+		book, getErr := s.Storage.GetBook(ctx, change.ID)
+		if getErr != nil {
+			book = storage.Book{ID: change.ID, Title: change.Title, Price: change.NewPrice}
+		}
+		s.invalidate(book, false)
+	}
+	return result, err
+}
+
+// Invalidate drops the entries affected by the event of the catalog.
+// It's meant to be registered as a listener of the library, so the changes made around the cache are seen.
+func (s *Storage) Invalidate(event storage.Event) {
+	s.invalidate(event.Book, event.Type == storage.EventBookDeleted)
+}
+
+// InvalidateRates drops the filter results with the currency, which were compared at the exchange rates.
+// It's meant to be registered as a listener of the exchange-rate table, the cache doesn't see the rates otherwise.
+func (s *Storage) InvalidateRates() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.generation++
+	s.cache.each(func(key string, value interface{}) {
+		if result, ok := value.(filterResult); ok && result.filter.Currency != "" {
+			s.cache.drop(key)
+		}
+	})
+}
+
+// invalidate drops the book and the filter results which contain it or which it matches now.
+// The entries are dropped even when the write failed, because the storage might be changed partially.
+func (s *Storage) invalidate(book storage.Book, deleted bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.generation++
+	if book.ID != "" {
+		s.cache.drop(bookKey(book.ID))
+	}
+	s.cache.each(func(key string, value interface{}) {
+		result, ok := value.(filterResult)
+		if !ok {
+			return
+		}
+		if contains(result.books, book.ID) {
+			s.cache.drop(key)
+			return
+		}
+		if deleted {
+			return
+		}
+		if matched, err := result.filter.Match(book); err != nil || matched {
+			s.cache.drop(key)
+		}
+	})
+}
+
+func contains(books storage.Books, id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, book := range books {
+		if book.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// copyBook returns the book which doesn't share genres with the cached one,
+// so callers can't change the cache by decoding into the book they got
+func copyBook(book storage.Book) storage.Book {
+	if book.Genres != nil {
+		book.Genres = append([]string(nil), book.Genres...)
+	}
+	return book
+}
+
+func copyBooks(books storage.Books) storage.Books {
+	if books == nil {
+		return nil
+	}
+	copied := make(storage.Books, len(books))
+	for i, book := range books {
+		copied[i] = copyBook(book)
+	}
+	return copied
+}
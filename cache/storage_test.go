@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ssOlexBaiko/library/api/web"
+	"github.com/ssOlexBaiko/library/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// counting counts the reads which reach the wrapped storage
+type counting struct {
+	web.Storage
+	gets, filters int
+}
+
+func (c *counting) GetBook(ctx context.Context, id string) (storage.Book, error) {
+	c.gets++
+	return c.Storage.GetBook(ctx, id)
+}
+
+func (c *counting) PriceFilter(ctx context.Context, filter storage.BookFilter) (storage.Books, error) {
+	c.filters++
+	return c.Storage.PriceFilter(ctx, filter)
+}
+
+func newLibrary(t *testing.T) web.Storage {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "storage.json")
+	if err = ioutil.WriteFile(path, []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return storage.NewLibrary(path, false)
+}
+
+func TestStorage(t *testing.T) {
+	test := assert.New(t)
+	ctx := context.Background()
+	next := &counting{Storage: newLibrary(t)}
+	cached := NewStorage(next, 10, time.Hour)
+
+	cheap, err := cached.CreateBook(ctx, storage.Book{Title: "Cheap", Genres: []string{"adventure"}, Pages: 100, Price: storage.MustDecimal("5")})
+	test.NoError(err)
+	_, err = cached.CreateBook(ctx, storage.Book{Title: "Expensive", Genres: []string{"drama"}, Pages: 100, Price: storage.MustDecimal("50")})
+	test.NoError(err)
+
+	// repeated reads are served from the cache
+	for i := 0; i < 3; i++ {
+		book, err := cached.GetBook(ctx, cheap.ID)
+		test.NoError(err)
+		test.Equal(cheap, book)
+		filtered, err := cached.PriceFilter(ctx, storage.BookFilter{Price: "<10"})
+		test.NoError(err)
+		test.Len(filtered, 1)
+	}
+	test.Equal(1, next.gets)
+	test.Equal(1, next.filters)
+
+	// changing the returned book doesn't change the cache
+	book, _ := cached.GetBook(ctx, cheap.ID)
+	book.Genres[0] = "changed"
+	book, _ = cached.GetBook(ctx, cheap.ID)
+	test.Equal("adventure", book.Genres[0])
+
+	// the changed book is dropped together with the filter it left
+	cheap.Price = storage.MustDecimal("20")
+	test.NoError(cached.ChangeBook(ctx, cheap.ID, cheap))
+	book, err = cached.GetBook(ctx, cheap.ID)
+	test.NoError(err)
+	test.Equal("20", book.Price.String())
+	filtered, err := cached.PriceFilter(ctx, storage.BookFilter{Price: "<10"})
+	test.NoError(err)
+	test.Empty(filtered)
+	test.Equal(2, next.gets)
+	test.Equal(2, next.filters)
+
+	// unrelated filter results survive the write
+	_, err = cached.PriceFilter(ctx, storage.BookFilter{Price: ">100"})
+	test.NoError(err)
+	_, err = cached.CreateBook(ctx, storage.Book{Title: "Another", Genres: []string{"drama"}, Pages: 100, Price: storage.MustDecimal("1")})
+	test.NoError(err)
+	_, err = cached.PriceFilter(ctx, storage.BookFilter{Price: ">100"})
+	test.NoError(err)
+	test.Equal(3, next.filters)
+
+	// the batch drops the filter results of the books it touched
+	another, err := cached.PriceFilter(ctx, storage.BookFilter{Price: "<10"})
+	test.NoError(err)
+	test.Len(another, 1)
+	_, err = cached.Batch(ctx, []storage.Operation{{Op: storage.OpDelete, ID: another[0].ID}})
+	test.NoError(err)
+	filtered, err = cached.PriceFilter(ctx, storage.BookFilter{Price: "<10"})
+	test.NoError(err)
+	test.Empty(filtered)
+
+	// the applied reprice drops the filter results of the repriced books
+	drama, err := cached.PriceFilter(ctx, storage.BookFilter{Genre: "drama"})
+	test.NoError(err)
+	test.Len(drama, 1)
+	_, err = cached.Reprice(ctx, storage.Reprice{
+		Filter:     storage.BookFilter{Genre: "drama"},
+		Adjustment: storage.Adjustment{Kind: storage.AdjustSet, Value: storage.MustDecimal("60")},
+		Apply:      true,
+	})
+	test.NoError(err)
+	drama, err = cached.PriceFilter(ctx, storage.BookFilter{Genre: "drama"})
+	test.NoError(err)
+	if test.Len(drama, 1) {
+		test.Equal("60", drama[0].Price.String())
+	}
+
+	// the filters with the currency depend on the exchange rates, so they are dropped when the rates change
+	filters := next.filters
+	for i := 0; i < 2; i++ {
+		_, err = cached.PriceFilter(ctx, storage.BookFilter{Price: "<100", Currency: "USD"})
+		test.NoError(err)
+		_, err = cached.PriceFilter(ctx, storage.BookFilter{Price: "<100"})
+		test.NoError(err)
+	}
+	test.Equal(filters+2, next.filters)
+	cached.InvalidateRates()
+	_, err = cached.PriceFilter(ctx, storage.BookFilter{Price: "<100", Currency: "USD"})
+	test.NoError(err)
+	_, err = cached.PriceFilter(ctx, storage.BookFilter{Price: "<100"})
+	test.NoError(err)
+	test.Equal(filters+3, next.filters, "only the filter with the currency is loaded again")
+
+	// changes made around the cache are seen through Invalidate
+	test.NoError(next.RemoveBook(ctx, cheap.ID))
+	cached.Invalidate(storage.Event{Type: storage.EventBookDeleted, Book: cheap})
+	_, err = cached.GetBook(ctx, cheap.ID)
+	test.Equal(storage.ErrNotFound, err)
+}
+
+func TestLRU(t *testing.T) {
+	test := assert.New(t)
+
+	c := newLRU(2, time.Hour)
+	c.add("a", 1)
+	c.add("b", 2)
+	c.get("a")
+	test.Equal(1, c.add("c", 3))
+	_, ok := c.get("b")
+	test.False(ok, "the least recently used entry is evicted")
+	_, ok = c.get("a")
+	test.True(ok)
+
+	c = newLRU(2, time.Nanosecond)
+	c.add("a", 1)
+	time.Sleep(time.Millisecond)
+	_, ok = c.get("a")
+	test.False(ok, "the expired entry isn't returned")
+}
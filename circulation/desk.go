@@ -0,0 +1,447 @@
+package circulation
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/twinj/uuid"
+)
+
+// LoanPeriod is how long the copy is lent when the due date isn't given
+const LoanPeriod = 14 * 24 * time.Hour
+
+var (
+	// ErrNotFound describe the author, copy, hold or loan which doesn't exist
+	ErrNotFound = errors.New("no such author, copy, hold or loan")
+	// ErrInvalid describe the entity without the required fields
+	ErrInvalid = errors.New("author needs a name, copy and hold need a book, hold and loan need a patron")
+	// ErrUnavailable describe the copy which is lent already or held for another patron
+	ErrUnavailable = errors.New("copy is on loan or held for another patron")
+	// ErrReturned describe the loan which is returned already
+	ErrReturned = errors.New("loan is returned already")
+)
+
+// Author wrote the books with given IDs
+type Author struct {
+	ID    string   `json:"id"`
+	Name  string   `json:"name"`
+	Books []string `json:"books"`
+}
+
+// Copy is a physical copy of the book which can be lent
+type Copy struct {
+	ID      string    `json:"id"`
+	BookID  string    `json:"book_id"`
+	Barcode string    `json:"barcode,omitempty"`
+	Added   time.Time `json:"added"`
+}
+
+// Hold is the place of the patron in the queue for the book
+type Hold struct {
+	ID     string    `json:"id"`
+	BookID string    `json:"book_id"`
+	Patron string    `json:"patron"`
+	Placed time.Time `json:"placed"`
+}
+
+// Loan is the copy lent to the patron, Returned is nil until the copy is back
+type Loan struct {
+	ID       string     `json:"id"`
+	CopyID   string     `json:"copy_id"`
+	BookID   string     `json:"book_id"`
+	Patron   string     `json:"patron"`
+	Borrowed time.Time  `json:"borrowed"`
+	Due      time.Time  `json:"due"`
+	Returned *time.Time `json:"returned,omitempty"`
+}
+
+// Active reports whether the copy isn't returned yet
+func (l Loan) Active() bool {
+	return l.Returned == nil
+}
+
+// Overdue reports whether the copy isn't returned after the due date
+func (l Loan) Overdue(now time.Time) bool {
+	return l.Active() && now.After(l.Due)
+}
+
+// state is what the desk keeps in the storage file
+type state struct {
+	Authors []Author `json:"authors"`
+	Copies  []Copy   `json:"copies"`
+	Holds   []Hold   `json:"holds"`
+	Loans   []Loan   `json:"loans"`
+}
+
+// Desk keeps the authors of the books and the circulation of their copies in the file.
+// The lookups take many book IDs at once, so the callers can load a page of books without a call per book.
+type Desk struct {
+	path string
+
+	mu    sync.RWMutex
+	state state
+}
+
+// NewDesk constructor for Desk struct, it reads the circulation from the given file
+func NewDesk(path string) (*Desk, error) {
+	d := &Desk{path: path}
+
+	file, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err = json.Unmarshal(file, &d.state); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// writeData saves the state, it has to be called with the lock held.
+// The file and the directory are synced, so the renamed file survives the crash of the machine.
+func (d *Desk) writeData() error {
+	path, err := filepath.Abs(d.path)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(d.state, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// update applies the change to the copy of the state and saves it, the state is kept when saving fails
+func (d *Desk) update(change func(s *state) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	previous := d.state
+	next := state{
+		Authors: append([]Author{}, previous.Authors...),
+		Copies:  append([]Copy{}, previous.Copies...),
+		Holds:   append([]Hold{}, previous.Holds...),
+		Loans:   append([]Loan{}, previous.Loans...),
+	}
+	if err := change(&next); err != nil {
+		return err
+	}
+	d.state = next
+	if err := d.writeData(); err != nil {
+		d.state = previous
+		return err
+	}
+	return nil
+}
+
+// AddAuthor adds the author of the books
+func (d *Desk) AddAuthor(author Author) (Author, error) {
+	author.Name = strings.TrimSpace(author.Name)
+	if author.Name == "" {
+		return Author{}, ErrInvalid
+	}
+	author.ID = uuid.NewV4().String()
+	author.Books = append([]string{}, author.Books...)
+
+	err := d.update(func(s *state) error {
+		s.Authors = append(s.Authors, author)
+		return nil
+	})
+	if err != nil {
+		return Author{}, err
+	}
+	return author, nil
+}
+
+// Authors returns all the authors ordered by the name
+func (d *Desk) Authors() []Author {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	authors := make([]Author, 0, len(d.state.Authors))
+	for _, author := range d.state.Authors {
+		author.Books = append([]string{}, author.Books...)
+		authors = append(authors, author)
+	}
+	sort.SliceStable(authors, func(i, j int) bool { return authors[i].Name < authors[j].Name })
+	return authors
+}
+
+// Author returns the author by ID
+func (d *Desk) Author(id string) (Author, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, author := range d.state.Authors {
+		if author.ID == id {
+			author.Books = append([]string{}, author.Books...)
+			return author, nil
+		}
+	}
+	return Author{}, ErrNotFound
+}
+
+// AuthorsOf returns the authors of the books by the book ID, the books without the author are left out
+func (d *Desk) AuthorsOf(bookIDs []string) map[string]Author {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	wanted := set(bookIDs)
+	authors := make(map[string]Author, len(bookIDs))
+	for _, author := range d.state.Authors {
+		for _, id := range author.Books {
+			if _, ok := authors[id]; !ok && wanted[id] {
+				author.Books = append([]string{}, author.Books...)
+				authors[id] = author
+			}
+		}
+	}
+	return authors
+}
+
+// AddCopy adds the copy of the book
+func (d *Desk) AddCopy(bookID, barcode string) (Copy, error) {
+	if bookID == "" {
+		return Copy{}, ErrInvalid
+	}
+	c := Copy{
+		ID:      uuid.NewV4().String(),
+		BookID:  bookID,
+		Barcode: strings.TrimSpace(barcode),
+		Added:   time.Now().UTC(),
+	}
+
+	err := d.update(func(s *state) error {
+		s.Copies = append(s.Copies, c)
+		return nil
+	})
+	if err != nil {
+		return Copy{}, err
+	}
+	return c, nil
+}
+
+// Copies returns the copies of the books by the book ID in the order they were added
+func (d *Desk) Copies(bookIDs []string) map[string][]Copy {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	wanted := set(bookIDs)
+	copies := make(map[string][]Copy, len(bookIDs))
+	for _, c := range d.state.Copies {
+		if wanted[c.BookID] {
+			copies[c.BookID] = append(copies[c.BookID], c)
+		}
+	}
+	return copies
+}
+
+// PlaceHold puts the patron in the queue for the book
+func (d *Desk) PlaceHold(bookID, patron string) (Hold, error) {
+	patron = strings.TrimSpace(patron)
+	if bookID == "" || patron == "" {
+		return Hold{}, ErrInvalid
+	}
+	hold := Hold{
+		ID:     uuid.NewV4().String(),
+		BookID: bookID,
+		Patron: patron,
+		Placed: time.Now().UTC(),
+	}
+
+	err := d.update(func(s *state) error {
+		s.Holds = append(s.Holds, hold)
+		return nil
+	})
+	if err != nil {
+		return Hold{}, err
+	}
+	return hold, nil
+}
+
+// CancelHold removes the patron from the queue
+func (d *Desk) CancelHold(id string) error {
+	return d.update(func(s *state) error {
+		for i, hold := range s.Holds {
+			if hold.ID == id {
+				s.Holds = append(s.Holds[:i], s.Holds[i+1:]...)
+				return nil
+			}
+		}
+		return ErrNotFound
+	})
+}
+
+// Holds returns the queues for the books by the book ID, the first hold was placed first
+func (d *Desk) Holds(bookIDs []string) map[string][]Hold {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	wanted := set(bookIDs)
+	holds := make(map[string][]Hold, len(bookIDs))
+	for _, hold := range d.state.Holds {
+		if wanted[hold.BookID] {
+			holds[hold.BookID] = append(holds[hold.BookID], hold)
+		}
+	}
+	return holds
+}
+
+// Checkout lends the copy to the patron until the due date, it's LoanPeriod from now when due is zero.
+// The copy can't be lent while it's on loan or while another patron is first in the queue for the book,
+// the hold of the patron is fulfilled by the loan.
+func (d *Desk) Checkout(copyID, patron string, due time.Time) (Loan, error) {
+	patron = strings.TrimSpace(patron)
+	if patron == "" {
+		return Loan{}, ErrInvalid
+	}
+	now := time.Now().UTC()
+	if due.IsZero() {
+		due = now.Add(LoanPeriod)
+	}
+
+	var loan Loan
+	err := d.update(func(s *state) error {
+		var bookID string
+		for _, c := range s.Copies {
+			if c.ID == copyID {
+				bookID = c.BookID
+			}
+		}
+		if bookID == "" {
+			return ErrNotFound
+		}
+		for _, l := range s.Loans {
+			if l.CopyID == copyID && l.Active() {
+				return ErrUnavailable
+			}
+		}
+
+		held := -1
+		for i, hold := range s.Holds {
+			if hold.BookID != bookID {
+				continue
+			}
+			if hold.Patron != patron {
+				return ErrUnavailable
+			}
+			held = i
+			break
+		}
+		if held >= 0 {
+			s.Holds = append(s.Holds[:held], s.Holds[held+1:]...)
+		}
+
+		loan = Loan{
+			ID:       uuid.NewV4().String(),
+			CopyID:   copyID,
+			BookID:   bookID,
+			Patron:   patron,
+			Borrowed: now,
+			Due:      due.UTC(),
+		}
+		s.Loans = append(s.Loans, loan)
+		return nil
+	})
+	if err != nil {
+		return Loan{}, err
+	}
+	return loan, nil
+}
+
+// Return takes the copy back from the patron
+func (d *Desk) Return(loanID string) (Loan, error) {
+	var loan Loan
+	err := d.update(func(s *state) error {
+		for i, l := range s.Loans {
+			if l.ID != loanID {
+				continue
+			}
+			if !l.Active() {
+				return ErrReturned
+			}
+			returned := time.Now().UTC()
+			l.Returned = &returned
+			s.Loans[i], loan = l, l
+			return nil
+		}
+		return ErrNotFound
+	})
+	if err != nil {
+		return Loan{}, err
+	}
+	return loan, nil
+}
+
+// Loans returns the loans of the books by the book ID in the order they were made
+func (d *Desk) Loans(bookIDs []string) map[string][]Loan {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	wanted := set(bookIDs)
+	loans := make(map[string][]Loan, len(bookIDs))
+	for _, loan := range d.state.Loans {
+		if wanted[loan.BookID] {
+			loans[loan.BookID] = append(loans[loan.BookID], loan)
+		}
+	}
+	return loans
+}
+
+// LoanCounts returns the number of the active loans and the number of the overdue ones at the time
+func (d *Desk) LoanCounts(now time.Time) (active, overdue int) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, loan := range d.state.Loans {
+		if loan.Active() {
+			active++
+		}
+		if loan.Overdue(now) {
+			overdue++
+		}
+	}
+	return active, overdue
+}
+
+func set(ids []string) map[string]bool {
+	s := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		s[id] = true
+	}
+	return s
+}
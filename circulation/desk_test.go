@@ -0,0 +1,104 @@
+package circulation
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDesk(t *testing.T) (*Desk, string) {
+	dir, err := ioutil.TempDir("", "circulation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "circulation.json")
+	desk, err := NewDesk(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return desk, path
+}
+
+func TestDeskAuthors(t *testing.T) {
+	test := assert.New(t)
+	desk, path := newTestDesk(t)
+
+	_, err := desk.AddAuthor(Author{Name: " "})
+	test.Equal(ErrInvalid, err)
+
+	tolkien, err := desk.AddAuthor(Author{Name: "J. R. R. Tolkien", Books: []string{"hobbit", "silmarillion"}})
+	test.NoError(err)
+	orwell, err := desk.AddAuthor(Author{Name: "George Orwell", Books: []string{"1984"}})
+	test.NoError(err)
+
+	authors := desk.AuthorsOf([]string{"hobbit", "1984", "unknown"})
+	test.Len(authors, 2)
+	test.Equal(tolkien.ID, authors["hobbit"].ID)
+	test.Equal(orwell.ID, authors["1984"].ID)
+
+	// the authors are read back from the file
+	reopened, err := NewDesk(path)
+	test.NoError(err)
+	test.Equal([]Author{orwell, tolkien}, reopened.Authors())
+	author, err := reopened.Author(tolkien.ID)
+	test.NoError(err)
+	test.Equal(tolkien, author)
+	_, err = reopened.Author("unknown")
+	test.Equal(ErrNotFound, err)
+}
+
+func TestDeskCirculation(t *testing.T) {
+	test := assert.New(t)
+	desk, path := newTestDesk(t)
+
+	first, err := desk.AddCopy("hobbit", "0001")
+	test.NoError(err)
+	second, err := desk.AddCopy("hobbit", "0002")
+	test.NoError(err)
+	test.Equal(map[string][]Copy{"hobbit": {first, second}}, desk.Copies([]string{"hobbit", "1984"}))
+
+	hold, err := desk.PlaceHold("hobbit", "alice")
+	test.NoError(err)
+
+	// the copy is held for alice, so bob has to wait
+	_, err = desk.Checkout(first.ID, "bob", time.Time{})
+	test.Equal(ErrUnavailable, err)
+	_, err = desk.Checkout("unknown", "alice", time.Time{})
+	test.Equal(ErrNotFound, err)
+
+	loan, err := desk.Checkout(first.ID, "alice", time.Time{})
+	test.NoError(err)
+	test.Equal("hobbit", loan.BookID)
+	test.WithinDuration(time.Now().Add(LoanPeriod), loan.Due, time.Minute)
+	test.Empty(desk.Holds([]string{"hobbit"}), "the hold is fulfilled by the loan")
+	test.Equal(ErrNotFound, desk.CancelHold(hold.ID))
+
+	_, err = desk.Checkout(first.ID, "bob", time.Time{})
+	test.Equal(ErrUnavailable, err, "the copy is on loan")
+	late, err := desk.Checkout(second.ID, "bob", time.Now().Add(-time.Hour))
+	test.NoError(err)
+
+	active, overdue := desk.LoanCounts(time.Now())
+	test.Equal(2, active)
+	test.Equal(1, overdue)
+
+	returned, err := desk.Return(late.ID)
+	test.NoError(err)
+	test.False(returned.Active())
+	_, err = desk.Return(late.ID)
+	test.Equal(ErrReturned, err)
+
+	// the loans are read back from the file
+	reopened, err := NewDesk(path)
+	test.NoError(err)
+	active, overdue = reopened.LoanCounts(time.Now())
+	test.Equal(1, active)
+	test.Equal(0, overdue)
+	test.Len(reopened.Loans([]string{"hobbit"})["hobbit"], 2)
+}
@@ -0,0 +1,404 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backends of the storage
+const (
+	BackendJSON = "json"
+	BackendSQL  = "sql"
+)
+
+// Roles which can be given to the API tokens, they match the roles of the web package
+var roles = []string{"reader", "editor", "admin"}
+
+// StorageMiddlewares are the names of the storage wrappers which can be stacked
+var StorageMiddlewares = []string{"validation", "audit", "metrics", "tracing", "cache"}
+
+// Config describes the whole configuration of the server.
+// It's built from the defaults, the file, the LIBRARY_* environment variables and the flags, the later wins.
+type Config struct {
+	Storage     Storage     `yaml:"storage"`
+	Server      Server      `yaml:"server"`
+	Auth        Auth        `yaml:"auth"`
+	CORS        CORS        `yaml:"cors"`
+	Limits      Limits      `yaml:"limits"`
+	Logging     Logging     `yaml:"logging"`
+	Cache       Cache       `yaml:"cache"`
+	Replication Replication `yaml:"replication"`
+	Webhooks    Webhooks    `yaml:"webhooks"`
+	Rates       Rates       `yaml:"rates"`
+	Circulation Circulation `yaml:"circulation"`
+	Tracing     Tracing     `yaml:"tracing"`
+}
+
+// Storage describes the backend of the catalog and the wrappers around it
+type Storage struct {
+	Backend string `yaml:"backend"`
+	// Path is the file of the json backend
+	Path string `yaml:"path"`
+	// DSN is the data source name of the sql backend
+	DSN        string   `yaml:"dsn"`
+	Middleware []string `yaml:"middleware"`
+	// CompactAfter is the number of the journal records of the json backend which are written into its files at once
+	CompactAfter int `yaml:"compact_after"`
+}
+
+// Server describes the listeners of the API
+type Server struct {
+	Listen            []string      `yaml:"listen"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	// WriteTimeout is 0 by default, so the event streams stay open
+	WriteTimeout    time.Duration `yaml:"write_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	TLS             TLS           `yaml:"tls"`
+}
+
+// TLS describes the certificates of the listeners, the listeners serve plain HTTP without them
+type TLS struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ClientCAFile verifies the client certificates
+	ClientCAFile string `yaml:"client_ca_file"`
+	// ClientAuth is none, optional or require
+	ClientAuth string `yaml:"client_auth"`
+	// ReloadInterval is how often the files are checked for the rotated certificates
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+	// RedirectListen are the plain HTTP addresses redirecting to the HTTPS listeners
+	RedirectListen []string `yaml:"redirect_listen"`
+}
+
+// Enabled reports whether the listeners serve HTTPS
+func (t TLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// Auth describes the API clients, the API is open when there are no tokens
+type Auth struct {
+	// Tokens maps the bearer tokens to the roles
+	Tokens map[string]string `yaml:"tokens"`
+	// ClientRoles maps the subjects of the client certificates to the roles,
+	// the subject is the common name or the whole distinguished name
+	ClientRoles map[string]string `yaml:"client_roles"`
+}
+
+// CORS describes which browser front-ends may call the API
+type CORS struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins"`
+	AllowedMethods   []string      `yaml:"allowed_methods"`
+	AllowedHeaders   []string      `yaml:"allowed_headers"`
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+// Limits describes the bounds of the requests and the kept state
+type Limits struct {
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+	// RequestTimeout is the deadline of the routes which don't have their own
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	EventLogSize   int           `yaml:"event_log_size"`
+	// IdempotencyRetention is how long the responses are replayed for the retried POST requests
+	IdempotencyRetention time.Duration `yaml:"idempotency_retention"`
+}
+
+// Logging describes where the log is written
+type Logging struct {
+	// Output is stderr, stdout or the path of the file the log is appended to
+	Output string `yaml:"output"`
+	UTC    bool   `yaml:"utc"`
+}
+
+// Cache describes the cache storage wrapper
+type Cache struct {
+	Size int           `yaml:"size"`
+	TTL  time.Duration `yaml:"ttl"`
+}
+
+// Replication describes the peers the catalog is pulled from
+type Replication struct {
+	Node     string        `yaml:"node"`
+	Peers    []string      `yaml:"peers"`
+	Interval time.Duration `yaml:"interval"`
+	// Token is sent to the peers which require authentication
+	Token string `yaml:"token"`
+	// Path is the file the sync tokens of the peers are kept in
+	Path string `yaml:"path"`
+}
+
+// Webhooks describes the webhook subscriptions
+type Webhooks struct {
+	Path string `yaml:"path"`
+}
+
+// Rates describes the exchange-rate table the prices are converted at
+type Rates struct {
+	Path string `yaml:"path"`
+}
+
+// Circulation describes the file of the authors, copies, holds and loans
+type Circulation struct {
+	Path string `yaml:"path"`
+}
+
+// Tracing describes where the spans are exported
+type Tracing struct {
+	Exporter string `yaml:"exporter"`
+	Endpoint string `yaml:"endpoint"`
+}
+
+// Default returns the configuration used when nothing is set
+func Default() *Config {
+	return &Config{
+		Storage: Storage{
+			Backend:      BackendJSON,
+			Path:         "storage/storage.json",
+			DSN:          "storage/data.db",
+			Middleware:   []string{"validation", "metrics", "tracing"},
+			CompactAfter: 100,
+		},
+		Server: Server{
+			Listen:            []string{"0.0.0.0:8000"},
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+			TLS: TLS{
+				ClientAuth:     "none",
+				ReloadInterval: time.Minute,
+			},
+		},
+		Auth: Auth{
+			Tokens:      map[string]string{},
+			ClientRoles: map[string]string{},
+		},
+		CORS: CORS{
+			AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+			AllowedHeaders: []string{"Content-Type", "Authorization", "If-None-Match", "Last-Event-ID", "Idempotency-Key"},
+			MaxAge:         10 * time.Minute,
+		},
+		Limits: Limits{
+			MaxBodyBytes:         1 << 20,
+			RequestTimeout:       10 * time.Second,
+			EventLogSize:         1000,
+			IdempotencyRetention: 24 * time.Hour,
+		},
+		Logging: Logging{Output: "stderr"},
+		Cache: Cache{
+			Size: 1000,
+			TTL:  time.Minute,
+		},
+		Replication: Replication{Interval: 10 * time.Second, Path: "storage/replication.json"},
+		Webhooks:    Webhooks{Path: "storage/webhooks.json"},
+		Rates:       Rates{Path: "storage/rates.json"},
+		Circulation: Circulation{Path: "storage/circulation.json"},
+		Tracing: Tracing{
+			Exporter: "none",
+			Endpoint: "localhost:4318",
+		},
+	}
+}
+
+// Validate returns all the problems of the configuration at once
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	switch c.Storage.Backend {
+	case BackendJSON:
+		if c.Storage.Path == "" {
+			fail("storage.path is required by the json backend")
+		}
+		if c.Storage.CompactAfter <= 0 {
+			fail("storage.compact_after must be positive")
+		}
+	case BackendSQL:
+		if c.Storage.DSN == "" {
+			fail("storage.dsn is required by the sql backend")
+		}
+	default:
+		fail("storage.backend %q isn't json or sql", c.Storage.Backend)
+	}
+	for _, name := range c.Storage.Middleware {
+		if !oneOf(name, StorageMiddlewares) {
+			fail("storage.middleware %q isn't one of %s", name, strings.Join(StorageMiddlewares, ", "))
+		}
+	}
+
+	if len(c.Server.Listen) == 0 {
+		fail("server.listen needs at least one address")
+	}
+	for _, addr := range c.Server.Listen {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			fail("server.listen %q: %v", addr, err)
+		}
+	}
+	durations := map[string]time.Duration{
+		"server.read_header_timeout":   c.Server.ReadHeaderTimeout,
+		"server.read_timeout":          c.Server.ReadTimeout,
+		"server.write_timeout":         c.Server.WriteTimeout,
+		"server.idle_timeout":          c.Server.IdleTimeout,
+		"server.shutdown_timeout":      c.Server.ShutdownTimeout,
+		"server.tls.reload_interval":   c.Server.TLS.ReloadInterval,
+		"cors.max_age":                 c.CORS.MaxAge,
+		"limits.request_timeout":       c.Limits.RequestTimeout,
+		"limits.idempotency_retention": c.Limits.IdempotencyRetention,
+		"cache.ttl":                    c.Cache.TTL,
+	}
+	for key, d := range durations {
+		if d < 0 {
+			fail("%s can't be negative", key)
+		}
+	}
+
+	tls := c.Server.TLS
+	if tls.CertFile != "" && tls.KeyFile == "" || tls.CertFile == "" && tls.KeyFile != "" {
+		fail("server.tls.cert_file and server.tls.key_file must be set together")
+	}
+	switch tls.ClientAuth {
+	case "none":
+	case "optional", "require":
+		if tls.ClientCAFile == "" {
+			fail("server.tls.client_ca_file is required by server.tls.client_auth %s", tls.ClientAuth)
+		}
+		if !tls.Enabled() {
+			fail("server.tls.client_auth %s needs server.tls.cert_file", tls.ClientAuth)
+		}
+	default:
+		fail("server.tls.client_auth %q isn't none, optional or require", tls.ClientAuth)
+	}
+	if tls.Enabled() && tls.ReloadInterval <= 0 {
+		fail("server.tls.reload_interval must be positive")
+	}
+	if len(tls.RedirectListen) > 0 && !tls.Enabled() {
+		fail("server.tls.redirect_listen needs server.tls.cert_file")
+	}
+	for _, addr := range tls.RedirectListen {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			fail("server.tls.redirect_listen %q: %v", addr, err)
+		}
+	}
+
+	for token, role := range c.Auth.Tokens {
+		if token == "" {
+			fail("auth.tokens can't contain an empty token")
+		}
+		if !oneOf(role, roles) {
+			fail("auth.tokens role %q isn't one of %s", role, strings.Join(roles, ", "))
+		}
+	}
+
+	for subject, role := range c.Auth.ClientRoles {
+		if subject == "" {
+			fail("auth.client_roles can't contain an empty subject")
+		}
+		if !oneOf(role, roles) {
+			fail("auth.client_roles role %q isn't one of %s", role, strings.Join(roles, ", "))
+		}
+	}
+	if len(c.Auth.ClientRoles) > 0 && tls.ClientAuth == "none" {
+		fail("auth.client_roles needs server.tls.client_auth optional or require")
+	}
+
+	for _, origin := range c.CORS.AllowedOrigins {
+		if origin == "*" {
+			if c.CORS.AllowCredentials {
+				fail("cors.allowed_origins can't be * when cors.allow_credentials is set")
+			}
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			fail("cors.allowed_origins %q isn't scheme://host[:port]", origin)
+		}
+	}
+
+	if c.Limits.MaxBodyBytes < 0 {
+		fail("limits.max_body_bytes can't be negative")
+	}
+	if c.Limits.EventLogSize <= 0 {
+		fail("limits.event_log_size must be positive")
+	}
+	if c.Logging.Output == "" {
+		fail("logging.output is required")
+	}
+	if oneOf("cache", c.Storage.Middleware) && c.Cache.Size <= 0 {
+		fail("cache.size must be positive when the cache is used")
+	}
+
+	if c.Replication.Interval <= 0 {
+		fail("replication.interval must be positive")
+	}
+	for _, peer := range c.Replication.Peers {
+		if u, err := url.Parse(peer); err != nil || u.Scheme == "" || u.Host == "" {
+			fail("replication.peers %q isn't a base URL", peer)
+		}
+	}
+	if c.Replication.Path == "" {
+		fail("replication.path is required")
+	}
+	if c.Webhooks.Path == "" {
+		fail("webhooks.path is required")
+	}
+	if c.Rates.Path == "" {
+		fail("rates.path is required")
+	}
+	if c.Circulation.Path == "" {
+		fail("circulation.path is required")
+	}
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		if c.Tracing.Endpoint == "" {
+			fail("tracing.endpoint is required by the otlp exporter")
+		}
+	default:
+		fail("tracing.exporter %q isn't none, stdout or otlp", c.Tracing.Exporter)
+	}
+
+	return errors.Join(errs...)
+}
+
+func oneOf(value string, values []string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	dsnPassword = regexp.MustCompile(`(password=)[^ &;]+`)
+	urlPassword = regexp.MustCompile(`(://[^:/@]+:)[^@]+@`)
+)
+
+// Redacted returns the copy of the configuration which is safe to print
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	redacted.Storage.DSN = dsnPassword.ReplaceAllString(c.Storage.DSN, "${1}REDACTED")
+	redacted.Storage.DSN = urlPassword.ReplaceAllString(redacted.Storage.DSN, "${1}REDACTED@")
+	tokens := make([]string, 0, len(c.Auth.Tokens))
+	for token := range c.Auth.Tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	redacted.Auth.Tokens = map[string]string{}
+	for i, token := range tokens {
+		redacted.Auth.Tokens[fmt.Sprintf("REDACTED-%d", i+1)] = c.Auth.Tokens[token]
+	}
+	if c.Replication.Token != "" {
+		redacted.Replication.Token = "REDACTED"
+	}
+	return &redacted
+}
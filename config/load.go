@@ -0,0 +1,287 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the prefix of the environment variables, the rest is the key of the setting
+// in upper case with dots replaced by underscores, e.g. LIBRARY_STORAGE_BACKEND
+const envPrefix = "LIBRARY_"
+
+// setting binds the field of the configuration to its flag and environment variable
+type setting struct {
+	key   string
+	flag  string
+	usage string
+	field func(*Config) interface{}
+}
+
+// settings lists everything which can be overridden by the environment and the flags.
+// Flag names of the older versions are kept, so the existing deployments keep working.
+var settings = []setting{
+	{"storage.backend", "backend", "storage backend: json or sql", func(c *Config) interface{} { return &c.Storage.Backend }},
+	{"storage.path", "libPath", "path of the json storage file", func(c *Config) interface{} { return &c.Storage.Path }},
+	{"storage.dsn", "dsn", "data source name of the sql storage", func(c *Config) interface{} { return &c.Storage.DSN }},
+	{"storage.compact_after", "compactAfter", "number of the journal records after which the json storage is compacted", func(c *Config) interface{} { return &c.Storage.CompactAfter }},
+	{"storage.middleware", "storageMiddleware", "comma separated storage wrappers from the outermost one: " + strings.Join(StorageMiddlewares, ", "), func(c *Config) interface{} { return &c.Storage.Middleware }},
+
+	{"server.listen", "listen", "comma separated addresses the server listens on", func(c *Config) interface{} { return &c.Server.Listen }},
+	{"server.read_header_timeout", "readHeaderTimeout", "how long reading of the request headers may take", func(c *Config) interface{} { return &c.Server.ReadHeaderTimeout }},
+	{"server.read_timeout", "readTimeout", "how long reading of the whole request may take", func(c *Config) interface{} { return &c.Server.ReadTimeout }},
+	{"server.write_timeout", "writeTimeout", "how long writing of the response may take, 0 keeps the event streams open", func(c *Config) interface{} { return &c.Server.WriteTimeout }},
+	{"server.idle_timeout", "idleTimeout", "how long the idle keep-alive connection is kept", func(c *Config) interface{} { return &c.Server.IdleTimeout }},
+	{"server.shutdown_timeout", "shutdownTimeout", "how long the in-flight requests are drained on shutdown", func(c *Config) interface{} { return &c.Server.ShutdownTimeout }},
+
+	{"server.tls.cert_file", "tlsCert", "certificate file of the HTTPS listeners, plain HTTP without it", func(c *Config) interface{} { return &c.Server.TLS.CertFile }},
+	{"server.tls.key_file", "tlsKey", "private key file of the certificate", func(c *Config) interface{} { return &c.Server.TLS.KeyFile }},
+	{"server.tls.client_ca_file", "tlsClientCA", "CA file verifying the client certificates", func(c *Config) interface{} { return &c.Server.TLS.ClientCAFile }},
+	{"server.tls.client_auth", "tlsClientAuth", "client certificates: none, optional or require", func(c *Config) interface{} { return &c.Server.TLS.ClientAuth }},
+	{"server.tls.reload_interval", "tlsReloadInterval", "how often the certificate files are checked for changes", func(c *Config) interface{} { return &c.Server.TLS.ReloadInterval }},
+	{"server.tls.redirect_listen", "redirectListen", "comma separated plain HTTP addresses redirecting to HTTPS", func(c *Config) interface{} { return &c.Server.TLS.RedirectListen }},
+
+	{"auth.tokens", "authTokens", "comma separated token:role pairs of the API clients, roles are reader, editor and admin", func(c *Config) interface{} { return &c.Auth.Tokens }},
+	{"auth.client_roles", "authClientRoles", "comma separated common-name:role pairs of the client certificates", func(c *Config) interface{} { return &c.Auth.ClientRoles }},
+
+	{"cors.allowed_origins", "corsOrigins", "comma separated origins of the browser front-ends", func(c *Config) interface{} { return &c.CORS.AllowedOrigins }},
+	{"cors.allowed_methods", "corsMethods", "comma separated methods the front-ends may use", func(c *Config) interface{} { return &c.CORS.AllowedMethods }},
+	{"cors.allowed_headers", "corsHeaders", "comma separated headers the front-ends may send", func(c *Config) interface{} { return &c.CORS.AllowedHeaders }},
+	{"cors.allow_credentials", "corsCredentials", "let the front-ends send credentials", func(c *Config) interface{} { return &c.CORS.AllowCredentials }},
+	{"cors.max_age", "corsMaxAge", "how long the browsers cache the preflight response", func(c *Config) interface{} { return &c.CORS.MaxAge }},
+
+	{"limits.max_body_bytes", "maxBodyBytes", "largest accepted request body, 0 means no limit", func(c *Config) interface{} { return &c.Limits.MaxBodyBytes }},
+	{"limits.request_timeout", "requestTimeout", "deadline of the routes which don't have their own", func(c *Config) interface{} { return &c.Limits.RequestTimeout }},
+	{"limits.event_log_size", "eventLogSize", "number of events kept for resuming the event stream", func(c *Config) interface{} { return &c.Limits.EventLogSize }},
+	{"limits.idempotency_retention", "idempotencyRetention", "how long the responses are replayed for the POST requests retried with the same Idempotency-Key, 0 disables it", func(c *Config) interface{} { return &c.Limits.IdempotencyRetention }},
+
+	{"logging.output", "logOutput", "where the log is written: stderr, stdout or a file path", func(c *Config) interface{} { return &c.Logging.Output }},
+	{"logging.utc", "logUTC", "write the log times in UTC", func(c *Config) interface{} { return &c.Logging.UTC }},
+
+	{"cache.size", "cacheSize", "number of books and filter results kept in the cache", func(c *Config) interface{} { return &c.Cache.Size }},
+	{"cache.ttl", "cacheTTL", "how long the cached books and filter results are kept", func(c *Config) interface{} { return &c.Cache.TTL }},
+
+	{"replication.node", "node", "name of this instance for the replication, host name by default", func(c *Config) interface{} { return &c.Replication.Node }},
+	{"replication.peers", "peers", "comma separated base URLs of the instances to replicate from", func(c *Config) interface{} { return &c.Replication.Peers }},
+	{"replication.interval", "replicationInterval", "how often the peers are pulled", func(c *Config) interface{} { return &c.Replication.Interval }},
+	{"replication.token", "replicationToken", "token sent to the peers", func(c *Config) interface{} { return &c.Replication.Token }},
+	{"replication.path", "replicationPath", "path of the file the sync tokens of the peers are kept in", func(c *Config) interface{} { return &c.Replication.Path }},
+
+	{"webhooks.path", "webhooksPath", "path of the webhooks file", func(c *Config) interface{} { return &c.Webhooks.Path }},
+
+	{"rates.path", "ratesPath", "path of the exchange rates file", func(c *Config) interface{} { return &c.Rates.Path }},
+	{"circulation.path", "circulationPath", "path of the authors, copies, holds and loans file", func(c *Config) interface{} { return &c.Circulation.Path }},
+
+	{"tracing.exporter", "traceExporter", "where the spans are exported: none, stdout or otlp", func(c *Config) interface{} { return &c.Tracing.Exporter }},
+	{"tracing.endpoint", "otlpEndpoint", "host:port of the OTLP/HTTP collector", func(c *Config) interface{} { return &c.Tracing.Endpoint }},
+}
+
+// envName returns the environment variable of the setting,
+// e.g. LIBRARY_SERVER_READ_HEADER_TIMEOUT for server.read_header_timeout
+func (s setting) envName() string {
+	return envPrefix + strings.ToUpper(strings.Replace(s.key, ".", "_", -1))
+}
+
+// flagValue keeps the raw value of the flag, it's applied after the file and the environment
+type flagValue struct {
+	def string
+	raw string
+}
+
+func (v *flagValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return v.def
+}
+
+func (v *flagValue) Set(raw string) error {
+	v.raw = raw
+	return nil
+}
+
+// boolFlag lets the bool settings be set without value like the standard flags
+type boolFlag struct {
+	flagValue
+}
+
+func (v *boolFlag) IsBoolFlag() bool { return true }
+
+// Load builds the configuration from the defaults, the file given by -config or LIBRARY_CONFIG,
+// the environment and the flags in args, the later wins. The result is validated.
+// lookupEnv is os.LookupEnv outside of the tests.
+func Load(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("library", flag.ContinueOnError)
+	path := fs.String("config", "", "path of the YAML config file, LIBRARY_CONFIG by default")
+	useSql := fs.Bool("useSql", false, "deprecated, use -backend=sql")
+	values := map[string]*flagValue{}
+	for _, s := range settings {
+		def := format(s.field(cfg))
+		if _, ok := s.field(cfg).(*bool); ok {
+			value := &boolFlag{flagValue{def: def}}
+			fs.Var(value, s.flag, s.usage)
+			values[s.flag] = &value.flagValue
+			continue
+		}
+		value := &flagValue{def: def}
+		fs.Var(value, s.flag, s.usage)
+		values[s.flag] = value
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path == "" {
+		*path, _ = lookupEnv(envPrefix + "CONFIG")
+	}
+	if *path != "" {
+		if err := loadFile(cfg, *path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		raw, ok := lookupEnv(s.envName())
+		if !ok {
+			continue
+		}
+		if err := parse(s.field(cfg), raw); err != nil {
+			return nil, fmt.Errorf("%s: %v", s.envName(), err)
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "useSql" && *useSql {
+			cfg.Storage.Backend = BackendSQL
+		}
+		value, ok := values[f.Name]
+		if !ok || err != nil {
+			return
+		}
+		for _, s := range settings {
+			if s.flag == f.Name {
+				if e := parse(s.field(cfg), value.raw); e != nil {
+					err = fmt.Errorf("-%s: %v", f.Name, e)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile overrides the configuration by the YAML file, unknown keys are errors,
+// so the typos don't get silently ignored
+func loadFile(cfg *Config, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err = decoder.Decode(cfg); err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// parse sets the field from the string form used by the flags and the environment
+func parse(field interface{}, raw string) error {
+	var err error
+	switch field := field.(type) {
+	case *string:
+		*field = raw
+	case *bool:
+		*field, err = strconv.ParseBool(raw)
+	case *int:
+		*field, err = strconv.Atoi(raw)
+	case *int64:
+		*field, err = strconv.ParseInt(raw, 10, 64)
+	case *time.Duration:
+		*field, err = time.ParseDuration(raw)
+	case *[]string:
+		*field = split(raw)
+	case *map[string]string:
+		pairs := map[string]string{}
+		// the distinguished names are comma separated as well, their attributes go on in the next value
+		var attributes []string
+		for _, pair := range split(raw) {
+			i := strings.LastIndex(pair, ":")
+			if i < 0 && strings.Contains(pair, "=") {
+				attributes = append(attributes, pair)
+				continue
+			}
+			if i < 0 {
+				return fmt.Errorf("%q isn't key:value", pair)
+			}
+			key := strings.Join(append(attributes, strings.TrimSpace(pair[:i])), ",")
+			pairs[key] = strings.TrimSpace(pair[i+1:])
+			attributes = nil
+		}
+		if len(attributes) > 0 {
+			return fmt.Errorf("%q isn't key:value", strings.Join(attributes, ","))
+		}
+		*field = pairs
+	default:
+		return fmt.Errorf("unsupported setting type %T", field)
+	}
+	return err
+}
+
+// format returns the string form of the field, it's shown as the default of the flag
+func format(field interface{}) string {
+	switch field := field.(type) {
+	case *string:
+		return *field
+	case *bool:
+		return strconv.FormatBool(*field)
+	case *int:
+		return strconv.Itoa(*field)
+	case *int64:
+		return strconv.FormatInt(*field, 10)
+	case *time.Duration:
+		return field.String()
+	case *[]string:
+		return strings.Join(*field, ",")
+	}
+	return ""
+}
+
+// split splits the comma separated list, spaces around the values are ignored,
+// the spaces inside of them are kept
+func split(raw string) []string {
+	var values []string
+	for _, value := range strings.Split(raw, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// Print writes the configuration as YAML with the secrets redacted
+func (c *Config) Print(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c.Redacted()); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
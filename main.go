@@ -1,26 +1,295 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
-
-	"flag"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/ssOlexBaiko/library/api/web"
+	"github.com/ssOlexBaiko/library/cache"
+	"github.com/ssOlexBaiko/library/circulation"
+	"github.com/ssOlexBaiko/library/config"
+	"github.com/ssOlexBaiko/library/middleware"
+	"github.com/ssOlexBaiko/library/rates"
+	"github.com/ssOlexBaiko/library/replication"
 	"github.com/ssOlexBaiko/library/storage"
+	"github.com/ssOlexBaiko/library/tlsconfig"
+	"github.com/ssOlexBaiko/library/tracing"
+	"github.com/ssOlexBaiko/library/webhook"
 )
 
-var libPath = flag.String("libPath", "storage/storage.json", "set path the storage file")
-var useSql = flag.Bool("useSql", false, "use sql db instead of json file")
-
 func main() {
-	flag.Parse()
+	args := os.Args[1:]
+	if len(args) >= 2 && args[0] == "config" && args[1] == "print" {
+		cfg, err := config.Load(args[2:], os.LookupEnv)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = cfg.Print(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg, err := config.Load(args, os.LookupEnv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(serve(cfg))
+}
+
+// setupLogging directs the standard log as the configuration says
+func setupLogging(cfg config.Logging) error {
+	flags := log.LstdFlags
+	if cfg.UTC {
+		flags |= log.LUTC
+	}
+	log.SetFlags(flags)
+
+	switch cfg.Output {
+	case "stderr":
+		log.SetOutput(os.Stderr)
+	case "stdout":
+		log.SetOutput(os.Stdout)
+	default:
+		file, err := os.OpenFile(cfg.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(file)
+	}
+	return nil
+}
+
+// serve runs the server till the signal and returns the exit code
+func serve(cfg *config.Config) int {
+	if err := setupLogging(cfg.Logging); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing.Exporter, cfg.Tracing.Endpoint)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	var (
+		certs     *tlsconfig.Reloader
+		tlsConfig *tls.Config
+	)
+	if cfg.Server.TLS.Enabled() {
+		certs, err = tlsconfig.NewReloader(cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile, cfg.Server.TLS.ClientCAFile)
+		if err == nil {
+			tlsConfig, err = certs.TLSConfig(cfg.Server.TLS.ClientAuth)
+		}
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		certs.Start(cfg.Server.TLS.ReloadInterval)
+	}
+
+	library := storage.NewLibrary(cfg.Storage.Path, cfg.Storage.Backend == config.BackendSQL)
+	library.SetDSN(cfg.Storage.DSN)
+	library.SetCompaction(cfg.Storage.CompactAfter)
+	// the journal left by the crashed process is replayed before the first request
+	if err = library.Recover(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if cfg.Replication.Node != "" {
+		library.SetNode(cfg.Replication.Node)
+	}
+
+	exchangeRates, err := rates.NewTable(cfg.Rates.Path)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	library.SetConverter(exchangeRates)
+
+	desk, err := circulation.NewDesk(cfg.Circulation.Path)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	webhooks, err := webhook.NewDispatcher(library, cfg.Webhooks.Path)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	events := web.NewEventStream(cfg.Limits.EventLogSize)
+	library.OnChange(events.Publish)
+
+	replicator, err := replication.NewReplicator(library, cfg.Replication.Peers, cfg.Replication.Interval, cfg.Replication.Path)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	replicator.SetToken(cfg.Replication.Token)
+
+	middlewares, err := storageMiddlewares(cfg.Storage.Middleware, cfg.Cache, library.OnChange, exchangeRates.OnChange)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	store := web.ChainStorage(library, middlewares...)
+	// the listeners are registered by now, so the deliveries and the replicated changes can start
+	webhooks.Start()
+	replicator.Start()
 
 	router := web.NewRouter(
 		web.NewHandler(
-			storage.NewLibrary(*libPath, *useSql),
+			store,
+			web.WithWebhooks(webhooks),
+			web.WithRates(exchangeRates),
+			web.WithCirculation(desk),
+			web.WithEventStream(events),
+			web.WithReplication(replicator),
+			web.WithAuth(cfg.Auth.Tokens),
+			web.WithClientRoles(cfg.Auth.ClientRoles),
+			web.WithCORS(web.CORSOptions{
+				AllowedOrigins:   cfg.CORS.AllowedOrigins,
+				AllowedMethods:   cfg.CORS.AllowedMethods,
+				AllowedHeaders:   cfg.CORS.AllowedHeaders,
+				AllowCredentials: cfg.CORS.AllowCredentials,
+				MaxAge:           cfg.CORS.MaxAge,
+			}),
+			web.WithMaxBodyBytes(cfg.Limits.MaxBodyBytes),
+			web.WithDefaultTimeout(cfg.Limits.RequestTimeout),
+			web.WithIdempotencyRetention(cfg.Limits.IdempotencyRetention),
 		),
 	)
 
-	log.Fatal(http.ListenAndServe("0.0.0.0:8000", router))
+	var servers []*http.Server
+	for _, addr := range cfg.Server.Listen {
+		server := &http.Server{
+			Addr:              addr,
+			Handler:           router,
+			ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+			ReadTimeout:       cfg.Server.ReadTimeout,
+			WriteTimeout:      cfg.Server.WriteTimeout,
+			IdleTimeout:       cfg.Server.IdleTimeout,
+			TLSConfig:         tlsConfig,
+		}
+		// the event streams never end by themselves, so they would hold the shutdown till the timeout
+		server.RegisterOnShutdown(events.Close)
+		servers = append(servers, server)
+	}
+	if len(cfg.Server.TLS.RedirectListen) > 0 {
+		_, httpsPort, _ := net.SplitHostPort(cfg.Server.Listen[0])
+		redirect := web.RedirectToHTTPS(httpsPort)
+		for _, addr := range cfg.Server.TLS.RedirectListen {
+			servers = append(servers, &http.Server{
+				Addr:              addr,
+				Handler:           redirect,
+				ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+				ReadTimeout:       cfg.Server.ReadTimeout,
+				IdleTimeout:       cfg.Server.IdleTimeout,
+			})
+		}
+	}
+
+	failed := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			var err error
+			if server.TLSConfig != nil {
+				log.Println("listening with tls on", server.Addr)
+				// the certificates come from the reloader
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				log.Println("listening on", server.Addr)
+				err = server.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				failed <- err
+			}
+		}(server)
+	}
+
+	exitCode := 0
+	select {
+	case <-ctx.Done():
+		log.Println("shutting down")
+	case err := <-failed:
+		log.Println(err)
+		exitCode = 1
+	}
+	// the second signal kills the process without waiting
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	// requests are drained first, so they still can use the background jobs and the storage
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Println(err)
+			exitCode = 1
+		}
+	}
+	closers := []struct {
+		name  string
+		close func() error
+	}{
+		{"replicator", replicator.Close},
+		{"webhooks", webhooks.Close},
+		{"storage", library.Close},
+		{"tls reloader", func() error {
+			if certs == nil {
+				return nil
+			}
+			return certs.Close()
+		}},
+		{"tracing", func() error { return shutdownTracing(shutdownCtx) }},
+	}
+	for _, closer := range closers {
+		if err := closer.close(); err != nil {
+			log.Println(closer.name, err)
+			exitCode = 1
+		}
+	}
+	return exitCode
+}
+
+// storageMiddlewares returns the storage wrappers by their names,
+// onChange and onRatesChange let the cache see the changes which are made around it
+func storageMiddlewares(names []string, cacheConfig config.Cache, onChange func(func(storage.Event)), onRatesChange func(func())) ([]web.StorageMiddleware, error) {
+	var middlewares []web.StorageMiddleware
+	for _, name := range names {
+		switch name {
+		case "validation":
+			middlewares = append(middlewares, middleware.Validation())
+		case "audit":
+			middlewares = append(middlewares, middleware.Audit(log.New(log.Writer(), "audit: ", log.Flags())))
+		case "metrics":
+			middlewares = append(middlewares, middleware.Metrics())
+		case "tracing":
+			middlewares = append(middlewares, middleware.Tracing())
+		case "cache":
+			middlewares = append(middlewares, func(next web.Storage) web.Storage {
+				cached := cache.NewStorage(next, cacheConfig.Size, cacheConfig.TTL)
+				// the replicated changes don't go through the cache
+				onChange(cached.Invalidate)
+				// the filters with the currency are compared at the exchange rates
+				onRatesChange(cached.InvalidateRates)
+				return cached
+			})
+		default:
+			return nil, fmt.Errorf("unknown storage middleware %q", name)
+		}
+	}
+	return middlewares, nil
 }
@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"context"
+	"log"
+
+	"github.com/ssOlexBaiko/library/api/web"
+	"github.com/ssOlexBaiko/library/storage"
+	"github.com/ssOlexBaiko/library/tracing"
+)
+
+type audit struct {
+	web.Storage
+	logger *log.Logger
+}
+
+// Audit writes every change of the catalog and its result to the logger, reads aren't logged
+func Audit(logger *log.Logger) web.StorageMiddleware {
+	return func(next web.Storage) web.Storage {
+		return audit{Storage: next, logger: logger}
+	}
+}
+
+// record writes the change, the trace ID ties the line to the request which made the change
+func (s audit) record(ctx context.Context, method, id string, book *storage.Book, err error) {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	if book != nil {
+		s.logger.Printf("%s id=%q title=%q genres=%q pages=%d price=%v currency=%q result=%q trace_id=%q",
+			method, id, book.Title, []string(book.Genres), book.Pages, book.Price, book.Currency, result, tracing.TraceID(ctx))
+		return
+	}
+	s.logger.Printf("%s id=%q result=%q trace_id=%q", method, id, result, tracing.TraceID(ctx))
+}
+
+func (s audit) CreateBook(ctx context.Context, book storage.Book) (storage.Book, error) {
+	created, err := s.Storage.CreateBook(ctx, book)
+	if err == nil {
+		book = created
+	}
+	s.record(ctx, "CreateBook", book.ID, &book, err)
+	return created, err
+}
+
+func (s audit) RemoveBook(ctx context.Context, id string) error {
+	err := s.Storage.RemoveBook(ctx, id)
+	s.record(ctx, "RemoveBook", id, nil, err)
+	return err
+}
+
+func (s audit) ChangeBook(ctx context.Context, id string, changedBook storage.Book) error {
+	err := s.Storage.ChangeBook(ctx, id, changedBook)
+	s.record(ctx, "ChangeBook", id, &changedBook, err)
+	return err
+}
+
+// Batch writes every operation of the batch with its own result
+func (s audit) Batch(ctx context.Context, ops []storage.Operation) ([]storage.OperationResult, error) {
+	results, err := s.Storage.Batch(ctx, ops)
+	for i, op := range ops {
+		id, book, opErr := op.ID, &ops[i].Book, err
+		if op.Op == storage.OpDelete {
+			book = nil
+		}
+		if i < len(results) {
+			opErr = results[i].Err
+			if results[i].Book != nil && op.Op != storage.OpDelete {
+				id, book = results[i].ID, results[i].Book
+			}
+		}
+		s.record(ctx, "Batch."+op.Op, id, book, opErr)
+	}
+	return results, err
+}
+
+// Reprice writes every changed price once the adjustment is applied, the failed apply is written as a whole
+func (s audit) Reprice(ctx context.Context, reprice storage.Reprice) (storage.RepriceResult, error) {
+	result, err := s.Storage.Reprice(ctx, reprice)
+	if err != nil && reprice.Apply {
+		s.record(ctx, "Reprice", "", nil, err)
+	}
+	for _, change := range result.Changes {
+		if !result.Applied {
+			break
+		}
+		s.logger.Printf("Reprice id=%q title=%q old_price=%v new_price=%v currency=%q result=%q trace_id=%q",
+			change.ID, change.Title, change.OldPrice, change.NewPrice, change.Currency, "ok", tracing.TraceID(ctx))
+	}
+	return result, err
+}
@@ -0,0 +1,34 @@
+// Package middleware contains wrappers of the storage used by the handlers.
+//
+// A wrapper is a web.StorageMiddleware: it gets the next storage and returns the storage
+// which adds its concern around the calls. Wrappers are stacked with web.ChainStorage,
+// the first one sees the calls first:
+//
+//	store := web.ChainStorage(library,
+//		middleware.Validation(),
+//		middleware.Audit(log.New(os.Stdout, "audit: ", log.LstdFlags)),
+//		middleware.Metrics(),
+//	)
+//
+// A custom wrapper embeds web.Storage, so the methods it doesn't care about are passed through,
+// and overrides only the methods it needs:
+//
+//	type readOnly struct {
+//		web.Storage
+//	}
+//
+//	func (s readOnly) CreateBook(ctx context.Context, book storage.Book) (storage.Book, error) {
+//		return storage.Book{}, errors.New("the catalog is read only")
+//	}
+//
+//	func ReadOnly() web.StorageMiddleware {
+//		return func(next web.Storage) web.Storage {
+//			return readOnly{next}
+//		}
+//	}
+//
+// Wrappers hide the methods which aren't part of web.Storage,
+// so things like the replication have to keep using the library itself.
+// Errors of the wrapped storage should be returned as they are, the handlers compare them
+// with storage.ErrNotFound, rejected input is reported by wrapping storage.ErrInvalid.
+package middleware
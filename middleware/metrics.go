@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ssOlexBaiko/library/api/web"
+	"github.com/ssOlexBaiko/library/storage"
+)
+
+var (
+	callsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "library_storage_calls_total",
+			Help: "Number of storage calls made by the handlers by method and result.",
+		},
+		[]string{"method", "result"},
+	)
+	callDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "library_storage_call_duration_seconds",
+			Help:    "Duration of storage calls made by the handlers, including the wrappers below, by method.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"method"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(callsTotal, callDuration)
+}
+
+// result returns the label of the call outcome
+func result(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, storage.ErrNotFound):
+		return "not_found"
+	case errors.Is(err, storage.ErrInvalid):
+		return "invalid"
+	}
+	return "error"
+}
+
+type metrics struct {
+	web.Storage
+}
+
+// Metrics counts and times the calls as the handlers see them,
+// unlike the metrics of the library it sees the cache hits and the rejected calls
+func Metrics() web.StorageMiddleware {
+	return func(next web.Storage) web.Storage {
+		return metrics{next}
+	}
+}
+
+func (s metrics) observe(method string, start time.Time, err error) {
+	callDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	callsTotal.WithLabelValues(method, result(err)).Inc()
+}
+
+func (s metrics) GetBooks(ctx context.Context) (storage.Books, error) {
+	start := time.Now()
+	books, err := s.Storage.GetBooks(ctx)
+	s.observe("GetBooks", start, err)
+	return books, err
+}
+
+func (s metrics) CreateBook(ctx context.Context, book storage.Book) (storage.Book, error) {
+	start := time.Now()
+	created, err := s.Storage.CreateBook(ctx, book)
+	s.observe("CreateBook", start, err)
+	return created, err
+}
+
+func (s metrics) Batch(ctx context.Context, ops []storage.Operation) ([]storage.OperationResult, error) {
+	start := time.Now()
+	results, err := s.Storage.Batch(ctx, ops)
+	s.observe("Batch", start, err)
+	return results, err
+}
+
+func (s metrics) Reprice(ctx context.Context, reprice storage.Reprice) (storage.RepriceResult, error) {
+	start := time.Now()
+	result, err := s.Storage.Reprice(ctx, reprice)
+	s.observe("Reprice", start, err)
+	return result, err
+}
+
+func (s metrics) PriceHistory(ctx context.Context, id string) (storage.PriceRecords, error) {
+	start := time.Now()
+	prices, err := s.Storage.PriceHistory(ctx, id)
+	s.observe("PriceHistory", start, err)
+	return prices, err
+}
+
+func (s metrics) GetBook(ctx context.Context, id string) (storage.Book, error) {
+	start := time.Now()
+	book, err := s.Storage.GetBook(ctx, id)
+	s.observe("GetBook", start, err)
+	return book, err
+}
+
+func (s metrics) RemoveBook(ctx context.Context, id string) error {
+	start := time.Now()
+	err := s.Storage.RemoveBook(ctx, id)
+	s.observe("RemoveBook", start, err)
+	return err
+}
+
+func (s metrics) ChangeBook(ctx context.Context, id string, changedBook storage.Book) error {
+	start := time.Now()
+	err := s.Storage.ChangeBook(ctx, id, changedBook)
+	s.observe("ChangeBook", start, err)
+	return err
+}
+
+func (s metrics) PriceFilter(ctx context.Context, filter storage.BookFilter) (storage.Books, error) {
+	start := time.Now()
+	books, err := s.Storage.PriceFilter(ctx, filter)
+	s.observe("PriceFilter", start, err)
+	return books, err
+}
+
+func (s metrics) Changes(ctx context.Context, since uint64) (storage.Changes, uint64, error) {
+	start := time.Now()
+	changes, last, err := s.Storage.Changes(ctx, since)
+	s.observe("Changes", start, err)
+	return changes, last, err
+}
+
+func (s metrics) Version(ctx context.Context) (uint64, time.Time, error) {
+	start := time.Now()
+	seq, modified, err := s.Storage.Version(ctx)
+	s.observe("Version", start, err)
+	return seq, modified, err
+}
@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ssOlexBaiko/library/api/web"
+	"github.com/ssOlexBaiko/library/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func newLibrary(t *testing.T) web.Storage {
+	dir, err := ioutil.TempDir("", "middleware")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "storage.json")
+	if err = ioutil.WriteFile(path, []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return storage.NewLibrary(path, false)
+}
+
+// named records the order in which the wrappers see the calls
+type named struct {
+	web.Storage
+	name  string
+	calls *[]string
+}
+
+func (s named) GetBooks(ctx context.Context) (storage.Books, error) {
+	*s.calls = append(*s.calls, s.name)
+	return s.Storage.GetBooks(ctx)
+}
+
+func TestChainStorage(t *testing.T) {
+	var calls []string
+	wrapper := func(name string) web.StorageMiddleware {
+		return func(next web.Storage) web.Storage {
+			return named{Storage: next, name: name, calls: &calls}
+		}
+	}
+
+	store := web.ChainStorage(newLibrary(t), wrapper("outer"), wrapper("inner"))
+	ctx := context.Background()
+	_, err := store.GetBooks(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"outer", "inner"}, calls)
+}
+
+func TestValidationAndAudit(t *testing.T) {
+	test := assert.New(t)
+	ctx := context.Background()
+	var logged bytes.Buffer
+	store := web.ChainStorage(newLibrary(t),
+		Audit(log.New(&logged, "", 0)),
+		Validation(),
+		Metrics(),
+		Tracing(),
+	)
+
+	book := storage.Book{Title: "Book", Genres: []string{"drama"}, Pages: 10, Price: storage.MustDecimal("5")}
+	created, err := store.CreateBook(ctx, book)
+	test.NoError(err)
+	test.NotEmpty(created.ID)
+
+	book.Price = storage.MustDecimal("-1")
+	_, err = store.CreateBook(ctx, book)
+	test.True(errors.Is(err, storage.ErrInvalid))
+
+	_, err = store.GetBook(ctx, "not-uuid")
+	test.True(errors.Is(err, storage.ErrInvalid))
+
+	_, err = store.PriceFilter(ctx, storage.BookFilter{Price: "=5"})
+	test.True(errors.Is(err, storage.ErrInvalid))
+	_, err = store.PriceFilter(ctx, storage.BookFilter{Price: "<5", Currency: "ABC"})
+	test.True(errors.Is(err, storage.ErrInvalid))
+
+	books, err := store.PriceFilter(ctx, storage.BookFilter{Price: "<10"})
+	test.NoError(err)
+	test.Len(books, 1)
+
+	results, err := store.Batch(ctx, []storage.Operation{
+		{Op: storage.OpCreate, Book: storage.Book{Title: "Batch", Genres: []string{"drama"}, Pages: 10, Price: storage.MustDecimal("5")}},
+		{Op: storage.OpDelete, ID: "not-uuid"},
+	})
+	test.True(errors.Is(err, storage.ErrInvalid))
+	if test.Len(results, 2) {
+		test.Equal(storage.ErrRolledBack, results[0].Err)
+		test.True(errors.Is(results[1].Err, storage.ErrInvalid))
+	}
+
+	_, err = store.Reprice(ctx, storage.Reprice{
+		Filter:     storage.BookFilter{Price: "<10"},
+		Adjustment: storage.Adjustment{Kind: "double"},
+		Apply:      true,
+	})
+	test.True(errors.Is(err, storage.ErrInvalid))
+	result, err := store.Reprice(ctx, storage.Reprice{
+		Filter:     storage.BookFilter{Price: "<10"},
+		Adjustment: storage.Adjustment{Kind: storage.AdjustSet, Value: storage.MustDecimal("7")},
+		Apply:      true,
+	})
+	test.NoError(err)
+	test.Len(result.Changes, 1)
+
+	lines := strings.Split(strings.TrimSpace(logged.String()), "\n")
+	if test.Len(lines, 6, "only the writes are audited") {
+		test.Contains(lines[0], `result="ok"`)
+		test.Contains(lines[1], "price must be positive")
+		test.Contains(lines[2], "Batch.create")
+		test.Contains(lines[2], "rolled back")
+		test.Contains(lines[3], "isn't a UUID")
+		test.Contains(lines[4], "unknown adjustment")
+		test.Contains(lines[5], "old_price=5 new_price=7")
+	}
+}
@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ssOlexBaiko/library/api/web"
+	"github.com/ssOlexBaiko/library/storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans, the tracer is taken from the global provider
+// for every span, so the provider which is set after the package is loaded is used as well
+const tracerName = "github.com/ssOlexBaiko/library/middleware"
+
+type traced struct {
+	web.Storage
+}
+
+// Tracing wraps every storage call into the span, which is the child of the request span.
+// Spans are dropped unless the tracer provider is set up, so the wrapper is cheap to keep in the chain.
+func Tracing() web.StorageMiddleware {
+	return func(next web.Storage) web.Storage {
+		return traced{next}
+	}
+}
+
+// start starts the span of the storage method
+func (s traced) start(ctx context.Context, method string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, "storage."+method, trace.WithAttributes(attributes...))
+}
+
+// end records the error of the call, missing books aren't errors of the storage
+func (s traced) end(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (s traced) GetBooks(ctx context.Context) (storage.Books, error) {
+	ctx, span := s.start(ctx, "GetBooks")
+	books, err := s.Storage.GetBooks(ctx)
+	span.SetAttributes(attribute.Int("library.books", len(books)))
+	s.end(span, err)
+	return books, err
+}
+
+func (s traced) CreateBook(ctx context.Context, book storage.Book) (storage.Book, error) {
+	ctx, span := s.start(ctx, "CreateBook")
+	created, err := s.Storage.CreateBook(ctx, book)
+	span.SetAttributes(attribute.String("library.book_id", created.ID))
+	s.end(span, err)
+	return created, err
+}
+
+func (s traced) Batch(ctx context.Context, ops []storage.Operation) ([]storage.OperationResult, error) {
+	ctx, span := s.start(ctx, "Batch", attribute.Int("library.operations", len(ops)))
+	results, err := s.Storage.Batch(ctx, ops)
+	s.end(span, err)
+	return results, err
+}
+
+func (s traced) Reprice(ctx context.Context, reprice storage.Reprice) (storage.RepriceResult, error) {
+	ctx, span := s.start(ctx, "Reprice",
+		attribute.String("library.adjustment", reprice.Adjustment.Kind),
+		attribute.Bool("library.reprice.apply", reprice.Apply))
+	result, err := s.Storage.Reprice(ctx, reprice)
+	span.SetAttributes(attribute.Int("library.reprice.changes", len(result.Changes)))
+	s.end(span, err)
+	return result, err
+}
+
+func (s traced) GetBook(ctx context.Context, id string) (storage.Book, error) {
+	ctx, span := s.start(ctx, "GetBook", attribute.String("library.book_id", id))
+	book, err := s.Storage.GetBook(ctx, id)
+	s.end(span, err)
+	return book, err
+}
+
+func (s traced) PriceHistory(ctx context.Context, id string) (storage.PriceRecords, error) {
+	ctx, span := s.start(ctx, "PriceHistory", attribute.String("library.book_id", id))
+	prices, err := s.Storage.PriceHistory(ctx, id)
+	s.end(span, err)
+	return prices, err
+}
+
+func (s traced) RemoveBook(ctx context.Context, id string) error {
+	ctx, span := s.start(ctx, "RemoveBook", attribute.String("library.book_id", id))
+	err := s.Storage.RemoveBook(ctx, id)
+	s.end(span, err)
+	return err
+}
+
+func (s traced) ChangeBook(ctx context.Context, id string, changedBook storage.Book) error {
+	ctx, span := s.start(ctx, "ChangeBook", attribute.String("library.book_id", id))
+	err := s.Storage.ChangeBook(ctx, id, changedBook)
+	s.end(span, err)
+	return err
+}
+
+func (s traced) PriceFilter(ctx context.Context, filter storage.BookFilter) (storage.Books, error) {
+	ctx, span := s.start(ctx, "PriceFilter",
+		attribute.String("library.filter.price", filter.Price),
+		attribute.String("library.filter.genre", filter.Genre),
+		attribute.String("library.filter.currency", filter.Currency),
+	)
+	books, err := s.Storage.PriceFilter(ctx, filter)
+	span.SetAttributes(attribute.Int("library.books", len(books)))
+	s.end(span, err)
+	return books, err
+}
+
+func (s traced) Changes(ctx context.Context, since uint64) (storage.Changes, uint64, error) {
+	ctx, span := s.start(ctx, "Changes", attribute.Int64("library.since", int64(since)))
+	changes, last, err := s.Storage.Changes(ctx, since)
+	s.end(span, err)
+	return changes, last, err
+}
+
+func (s traced) Version(ctx context.Context) (uint64, time.Time, error) {
+	ctx, span := s.start(ctx, "Version")
+	seq, modified, err := s.Storage.Version(ctx)
+	s.end(span, err)
+	return seq, modified, err
+}
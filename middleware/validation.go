@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ssOlexBaiko/library/api/web"
+	"github.com/ssOlexBaiko/library/storage"
+	"github.com/twinj/uuid"
+)
+
+// maxTitle is the longest title which fits into the sql column
+const maxTitle = 100
+
+type validation struct {
+	web.Storage
+}
+
+// Validation rejects malformed ids, books and filters before they reach the storage
+func Validation() web.StorageMiddleware {
+	return func(next web.Storage) web.Storage {
+		return validation{next}
+	}
+}
+
+func validateID(id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return fmt.Errorf("%w: id %q isn't a UUID", storage.ErrInvalid, id)
+	}
+	return nil
+}
+
+func validateBook(book storage.Book) error {
+	switch {
+	case strings.TrimSpace(book.Title) == "":
+		return fmt.Errorf("%w: title is empty", storage.ErrInvalid)
+	case len(book.Title) > maxTitle:
+		return fmt.Errorf("%w: title is longer than %d", storage.ErrInvalid, maxTitle)
+	case len(book.Genres) == 0:
+		return fmt.Errorf("%w: genres are empty", storage.ErrInvalid)
+	case book.Pages <= 0:
+		return fmt.Errorf("%w: pages must be positive", storage.ErrInvalid)
+	case book.Price.Sign() <= 0:
+		return fmt.Errorf("%w: price must be positive", storage.ErrInvalid)
+	}
+	// the change without the currency keeps the one of the book, so only the given one is checked here
+	if book.Currency != "" {
+		if err := storage.CheckPrice(book.Money()); err != nil {
+			return err
+		}
+	}
+	for _, genre := range book.Genres {
+		if strings.TrimSpace(genre) == "" {
+			return fmt.Errorf("%w: genre is empty", storage.ErrInvalid)
+		}
+	}
+	return nil
+}
+
+func (s validation) CreateBook(ctx context.Context, book storage.Book) (storage.Book, error) {
+	if err := validateBook(book); err != nil {
+		return storage.Book{}, err
+	}
+	return s.Storage.CreateBook(ctx, book)
+}
+
+func (s validation) GetBook(ctx context.Context, id string) (storage.Book, error) {
+	if err := validateID(id); err != nil {
+		return storage.Book{}, err
+	}
+	return s.Storage.GetBook(ctx, id)
+}
+
+func (s validation) PriceHistory(ctx context.Context, id string) (storage.PriceRecords, error) {
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+	return s.Storage.PriceHistory(ctx, id)
+}
+
+func (s validation) RemoveBook(ctx context.Context, id string) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+	return s.Storage.RemoveBook(ctx, id)
+}
+
+func (s validation) ChangeBook(ctx context.Context, id string, changedBook storage.Book) error {
+	if err := validateID(id); err != nil {
+		return err
+	}
+	if err := validateBook(changedBook); err != nil {
+		return err
+	}
+	return s.Storage.ChangeBook(ctx, id, changedBook)
+}
+
+func (s validation) PriceFilter(ctx context.Context, filter storage.BookFilter) (storage.Books, error) {
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+	return s.Storage.PriceFilter(ctx, filter)
+}
+
+func (s validation) Batch(ctx context.Context, ops []storage.Operation) ([]storage.OperationResult, error) {
+	for i, op := range ops {
+		var err error
+		switch op.Op {
+		case storage.OpCreate:
+			err = validateBook(op.Book)
+		case storage.OpUpdate:
+			if err = validateID(op.ID); err == nil {
+				err = validateBook(op.Book)
+			}
+		case storage.OpDelete:
+			err = validateID(op.ID)
+		default:
+			err = fmt.Errorf("%w: unknown operation %q", storage.ErrInvalid, op.Op)
+		}
+		if err != nil {
+			return storage.AbortBatch(ops, i, err), err
+		}
+	}
+	return s.Storage.Batch(ctx, ops)
+}
+
+func (s validation) Reprice(ctx context.Context, reprice storage.Reprice) (storage.RepriceResult, error) {
+	if err := reprice.Filter.Validate(); err != nil {
+		return storage.RepriceResult{}, err
+	}
+	if err := reprice.Adjustment.Validate(); err != nil {
+		return storage.RepriceResult{}, err
+	}
+	return s.Storage.Reprice(ctx, reprice)
+}
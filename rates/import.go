@@ -0,0 +1,176 @@
+package rates
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/ssOlexBaiko/library/storage"
+)
+
+// ErrInvalidImport describe the file which is neither the ECB XML nor the ECB CSV of the reference rates
+var ErrInvalidImport = errors.New("not the reference rates in the ECB XML or CSV format")
+
+// dateLayouts are the formats of the dates in the ECB files, the daily CSV has the long one
+var dateLayouts = []string{"2006-01-02", "2 January 2006", "02 January 2006"}
+
+// envelope is the part of the ECB XML with the rates, e.g.
+// <Cube><Cube time="2024-05-10"><Cube currency="USD" rate="1.0773"/></Cube></Cube>
+type envelope struct {
+	Cube struct {
+		Days []struct {
+			Time  string `xml:"time,attr"`
+			Rates []struct {
+				Currency string `xml:"currency,attr"`
+				Rate     string `xml:"rate,attr"`
+			} `xml:"Cube"`
+		} `xml:"Cube"`
+	} `xml:"Cube"`
+}
+
+// Import replaces the rates of the currencies found in the ECB reference rates file,
+// the other rates are kept. Only the latest day is taken from the files with the history.
+// The currencies unknown to the library are skipped, the imported rates are returned.
+func (t *Table) Import(r io.Reader) (Rates, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var imported Rates
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		imported, err = parseXML(data)
+	} else {
+		imported, err = parseCSV(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	previous := t.state
+	t.state = state{Rates: merge(previous.Rates, imported), Updated: time.Now().UTC()}
+	if err = t.writeData(); err != nil {
+		t.state = previous
+		return nil, err
+	}
+	t.notify()
+	return merge(nil, imported), nil
+}
+
+func parseXML(data []byte) (Rates, error) {
+	var doc envelope
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+
+	var latest Rates
+	var latestDate time.Time
+	for _, day := range doc.Cube.Days {
+		date, err := parseDate(day.Time)
+		if err != nil {
+			return nil, err
+		}
+		if !latestDate.IsZero() && !date.After(latestDate) {
+			continue
+		}
+		var rates Rates
+		for _, cube := range day.Rates {
+			rate, ok, err := parseRate(cube.Currency, cube.Rate, date)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				rates = append(rates, rate)
+			}
+		}
+		latest, latestDate = rates, date
+	}
+	if len(latest) == 0 {
+		return nil, ErrInvalidImport
+	}
+	return latest, nil
+}
+
+// parseCSV reads the file with the "Date" column followed by a column per currency,
+// the daily file has a single row, the history one a row per day
+func parseCSV(data []byte) (Rates, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImport, err)
+	}
+	if len(records) < 2 || len(records[0]) < 2 || !strings.EqualFold(strings.TrimSpace(records[0][0]), "date") {
+		return nil, ErrInvalidImport
+	}
+
+	header := records[0]
+	var latest Rates
+	var latestDate time.Time
+	for _, record := range records[1:] {
+		if len(record) == 0 || strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		date, err := parseDate(record[0])
+		if err != nil {
+			return nil, err
+		}
+		if !latestDate.IsZero() && !date.After(latestDate) {
+			continue
+		}
+		var rates Rates
+		for i := 1; i < len(record) && i < len(header); i++ {
+			rate, ok, err := parseRate(header[i], record[i], date)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				rates = append(rates, rate)
+			}
+		}
+		latest, latestDate = rates, date
+	}
+	if len(latest) == 0 {
+		return nil, ErrInvalidImport
+	}
+	return latest, nil
+}
+
+func parseDate(text string) (time.Time, error) {
+	text = strings.TrimSpace(text)
+	for _, layout := range dateLayouts {
+		if date, err := time.Parse(layout, text); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%w: date %q", ErrInvalidImport, text)
+}
+
+// parseRate returns false for the empty columns, the missing values and the currencies unknown to the library
+func parseRate(currency, value string, date time.Time) (Rate, bool, error) {
+	currency = strings.ToUpper(strings.TrimSpace(currency))
+	value = strings.TrimSpace(value)
+	if _, ok := storage.CurrencyPlaces(currency); !ok || currency == Base || value == "" || value == "N/A" {
+		return Rate{}, false, nil
+	}
+
+	amount, err := storage.ParseDecimal(value)
+	if err != nil {
+		return Rate{}, false, fmt.Errorf("%w: %s rate %q: %v", ErrInvalidImport, currency, value, err)
+	}
+	rate := Rate{Currency: currency, Rate: amount, Date: date}
+	if err = checkRate(rate); err != nil {
+		return Rate{}, false, err
+	}
+	return rate, true, nil
+}
@@ -0,0 +1,236 @@
+package rates
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ssOlexBaiko/library/storage"
+)
+
+// Base is the currency the rates are quoted against, like the reference rates of the ECB
+const Base = "EUR"
+
+var (
+	// ErrNotFound describe the currency which has no rate in the table
+	ErrNotFound = errors.New("no exchange rate for the currency")
+	// ErrInvalidRate describe the rate of the unknown currency, the base one or the rate which isn't positive
+	ErrInvalidRate = errors.New("rate needs a known currency other than the base one and a positive value")
+)
+
+// Rate is the amount of the currency which is worth one unit of the Base currency
+type Rate struct {
+	Currency string          `json:"currency"`
+	Rate     storage.Decimal `json:"rate"`
+	// Date the rate was published for, it's the import time for the rates set by hand
+	Date time.Time `json:"date"`
+}
+
+// Rates contains rate objects
+type Rates []Rate
+
+// state is what the table keeps in the storage file
+type state struct {
+	Rates   Rates     `json:"rates"`
+	Updated time.Time `json:"updated"`
+}
+
+// Table keeps the exchange rates in the file and converts the prices at them.
+// The conversion is done offline, the rates are only changed by Set, Remove and Import.
+type Table struct {
+	path      string
+	listeners []func()
+
+	mu    sync.RWMutex
+	state state
+}
+
+// NewTable constructor for Table struct, it reads the rates from the given file
+func NewTable(path string) (*Table, error) {
+	t := &Table{path: path}
+
+	file, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err = json.Unmarshal(file, &t.state); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// OnChange registers the listener which is called after every successful change of the rates.
+// Listeners have to be registered before the table is used, they are called with the lock held,
+// so they mustn't block or use the table.
+func (t *Table) OnChange(listener func()) {
+	t.listeners = append(t.listeners, listener)
+}
+
+func (t *Table) notify() {
+	for _, listener := range t.listeners {
+		listener()
+	}
+}
+
+// writeData saves the state, it has to be called with the lock held
+func (t *Table) writeData() error {
+	path, err := filepath.Abs(t.path)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(t.state, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	// write into the temporary file first so the crash doesn't leave the half-written state
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Rates returns all the rates ordered by the currency
+func (t *Table) Rates() (Rates, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	rates := make(Rates, len(t.state.Rates))
+	copy(rates, t.state.Rates)
+	return rates, nil
+}
+
+// Updated returns the time the rates were changed last, it's zero for the empty table
+func (t *Table) Updated() time.Time {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.state.Updated
+}
+
+// Set adds the rate of the currency or replaces the existing one
+func (t *Table) Set(rate Rate) (Rate, error) {
+	rate.Currency = strings.ToUpper(strings.TrimSpace(rate.Currency))
+	if err := checkRate(rate); err != nil {
+		return Rate{}, err
+	}
+	if rate.Date.IsZero() {
+		rate.Date = time.Now().UTC()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	previous := t.state
+	t.state = state{Rates: merge(previous.Rates, Rates{rate}), Updated: time.Now().UTC()}
+	if err := t.writeData(); err != nil {
+		t.state = previous
+		return Rate{}, err
+	}
+	t.notify()
+	return rate, nil
+}
+
+// Remove deletes the rate of the currency, its prices can't be converted after that
+func (t *Table) Remove(currency string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	index := -1
+	for i, rate := range t.state.Rates {
+		if rate.Currency == currency {
+			index = i
+		}
+	}
+	if index < 0 {
+		return ErrNotFound
+	}
+
+	previous := t.state
+	rates := make(Rates, 0, len(previous.Rates)-1)
+	rates = append(rates, previous.Rates[:index]...)
+	rates = append(rates, previous.Rates[index+1:]...)
+	t.state = state{Rates: rates, Updated: time.Now().UTC()}
+	if err := t.writeData(); err != nil {
+		t.state = previous
+		return err
+	}
+	t.notify()
+	return nil
+}
+
+// Convert returns the price in the given currency rounded to the minor unit of that currency.
+// It implements storage.Converter.
+func (t *Table) Convert(price storage.Money, currency string) (storage.Money, error) {
+	places, ok := storage.CurrencyPlaces(currency)
+	if !ok {
+		return storage.Money{}, fmt.Errorf("%w: unknown currency %q", storage.ErrInvalid, currency)
+	}
+	if price.Currency == currency {
+		return price, nil
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	from, err := t.rate(price.Currency)
+	if err != nil {
+		return storage.Money{}, err
+	}
+	to, err := t.rate(currency)
+	if err != nil {
+		return storage.Money{}, err
+	}
+	// both rates are quoted against the base, so the price goes through it in one step
+	amount := price.Amount.MulDiv(to, from).Round(places)
+	return storage.Money{Amount: amount, Currency: currency}, nil
+}
+
+// rate returns the units of the currency per unit of the base one, it has to be called with the lock held
+func (t *Table) rate(currency string) (storage.Decimal, error) {
+	if currency == Base {
+		return storage.MustDecimal("1"), nil
+	}
+	for _, rate := range t.state.Rates {
+		if rate.Currency == currency {
+			return rate.Rate, nil
+		}
+	}
+	return storage.Decimal{}, fmt.Errorf("%w %s", ErrNotFound, currency)
+}
+
+func checkRate(rate Rate) error {
+	if _, ok := storage.CurrencyPlaces(rate.Currency); !ok || rate.Currency == Base || rate.Rate.Sign() <= 0 {
+		return fmt.Errorf("%w: %s %s", ErrInvalidRate, rate.Currency, rate.Rate)
+	}
+	return nil
+}
+
+// merge returns the rates with the given ones replacing the rates of the same currency, ordered by the currency
+func merge(rates, with Rates) Rates {
+	byCurrency := map[string]Rate{}
+	for _, rate := range rates {
+		byCurrency[rate.Currency] = rate
+	}
+	for _, rate := range with {
+		byCurrency[rate.Currency] = rate
+	}
+
+	merged := make(Rates, 0, len(byCurrency))
+	for _, rate := range byCurrency {
+		merged = append(merged, rate)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Currency < merged[j].Currency })
+	return merged
+}
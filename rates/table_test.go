@@ -0,0 +1,139 @@
+package rates
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ssOlexBaiko/library/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+const ecbXML = `<?xml version="1.0" encoding="UTF-8"?>
+<gesmes:Envelope xmlns:gesmes="http://www.gesmes.org/xml/2002-08-01" xmlns="http://www.ecb.int/vocabulary/2002-08-01/eurofxref">
+	<gesmes:subject>Reference rates</gesmes:subject>
+	<Cube>
+		<Cube time="2024-05-10">
+			<Cube currency="USD" rate="1.0773"/>
+			<Cube currency="PLN" rate="4.3135"/>
+			<Cube currency="GBP" rate="0.86078"/>
+		</Cube>
+		<Cube time="2024-05-09">
+			<Cube currency="USD" rate="1.0749"/>
+		</Cube>
+	</Cube>
+</gesmes:Envelope>`
+
+const ecbCSV = `Date, USD, JPY, PLN, XYZ, 
+10 May 2024, 1.0773, 167.72, 4.3135, 1.5, 
+`
+
+func newTestTable(t *testing.T) (*Table, string) {
+	dir, err := ioutil.TempDir("", "rates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "rates.json")
+	table, err := NewTable(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table, path
+}
+
+func money(amount, currency string) storage.Money {
+	return storage.Money{Amount: storage.MustDecimal(amount), Currency: currency}
+}
+
+func TestImport(t *testing.T) {
+	test := assert.New(t)
+	table, path := newTestTable(t)
+
+	imported, err := table.Import(bytes.NewBufferString(ecbXML))
+	test.NoError(err)
+	if test.Len(imported, 3, "only the latest day is imported") {
+		test.Equal("GBP", imported[0].Currency)
+		test.Equal("0.86078", imported[0].Rate.String())
+		test.Equal("1.0773", imported[2].Rate.String())
+		test.Equal(time.Date(2024, 5, 10, 0, 0, 0, 0, time.UTC), imported[2].Date)
+	}
+
+	_, err = table.Import(bytes.NewBufferString(ecbCSV))
+	test.NoError(err)
+	list, err := table.Rates()
+	test.NoError(err)
+	var currencies []string
+	for _, rate := range list {
+		currencies = append(currencies, rate.Currency)
+	}
+	test.Equal([]string{"GBP", "JPY", "PLN", "USD"}, currencies, "the rates missing in the file are kept, the unknown currencies are skipped")
+
+	_, err = table.Import(bytes.NewBufferString("title,price\nEmma,12\n"))
+	test.ErrorIs(err, ErrInvalidImport)
+	_, err = table.Import(bytes.NewBufferString(`<Envelope><Cube><Cube time="2024-05-10"><Cube currency="USD" rate="-1"/></Cube></Cube></Envelope>`))
+	test.ErrorIs(err, ErrInvalidRate)
+
+	reopened, err := NewTable(path)
+	test.NoError(err)
+	test.Equal(list, mustRates(t, reopened), "the rates are kept in the file")
+	test.Equal(table.Updated(), reopened.Updated())
+}
+
+func TestConvert(t *testing.T) {
+	test := assert.New(t)
+	table, _ := newTestTable(t)
+	changes := 0
+	table.OnChange(func() { changes++ })
+
+	_, err := table.Set(Rate{Currency: "usd", Rate: storage.MustDecimal("1.08")})
+	test.NoError(err)
+	_, err = table.Set(Rate{Currency: "PLN", Rate: storage.MustDecimal("4.32")})
+	test.NoError(err)
+
+	converted, err := table.Convert(money("10.80", "USD"), "EUR")
+	test.NoError(err)
+	test.Equal(money("10", "EUR"), converted)
+
+	converted, err = table.Convert(money("10", "EUR"), "PLN")
+	test.NoError(err)
+	test.Equal(money("43.2", "PLN"), converted)
+
+	// the cross rate goes through the base currency and only the result is rounded
+	converted, err = table.Convert(money("19.99", "USD"), "PLN")
+	test.NoError(err)
+	test.Equal(money("79.96", "PLN"), converted)
+
+	converted, err = table.Convert(money("5", "PLN"), "PLN")
+	test.NoError(err)
+	test.Equal(money("5", "PLN"), converted)
+
+	_, err = table.Convert(money("5", "JPY"), "EUR")
+	test.ErrorIs(err, ErrNotFound)
+	_, err = table.Convert(money("5", "EUR"), "ABC")
+	test.ErrorIs(err, storage.ErrInvalid)
+
+	_, err = table.Set(Rate{Currency: "EUR", Rate: storage.MustDecimal("1")})
+	test.ErrorIs(err, ErrInvalidRate)
+	_, err = table.Set(Rate{Currency: "USD", Rate: storage.MustDecimal("0")})
+	test.ErrorIs(err, ErrInvalidRate)
+	test.Equal(2, changes, "the rejected rates don't change the table")
+
+	test.NoError(table.Remove("PLN"))
+	test.ErrorIs(table.Remove("PLN"), ErrNotFound)
+	test.Equal(3, changes)
+	_, err = table.Convert(money("5", "USD"), "PLN")
+	test.ErrorIs(err, ErrNotFound)
+}
+
+func mustRates(t *testing.T, table *Table) Rates {
+	rates, err := table.Rates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rates
+}
@@ -0,0 +1,271 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ssOlexBaiko/library/storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Target is the library which receives the changes of the peers
+type Target interface {
+	Apply(ctx context.Context, change storage.Change) (bool, error)
+}
+
+// PeerStatus describes the replication from a single peer
+type PeerStatus struct {
+	Peer string `json:"peer"`
+	// Token is the sync token of the last pulled change
+	Token string `json:"token"`
+	// LastPull is the time of the last successful pull
+	LastPull time.Time `json:"last_pull"`
+	// Lag is the time since the last successful pull
+	Lag string `json:"lag"`
+	// Applied is the number of pulled changes which won against the local state
+	Applied int `json:"applied"`
+	// Skipped is the number of pulled changes which lost against the local state
+	Skipped   int    `json:"skipped"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// feed is the body of the change feed of the peer
+type feed struct {
+	Changes storage.Changes `json:"changes"`
+	Token   string          `json:"token"`
+}
+
+// errTokenRejected describes the sync token the peer doesn't accept, e.g. its storage was replaced
+var errTokenRejected = errors.New("peer rejected the sync token")
+
+// state is what the replicator keeps in the file
+type state struct {
+	// Tokens are the sync tokens of the last pulled changes by the base URLs of the peers
+	Tokens map[string]string `json:"tokens"`
+}
+
+// Replicator pulls the change logs of the peers and applies them to the target.
+// Sync tokens are kept in the file, so after restart every peer is pulled from where it was left.
+type Replicator struct {
+	path     string
+	target   Target
+	client   *http.Client
+	interval time.Duration
+	token    string
+
+	mu    sync.Mutex
+	peers []*PeerStatus
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewReplicator constructor for Replicator struct, peers are base URLs of other instances.
+// The sync tokens are read from the given file, the peers without them are pulled from the full snapshot.
+func NewReplicator(target Target, peers []string, interval time.Duration, path string) (*Replicator, error) {
+	r := &Replicator{
+		path:     path,
+		target:   target,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		interval: interval,
+	}
+
+	var saved state
+	file, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err = json.Unmarshal(file, &saved); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, peer := range peers {
+		peer = strings.TrimRight(peer, "/")
+		r.peers = append(r.peers, &PeerStatus{Peer: peer, Token: saved.Tokens[peer]})
+	}
+	return r, nil
+}
+
+// writeData saves the sync tokens of the peers, it has to be called with the lock held
+func (r *Replicator) writeData() error {
+	path, err := filepath.Abs(r.path)
+	if err != nil {
+		return err
+	}
+
+	saved := state{Tokens: map[string]string{}}
+	for _, peer := range r.peers {
+		if peer.Token != "" {
+			saved.Tokens[peer.Peer] = peer.Token
+		}
+	}
+	data, err := json.MarshalIndent(saved, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	// write into the temporary file first so the crash doesn't leave the half-written state
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// SetToken sets the bearer token which is sent to the peers requiring authentication
+func (r *Replicator) SetToken(token string) {
+	r.token = token
+}
+
+// Status returns the replication status of every peer
+func (r *Replicator) Status() []PeerStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	statuses := make([]PeerStatus, 0, len(r.peers))
+	for _, peer := range r.peers {
+		status := *peer
+		if !status.LastPull.IsZero() {
+			status.Lag = time.Since(status.LastPull).String()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Sync pulls every peer once, the canceled context stops the pull in progress
+func (r *Replicator) Sync(ctx context.Context) {
+	for _, peer := range r.peers {
+		if ctx.Err() != nil {
+			return
+		}
+		r.pull(ctx, peer)
+	}
+}
+
+func (r *Replicator) pull(ctx context.Context, peer *PeerStatus) {
+	r.mu.Lock()
+	token := peer.Token
+	r.mu.Unlock()
+
+	applied, skipped, token, err := r.fetch(ctx, peer.Peer, token)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	peer.Applied += applied
+	peer.Skipped += skipped
+	if err != nil {
+		log.Println("replication from", peer.Peer, err)
+		peer.LastError = err.Error()
+		if errors.Is(err, errTokenRejected) {
+			// the next pull starts over with the full snapshot
+			peer.Token = ""
+			if err = r.writeData(); err != nil {
+				log.Println(err)
+			}
+		}
+		return
+	}
+	changed := peer.Token != token
+	peer.Token = token
+	peer.LastPull = time.Now()
+	peer.LastError = ""
+	if changed {
+		// the changes were applied already, so they are only pulled again when the file can't be written
+		if err = r.writeData(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// fetch pulls the changes after the token and applies them in order
+func (r *Replicator) fetch(ctx context.Context, peer, token string) (int, int, string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", peer+"/v1/changes?since="+url.QueryEscape(token), nil)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	// the pull continues the trace of the caller on the peer
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusBadRequest && token != "" {
+		return 0, 0, "", fmt.Errorf("%w: peer responded with %s", errTokenRejected, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, "", fmt.Errorf("peer responded with %s", resp.Status)
+	}
+
+	var f feed
+	if err = json.NewDecoder(resp.Body).Decode(&f); err != nil {
+		return 0, 0, "", err
+	}
+
+	var applied, skipped int
+	for _, change := range f.Changes {
+		ok, err := r.target.Apply(ctx, change)
+		if err != nil {
+			// the token isn't moved, so the rest is pulled again next time
+			return applied, skipped, "", err
+		}
+		if ok {
+			applied++
+		} else {
+			skipped++
+		}
+	}
+	return applied, skipped, f.Token, nil
+}
+
+// Start runs the replication loop in the background
+func (r *Replicator) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.Sync(ctx)
+			}
+		}
+	}()
+}
+
+// Close stops the replication loop, cancels the current pull and waits for it to finish
+func (r *Replicator) Close() error {
+	if r.cancel == nil {
+		return nil
+	}
+	r.cancel()
+	<-r.done
+	r.cancel = nil
+	return nil
+}
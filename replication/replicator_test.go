@@ -0,0 +1,201 @@
+package replication_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ssOlexBaiko/library/api/web"
+	"github.com/ssOlexBaiko/library/replication"
+	"github.com/ssOlexBaiko/library/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// instance is the library served by the in-process server
+type instance struct {
+	library interface {
+		web.Storage
+		Apply(ctx context.Context, change storage.Change) (bool, error)
+	}
+	server *httptest.Server
+}
+
+func newInstance(t *testing.T, node string) *instance {
+	dir, err := ioutil.TempDir("", "replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "storage.json")
+	if err = ioutil.WriteFile(path, []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	library := storage.NewLibrary(path, false)
+	library.SetNode(node)
+	server := httptest.NewServer(web.NewRouter(web.NewHandler(library)))
+	t.Cleanup(server.Close)
+
+	return &instance{library: library, server: server}
+}
+
+// newReplicator returns the replicator which keeps its sync tokens in the file of the given name in the temporary directory
+func newReplicator(t *testing.T, target *instance, peer *instance, dir, name string) *replication.Replicator {
+	r, err := replication.NewReplicator(target.library, []string{peer.server.URL}, time.Hour, filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "replicator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func onlyBook(t *testing.T, i *instance) storage.Book {
+	ctx := context.Background()
+	books, err := i.library.GetBooks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(books) != 1 {
+		t.Fatalf("expected a single book, got %d", len(books))
+	}
+	return books[0]
+}
+
+func TestTwoWayReplication(t *testing.T) {
+	test := assert.New(t)
+	ctx := context.Background()
+
+	a := newInstance(t, "a")
+	b := newInstance(t, "b")
+	dir := tempDir(t)
+	fromB := newReplicator(t, a, b, dir, "a.json")
+	fromA := newReplicator(t, b, a, dir, "b.json")
+	sync := func() {
+		fromA.Sync(ctx)
+		fromB.Sync(ctx)
+		fromA.Sync(ctx)
+	}
+
+	_, err := a.library.CreateBook(ctx, storage.Book{Title: "Book", Genres: []string{"adventure"}, Pages: 100, Price: storage.MustDecimal("10")})
+	test.NoError(err)
+	sync()
+	book := onlyBook(t, b)
+	test.Equal("Book", book.Title)
+
+	// concurrent changes of different fields are both kept
+	changed := onlyBook(t, a)
+	changed.Title = "Title from A"
+	test.NoError(a.library.ChangeBook(ctx, changed.ID, changed))
+	changed = onlyBook(t, b)
+	changed.Price = storage.MustDecimal("42")
+	test.NoError(b.library.ChangeBook(ctx, changed.ID, changed))
+	sync()
+	test.Equal(onlyBook(t, a), onlyBook(t, b))
+	test.Equal("Title from A", onlyBook(t, a).Title)
+	test.Equal("42", onlyBook(t, a).Price.String())
+
+	// concurrent changes of the same field end up with the same winner on both sides
+	changed = onlyBook(t, a)
+	changed.Pages = 1
+	test.NoError(a.library.ChangeBook(ctx, changed.ID, changed))
+	changed = onlyBook(t, b)
+	changed.Pages = 2
+	test.NoError(b.library.ChangeBook(ctx, changed.ID, changed))
+	sync()
+	test.Equal(onlyBook(t, a), onlyBook(t, b))
+
+	// removal is replicated as a tombstone
+	test.NoError(b.library.RemoveBook(ctx, book.ID))
+	sync()
+	books, err := a.library.GetBooks(ctx)
+	test.NoError(err)
+	test.Empty(books)
+
+	status := fromA.Status()
+	if test.Len(status, 1) {
+		test.Equal(a.server.URL, status[0].Peer)
+		test.Empty(status[0].LastError)
+		test.NotEmpty(status[0].Token)
+		test.True(status[0].Applied > 0)
+	}
+}
+
+func TestReplicationAfterRestart(t *testing.T) {
+	test := assert.New(t)
+	ctx := context.Background()
+
+	a := newInstance(t, "a")
+	b := newInstance(t, "b")
+	c := newInstance(t, "c")
+	dir := tempDir(t)
+
+	emma, err := a.library.CreateBook(ctx, storage.Book{Title: "Emma", Genres: []string{"novel"}, Pages: 300, Price: storage.MustDecimal("12")})
+	test.NoError(err)
+	dune, err := a.library.CreateBook(ctx, storage.Book{Title: "Dune", Genres: []string{"sci-fi"}, Pages: 400, Price: storage.MustDecimal("10")})
+	test.NoError(err)
+	newReplicator(t, b, a, dir, "b.json").Sync(ctx)
+	newReplicator(t, c, a, dir, "c.json").Sync(ctx)
+	test.NoError(a.library.RemoveBook(ctx, dune.ID))
+
+	// the restarted replicator continues from its token, so only the deletion is pulled
+	fromA := newReplicator(t, b, a, dir, "b.json")
+	status := fromA.Status()
+	if test.Len(status, 1) {
+		test.NotEmpty(status[0].Token, "the token is read from the file")
+	}
+	fromA.Sync(ctx)
+	status = fromA.Status()
+	if test.Len(status, 1) {
+		test.Empty(status[0].LastError)
+		test.Equal(1, status[0].Applied)
+		test.Zero(status[0].Skipped)
+	}
+	test.Equal(emma.ID, onlyBook(t, b).ID)
+
+	// the replicator which lost its token gets the tombstone with the full snapshot
+	os.Remove(filepath.Join(dir, "c.json"))
+	newReplicator(t, c, a, dir, "c.json").Sync(ctx)
+	test.Equal(emma.ID, onlyBook(t, c).ID)
+}
+
+func TestSnapshotFieldClocks(t *testing.T) {
+	test := assert.New(t)
+	ctx := context.Background()
+
+	// the node names make the concurrent change of the other node older at the same clock
+	source := newInstance(t, "n2")
+	other := newInstance(t, "n1")
+	fresh := newInstance(t, "n3")
+	dir := tempDir(t)
+
+	_, err := source.library.CreateBook(ctx, storage.Book{Title: "Book", Genres: []string{"novel"}, Pages: 100, Price: storage.MustDecimal("10")})
+	test.NoError(err)
+	newReplicator(t, other, source, dir, "other.json").Sync(ctx)
+
+	changed := onlyBook(t, source)
+	changed.Title = "Title from the source"
+	test.NoError(source.library.ChangeBook(ctx, changed.ID, changed))
+	changed = onlyBook(t, other)
+	changed.Price = storage.MustDecimal("42")
+	test.NoError(other.library.ChangeBook(ctx, changed.ID, changed))
+
+	// the snapshot keeps the price at the clock of the creation, so the later price change wins
+	newReplicator(t, fresh, source, dir, "fresh.json").Sync(ctx)
+	newReplicator(t, fresh, other, dir, "fresh-other.json").Sync(ctx)
+	book := onlyBook(t, fresh)
+	test.Equal("Title from the source", book.Title)
+	test.Equal("42", book.Price.String())
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Kinds of the batch operations
+const (
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// ErrRolledBack describe the operation which wasn't applied because another operation of the batch failed
+var ErrRolledBack = errors.New("rolled back, another operation of the batch failed")
+
+// Operation is a single change of the batch.
+// ID is ignored by create, Book is ignored by delete and update replaces all the fields with it.
+type Operation struct {
+	Op   string `json:"op"`
+	ID   string `json:"id,omitempty"`
+	Book Book   `json:"book"`
+}
+
+// OperationResult is the outcome of the operation of the batch.
+// Book is the stored book of create and update and the removed one of delete.
+type OperationResult struct {
+	Op   string
+	ID   string
+	Book *Book
+	Err  error
+}
+
+// AbortBatch returns the results of the batch in which the operation with the index failed with err,
+// the other operations are rolled back
+func AbortBatch(ops []Operation, failed int, err error) []OperationResult {
+	results := make([]OperationResult, len(ops))
+	for i, op := range ops {
+		results[i] = OperationResult{Op: op.Op, ID: op.ID, Err: ErrRolledBack}
+	}
+	results[failed].Err = err
+	return results
+}
+
+// Batch applies the operations in one transaction, so either all of them are applied or none.
+// Operations see the changes of the previous ones. When an operation fails,
+// its result carries the error, the others ErrRolledBack, and the error is returned as well.
+func (l *library) Batch(ctx context.Context, ops []Operation) ([]OperationResult, error) {
+	defer l.observe("Batch", time.Now())
+	if l.useSql {
+		if l.isClosed() {
+			return nil, ErrClosed
+		}
+		// Connection to the database
+		db, err := InitDB(l.dsn)
+		if err != nil {
+			return nil, err
+		}
+		// Close connection database
+		defer db.Close()
+
+		tx := begin(ctx, db)
+		results := make([]OperationResult, len(ops))
+		for i, op := range ops {
+			var book Book
+			switch op.Op {
+			case OpCreate:
+				book, err = l.sqlCreate(tx, op.Book)
+			case OpUpdate:
+				book, err = l.sqlUpdate(tx, op.ID, op.Book)
+			case OpDelete:
+				book, err = l.sqlRemove(tx, op.ID)
+			default:
+				err = fmt.Errorf("%w: unknown operation %q", ErrInvalid, op.Op)
+			}
+			if err != nil {
+				tx.Rollback()
+				return AbortBatch(ops, i, err), err
+			}
+			results[i] = OperationResult{Op: op.Op, ID: book.ID, Book: &book}
+		}
+		if err = tx.Commit().Error; err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			l.notify(operationEvents[result.Op], *result.Book)
+		}
+		return results, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tx, err := l.beginJSON(ctx)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]OperationResult, len(ops))
+	for i, op := range ops {
+		var book Book
+		switch op.Op {
+		case OpCreate:
+			book, err = tx.create(op.Book)
+		case OpUpdate:
+			book, err = tx.update(op.ID, op.Book)
+		case OpDelete:
+			book, err = tx.remove(op.ID)
+		default:
+			err = fmt.Errorf("%w: unknown operation %q", ErrInvalid, op.Op)
+		}
+		if err != nil {
+			return AbortBatch(ops, i, err), err
+		}
+		results[i] = OperationResult{Op: op.Op, ID: book.ID, Book: &book}
+	}
+	if err = tx.commit(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// operationEvents are the events of the batch operations
+var operationEvents = map[string]string{
+	OpCreate: EventBookCreated,
+	OpUpdate: EventBookUpdated,
+	OpDelete: EventBookDeleted,
+}
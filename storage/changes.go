@@ -0,0 +1,345 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrInvalidSince describe the sequence number which is ahead of the change log
+	ErrInvalidSince = errors.New("sequence number is ahead of the change log")
+)
+
+// FullSync is the since of Changes which returns all the current books instead of the logged changes.
+// Zero isn't used for that, because it's the sequence number of the empty change log as well.
+const FullSync uint64 = math.MaxUint64
+
+// Change describes a single entry of the change log.
+// Book is empty for the deleted books, so the entry works as a tombstone.
+// Clock and Node are the Lamport timestamp of the change and the instance where it was made,
+// Fields lists the fields of the book which were set by the change.
+type Change struct {
+	Seq    uint64         `gorm:"primary_key" json:"seq"`
+	Type   string         `gorm:"type:varchar(32)" json:"type"`
+	BookID string         `gorm:"type:varchar(100);index" json:"book_id"`
+	Book   *Book          `gorm:"-" json:"book,omitempty"`
+	Data   string         `gorm:"type:text" json:"-"`
+	Time   time.Time      `json:"time"`
+	Clock  uint64         `json:"clock"`
+	Node   string         `gorm:"type:varchar(100)" json:"node"`
+	Fields pq.StringArray `gorm:"type:varchar(64)" json:"fields"`
+}
+
+// Changes contains change objects
+type Changes []Change
+
+// newChange returns the local change of the book, it's stamped by the clock when it's recorded
+func newChange(eventType string, book Book, fields []string) Change {
+	change := Change{
+		Type:   eventType,
+		BookID: book.ID,
+		Time:   time.Now().UTC(),
+		Fields: fields,
+	}
+	if eventType != EventBookDeleted {
+		change.Book = &book
+	}
+	return change
+}
+
+// changesPath returns path of the change log file kept next to the json storage
+func (l *library) changesPath() (string, error) {
+	return filepath.Abs(l.storage + ".changes")
+}
+
+func (l *library) readChanges() (Changes, error) {
+	path, err := l.changesPath()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var changes Changes
+	return changes, json.Unmarshal(file, &changes)
+}
+
+// recordSqlChange saves the change and the price it sets in the sql transaction like jsonTx.record does for the json storage
+func (l *library) recordSqlChange(tx *gorm.DB, change Change) error {
+	if change.Node == "" {
+		var last Change
+		err := tx.Order("clock desc").First(&last).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return err
+		}
+		change.Clock = last.Clock + 1
+		change.Node = l.node
+	}
+
+	if change.Book != nil {
+		data, err := json.Marshal(change.Book)
+		if err != nil {
+			return err
+		}
+		change.Data = string(data)
+	}
+	if err := tx.Create(&change).Error; err != nil {
+		return err
+	}
+	return recordSqlPrice(tx, change)
+}
+
+func lastSeq(changes Changes) uint64 {
+	if len(changes) == 0 {
+		return 0
+	}
+	return changes[len(changes)-1].Seq
+}
+
+func maxClock(changes Changes) uint64 {
+	var clock uint64
+	for _, change := range changes {
+		if change.Clock > clock {
+			clock = change.Clock
+		}
+	}
+	return clock
+}
+
+// snapshot returns the current books and the tombstones of the deleted ones, it's the starting point of the sync.
+// Every book is returned as a change per clock its fields were set at, oldest first, so the peer gets
+// the clocks of the single fields and not only the latest one. The fields older than the change log get zero clock.
+func (l *library) snapshot(books Books, history Changes) Changes {
+	byBook := map[string]Changes{}
+	var deleted []string
+	for _, change := range history {
+		byBook[change.BookID] = append(byBook[change.BookID], change)
+		if change.Type == EventBookDeleted {
+			deleted = append(deleted, change.BookID)
+		}
+	}
+
+	changes := make(Changes, 0, len(books))
+	present := map[string]bool{}
+	for i := range books {
+		present[books[i].ID] = true
+		changes = append(changes, l.bookSnapshot(&books[i], byBook[books[i].ID])...)
+	}
+
+	// the tombstones keep the peers which have the book from bringing it back
+	for _, id := range deleted {
+		if present[id] {
+			continue
+		}
+		present[id] = true
+		v := newVersions(byBook[id])
+		changes = append(changes, Change{
+			Type:   EventBookDeleted,
+			BookID: id,
+			Time:   changeTime(byBook[id], v.tombstone),
+			Clock:  v.tombstone.Clock,
+			Node:   v.tombstone.Node,
+		})
+	}
+	return changes
+}
+
+// bookSnapshot returns the changes which set the fields of the book at the clocks the history has for them
+func (l *library) bookSnapshot(book *Book, history Changes) Changes {
+	v := newVersions(history)
+	fields := map[version][]string{}
+	var stamps []version
+	for _, field := range bookFields {
+		stamp, ok := v.fields[field]
+		if !ok {
+			stamp = version{Node: l.node}
+		}
+		if _, ok = fields[stamp]; !ok {
+			stamps = append(stamps, stamp)
+		}
+		fields[stamp] = append(fields[stamp], field)
+	}
+	sort.Slice(stamps, func(i, j int) bool { return stamps[j].after(stamps[i]) })
+
+	changes := make(Changes, 0, len(stamps))
+	for _, stamp := range stamps {
+		changes = append(changes, Change{
+			Type:   EventBookUpdated,
+			BookID: book.ID,
+			Book:   book,
+			Time:   changeTime(history, stamp),
+			Clock:  stamp.Clock,
+			Node:   stamp.Node,
+			Fields: fields[stamp],
+		})
+	}
+	// the oldest change creates the book on the peer which doesn't have it
+	changes[0].Type = EventBookCreated
+	return changes
+}
+
+// changeTime returns the time of the change made at the version, it's zero for the fields older than the change log
+func changeTime(history Changes, stamp version) time.Time {
+	for _, change := range history {
+		if change.Clock == stamp.Clock && change.Node == stamp.Node {
+			return change.Time
+		}
+	}
+	return time.Time{}
+}
+
+// Changes returns the changes made after the given sequence number in order
+// together with the sequence number of the last change.
+// When since is FullSync all the current books are returned as created.
+func (l *library) Changes(ctx context.Context, since uint64) (Changes, uint64, error) {
+	defer l.observe("Changes", time.Now())
+	if l.useSql {
+		// Connection to the database
+		db, err := InitDB(l.dsn)
+		if err != nil {
+			return nil, 0, err
+		}
+		// Close connection database
+		defer db.Close()
+
+		tx := begin(ctx, db)
+		defer tx.Rollback()
+
+		var last Change
+		err = tx.Order("seq desc").First(&last).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return nil, 0, err
+		}
+		full := since == FullSync
+		if full {
+			since = 0
+		}
+		if since > last.Seq {
+			return nil, 0, ErrInvalidSince
+		}
+
+		var changes Changes
+		if err = tx.Where("seq > ?", since).Order("seq").Find(&changes).Error; err != nil {
+			return nil, 0, err
+		}
+		if err = decodeBooks(changes); err != nil {
+			return nil, 0, err
+		}
+
+		if full {
+			var books Books
+			if err = tx.Find(&books).Error; err != nil {
+				return nil, 0, err
+			}
+			return l.snapshot(books, changes), last.Seq, nil
+		}
+		return changes, last.Seq, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	state, err := l.viewJSON()
+	if err != nil {
+		return nil, 0, err
+	}
+	changes := state.changes
+	last := lastSeq(changes)
+	if since == FullSync {
+		// the snapshot points to the books, so it gets their copies
+		return l.snapshot(copyBooks(state.books), changes), last, nil
+	}
+	if since > last {
+		return nil, 0, ErrInvalidSince
+	}
+
+	var wanted Changes
+	for _, change := range changes {
+		if change.Seq > since {
+			wanted = append(wanted, change)
+		}
+	}
+	return wanted, last, nil
+}
+
+// decodeBooks fills books of the changes read from the sql table
+func decodeBooks(changes Changes) error {
+	for i := range changes {
+		if changes[i].Data == "" {
+			continue
+		}
+		var book Book
+		if err := json.Unmarshal([]byte(changes[i].Data), &book); err != nil {
+			return err
+		}
+		changes[i].Book = &book
+	}
+	return nil
+}
+
+// Version returns the sequence number and the time of the last change of the catalog.
+// It's used for checking whether the catalog has changed since the client has seen it.
+func (l *library) Version(ctx context.Context) (uint64, time.Time, error) {
+	defer l.observe("Version", time.Now())
+	if l.useSql {
+		// Connection to the database
+		db, err := InitDB(l.dsn)
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		// Close connection database
+		defer db.Close()
+
+		tx := begin(ctx, db)
+		defer tx.Rollback()
+
+		var last Change
+		err = tx.Order("seq desc").First(&last).Error
+		if err != nil && !gorm.IsRecordNotFoundError(err) {
+			return 0, time.Time{}, err
+		}
+		return last.Seq, last.Time, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	state, err := l.viewJSON()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if changes := state.changes; len(changes) > 0 {
+		last := changes[len(changes)-1]
+		return last.Seq, last.Time, nil
+	}
+
+	// the catalog hasn't been changed by the library yet, so the file itself tells the time
+	path, err := filepath.Abs(l.storage)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return 0, info.ModTime().UTC(), nil
+}
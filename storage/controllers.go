@@ -1,24 +1,47 @@
 package storage
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
-	"io/ioutil"
-	"path/filepath"
-	"strconv"
-
-	"github.com/twinj/uuid"
+	"fmt"
+	"os"
+	"sync"
+	"time"
 )
 
 var (
 	// ErrNotFound describe the state when the object is not found in the storage
 	ErrNotFound = errors.New("can't find the book with given ID")
+	// ErrInvalid describe the data which is rejected before it reaches the storage
+	ErrInvalid = errors.New("invalid data")
+	// ErrClosed describe the change which came after the library was closed
+	ErrClosed = errors.New("library is closed")
 )
 
 type library struct {
 	storage string
 	//storage io.ReadWriteCloser // Here you can put opened os.File object. After that you will be able to implement concurrent safe operations with file storage
 	useSql bool
+	// dsn is the data source name of the sql database
+	dsn string
+	// node identifies this library among the replicated ones
+	node string
+	// converter converts the prices for the filters with the currency
+	converter Converter
+	// compactAfter is the number of the journal records which are written into the snapshot files at once
+	compactAfter int
+	// fs writes the journal and the snapshot files of the json storage
+	fs fileSystem
+	// state is the json storage with the journal replayed, it's read at the first use
+	// and kept by the commits, so the files are read again only after the compaction
+	state *jsonState
+	// lock is the open lock file of the json storage, see acquire
+	lock *os.File
+
+	// mu serializes changes of the json storage and its change log
+	mu        sync.Mutex
+	closed    bool
+	listeners []func(Event)
 }
 
 // NewLibrary constructor for library struct.
@@ -26,23 +49,71 @@ type library struct {
 // or when you need some data preparation
 // or when you want to start some watchers (goroutines). In this case you also have to think about Close() method.
 func NewLibrary(pathToStorage string, useSql bool) *library {
+	node, err := os.Hostname()
+	if err != nil {
+		node = "library"
+	}
 	return &library{
 		storage: pathToStorage,
 		useSql:  useSql,
+		dsn:     "storage/data.db",
+		node:    node,
+
+		compactAfter: defaultCompactAfter,
+		fs:           osFS{},
 	}
 }
 
-func (l *library) writeData(books Books) error {
-	path, err := filepath.Abs(l.storage)
-	if err != nil {
-		return err
+// SetDSN sets the data source name of the sql database, it's storage/data.db by default
+func (l *library) SetDSN(dsn string) {
+	l.dsn = dsn
+}
+
+// SetNode sets the name of the library used by the replication, it's the host name by default.
+// Every replicated library needs its own name.
+func (l *library) SetNode(node string) {
+	l.node = node
+}
+
+// SetConverter sets the exchange rates the prices are converted at by the filters with the currency
+func (l *library) SetConverter(converter Converter) {
+	l.converter = converter
+}
+
+// Close waits for the change in progress and makes the library refuse the next changes,
+// the journal of the json storage is compacted, so the next start doesn't have to replay it.
+// The sql connections are opened per call, so there is nothing else to release.
+func (l *library) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.useSql {
+		return nil
 	}
 
-	booksBytes, err := json.MarshalIndent(books, "", "    ")
-	if err != nil {
-		return err
+	state, err := l.viewJSON()
+	if err == nil && state.entries > 0 {
+		err = l.compact(*state)
+	}
+	if releaseErr := l.release(); err == nil {
+		err = releaseErr
 	}
-	return ioutil.WriteFile(path, booksBytes, 0644)
+	return err
+}
+
+func (l *library) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// writable checks that the json storage can be changed, it has to be called with the lock held.
+// The caller might have given up while waiting for the lock.
+func (l *library) writable(ctx context.Context) error {
+	if l.closed {
+		return ErrClosed
+	}
+	return ctx.Err()
 }
 
 func (l *library) wantedIndex(id string, books Books) (int, error) {
@@ -55,215 +126,267 @@ func (l *library) wantedIndex(id string, books Books) (int, error) {
 }
 
 //GetBooks returns all book objects
-func (l *library) GetBooks() (Books, error) {
+func (l *library) GetBooks(ctx context.Context) (Books, error) {
+	defer l.observe("GetBooks", time.Now())
 	var books Books
 
 	if l.useSql {
 		// Connection to the database
-		db, err := InitDB()
+		db, err := InitDB(l.dsn)
 		if err != nil {
 			return nil, err
 		}
 		// Close connection database
 		defer db.Close()
+		tx := begin(ctx, db)
+		defer tx.Rollback()
 		// SELECT * FROM books
-		if err = db.Find(&books).Error; err != nil {
+		if err = tx.Find(&books).Error; err != nil {
 			return nil, err
 		}
 
 		return books, nil
 	}
 
-	path, err := filepath.Abs(l.storage)
-	if err != nil {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-
-	file, err := ioutil.ReadFile(path)
+	// the compaction replaces the snapshot files and empties the journal, so they are read together
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state, err := l.viewJSON()
 	if err != nil {
 		return nil, err
 	}
-
-	return books, json.Unmarshal(file, &books)
+	return copyBooks(state.books), nil
 }
 
-// CreateBook adds book object into db
-func (l *library) CreateBook(book Book) error {
-	err := errors.New("not all fields are populated")
+// checkFields rejects the book which misses any of the fields
+func checkFields(book Book) error {
+	err := fmt.Errorf("%w: not all fields are populated", ErrInvalid)
 	switch {
 	case book.Genres == nil:
 		return err
 	case book.Pages == 0:
 		return err
-	case book.Price == 0:
+	case book.Price.IsZero():
 		return err
 	case book.Title == "":
 		return err
 	}
+	return nil
+}
+
+// checkNewBook rejects the book which misses any of the fields or has an invalid price,
+// the book without the currency gets DefaultCurrency
+func checkNewBook(book Book) (Book, error) {
+	if err := checkFields(book); err != nil {
+		return Book{}, err
+	}
+	book.Currency = book.Money().Currency
+	return book, CheckPrice(book.Money())
+}
+
+// checkChangedBook keeps the currency of the book when the change has none
+// and rejects the invalid price, the price which isn't changed isn't checked
+func checkChangedBook(old, changed Book) (Book, error) {
+	if changed.Currency == "" {
+		changed.Currency = old.Currency
+	}
+	if changed.Money() == old.Money() {
+		return changed, nil
+	}
+	changed.Currency = changed.Money().Currency
+	return changed, CheckPrice(changed.Money())
+}
 
-	book.ID = uuid.NewV4().String()
+// CreateBook adds book object into db and returns it with the generated ID
+func (l *library) CreateBook(ctx context.Context, book Book) (Book, error) {
+	defer l.observe("CreateBook", time.Now())
 	if l.useSql {
+		if l.isClosed() {
+			return Book{}, ErrClosed
+		}
 		// Connection to the database
-		db, err := InitDB()
+		db, err := InitDB(l.dsn)
 		if err != nil {
-			return err
+			return Book{}, err
 		}
 		// Close connection database
 		defer db.Close()
 
-		return db.Create(&book).Error
+		tx := begin(ctx, db)
+		created, err := l.sqlCreate(tx, book)
+		if err != nil {
+			tx.Rollback()
+			return Book{}, err
+		}
+		if err = tx.Commit().Error; err != nil {
+			return Book{}, err
+		}
+		l.notify(EventBookCreated, created)
+		return created, nil
 	}
 
-	books, err := l.GetBooks()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tx, err := l.beginJSON(ctx)
 	if err != nil {
-		return err
+		return Book{}, err
 	}
-
-	books = append(books, book)
-	return l.writeData(books)
+	created, err := tx.create(book)
+	if err != nil {
+		return Book{}, err
+	}
+	return created, tx.commit()
 }
 
 // GetBook returns book object with specified id
-func (l *library) GetBook(id string) (Book, error) {
+func (l *library) GetBook(ctx context.Context, id string) (Book, error) {
+	defer l.observe("GetBook", time.Now())
 	var b Book
 	if l.useSql {
 		// Connection to the database
-		db, err := InitDB()
+		db, err := InitDB(l.dsn)
 		if err != nil {
 			return b, err
 		}
 		// Close connection database
 		defer db.Close()
 
-		if err = db.Where("id = ?", id).First(&b).Error; err != nil {
-			return b, err
-		}
-
-		return b, nil
+		tx := begin(ctx, db)
+		defer tx.Rollback()
+		return sqlFind(tx, id)
 	}
 
-	books, err := l.GetBooks()
+	if err := ctx.Err(); err != nil {
+		return b, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	state, err := l.viewJSON()
 	if err != nil {
 		return b, err
 	}
 
-	for _, book := range books {
+	for _, book := range state.books {
 		if id == book.ID {
-			return book, nil
+			return copyBooks(Books{book})[0], nil
 		}
 	}
 	return b, ErrNotFound
 }
 
 // RemoveBook removes book object with specified id
-func (l *library) RemoveBook(id string) error {
+func (l *library) RemoveBook(ctx context.Context, id string) error {
+	defer l.observe("RemoveBook", time.Now())
 	if l.useSql {
-		var book Book
+		if l.isClosed() {
+			return ErrClosed
+		}
 		// Connection to the database
-		db, err := InitDB()
+		db, err := InitDB(l.dsn)
 		if err != nil {
 			return err
 		}
 		// Close connection database
 		defer db.Close()
-		if err = db.Where("id = ?", id).First(&book).Error; err != nil {
+		tx := begin(ctx, db)
+		book, err := l.sqlRemove(tx, id)
+		if err != nil {
+			tx.Rollback()
 			return err
 		}
-
-		if err = db.Delete(&book).Error; err != nil {
+		if err = tx.Commit().Error; err != nil {
 			return err
 		}
 
+		l.notify(EventBookDeleted, book)
 		return nil
 	}
 
-	books, err := l.GetBooks()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tx, err := l.beginJSON(ctx)
 	if err != nil {
 		return err
 	}
-
-	index, err := l.wantedIndex(id, books)
-	if err != nil {
+	if _, err = tx.remove(id); err != nil {
 		return err
 	}
-	books = append(books[:index], books[index+1:]...)
-	return l.writeData(books)
+	return tx.commit()
 }
 
 // ChangeBook updates book object with specified id
-func (l *library) ChangeBook(id string, changedBook Book) error {
+func (l *library) ChangeBook(ctx context.Context, id string, changedBook Book) error {
+	defer l.observe("ChangeBook", time.Now())
 	if l.useSql {
-		var book Book
+		if l.isClosed() {
+			return ErrClosed
+		}
 		// Connection to the database
-		db, err := InitDB()
+		db, err := InitDB(l.dsn)
 		if err != nil {
 			return err
 		}
 		// Close connection database
 		defer db.Close()
-		if err = db.Where("id = ?", id).First(&book).Error; err != nil {
+		tx := begin(ctx, db)
+		book, err := l.sqlUpdate(tx, id, changedBook)
+		if err != nil {
+			tx.Rollback()
 			return err
 		}
-		if err = db.Save(&changedBook).Error; err != nil {
+		if err = tx.Commit().Error; err != nil {
 			return err
 		}
+		l.notify(EventBookUpdated, book)
 		return nil
 	}
 
-	books, err := l.GetBooks()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tx, err := l.beginJSON(ctx)
 	if err != nil {
 		return err
 	}
-
-	index, err := l.wantedIndex(id, books)
-	if err != nil {
+	if _, err = tx.update(id, changedBook); err != nil {
 		return err
 	}
-
-	book := &books[index]
-	book.Price = changedBook.Price
-	book.Title = changedBook.Title
-	book.Pages = changedBook.Pages
-	book.Genres = changedBook.Genres
-	err = l.writeData(books)
-	return err
+	return tx.commit()
 }
 
 // PriceFilter returns filtered book objects
-func (l *library) PriceFilter(filter BookFilter) (Books, error) {
+func (l *library) PriceFilter(ctx context.Context, filter BookFilter) (Books, error) {
+	defer l.observe("PriceFilter", time.Now())
 	var wantedBooks Books
 
 	if l.useSql {
 		return wantedBooks, errors.New("NotImplemented")
 	}
-	if len(filter.Price) <= 1 {
-		return nil, errors.New("Not valid data")
-	}
-	operator := string(filter.Price[0])
-	if operator != "<" && operator != ">" {
-		err := errors.New("unsupported operation")
+	if err := filter.Validate(); err != nil {
 		return nil, err
 	}
-
-	books, err := l.GetBooks()
+	operator, price, err := filter.parse()
 	if err != nil {
 		return nil, err
 	}
 
-	price, err := strconv.ParseFloat(filter.Price[1:], 64)
+	books, err := l.GetBooks(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	for _, book := range books {
-		if operator == ">" {
-			if book.Price > price {
-				wantedBooks = append(wantedBooks, book)
-			}
-		} else {
-			if book.Price < price {
-				wantedBooks = append(wantedBooks, book)
-			}
+		matched, err := filter.match(operator, price, book, l.converter)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			wantedBooks = append(wantedBooks, book)
 		}
 	}
 	return wantedBooks, nil
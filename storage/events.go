@@ -0,0 +1,34 @@
+package storage
+
+import "time"
+
+// Types of the catalog events
+const (
+	EventBookCreated = "book.created"
+	EventBookUpdated = "book.updated"
+	EventBookDeleted = "book.deleted"
+)
+
+// Event describes a change of the catalog made by the library
+type Event struct {
+	Type string    `json:"type"`
+	Book Book      `json:"book"`
+	Time time.Time `json:"time"`
+}
+
+// OnChange registers the listener which is called after every successful change of the catalog.
+// Listeners have to be registered before the library is used and mustn't block.
+func (l *library) OnChange(listener func(Event)) {
+	l.listeners = append(l.listeners, listener)
+}
+
+func (l *library) notify(eventType string, book Book) {
+	event := Event{
+		Type: eventType,
+		Book: book,
+		Time: time.Now().UTC(),
+	}
+	for _, listener := range l.listeners {
+		listener(event)
+	}
+}
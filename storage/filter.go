@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Converter converts the prices into the other currency, e.g. at the rates of the exchange-rate table
+type Converter interface {
+	Convert(price Money, currency string) (Money, error)
+}
+
+// parse splits the price filter into the operator and the price,
+// the empty operator means the filter doesn't care about the price
+func (f BookFilter) parse() (string, Decimal, error) {
+	if f.Price == "" && f.Genre != "" {
+		return "", Decimal{}, nil
+	}
+	if len(f.Price) <= 1 {
+		return "", Decimal{}, fmt.Errorf("%w: filter needs an operator and a price", ErrInvalid)
+	}
+	operator := string(f.Price[0])
+	if operator != "<" && operator != ">" {
+		return "", Decimal{}, fmt.Errorf("%w: unsupported operation %q", ErrInvalid, operator)
+	}
+
+	price, err := ParseDecimal(f.Price[1:])
+	if err != nil {
+		return "", Decimal{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return operator, price, nil
+}
+
+// Validate checks the filter without matching any book
+func (f BookFilter) Validate() error {
+	if _, _, err := f.parse(); err != nil {
+		return err
+	}
+	if _, ok := CurrencyPlaces(f.Currency); f.Currency != "" && !ok {
+		return fmt.Errorf("%w: unknown currency %q", ErrInvalid, f.Currency)
+	}
+	return nil
+}
+
+// Match reports whether the book passes the filter.
+// The price of the filter with the currency is compared only with the books of that currency,
+// the other ones need the converter of the library.
+func (f BookFilter) Match(book Book) (bool, error) {
+	operator, price, err := f.parse()
+	if err != nil {
+		return false, err
+	}
+	return f.match(operator, price, book, nil)
+}
+
+// Key identifies the filter, the filters with the same key match the same books
+func (f BookFilter) Key() string {
+	key := f.Price
+	if f.Genre != "" {
+		key += "\x00" + strings.ToLower(f.Genre)
+	}
+	if f.Currency != "" {
+		key += "\x00" + f.Currency
+	}
+	return key
+}
+
+// match compares the price of the book converted into the currency of the filter when it has one,
+// without the currency the amounts are compared as they are
+func (f BookFilter) match(operator string, price Decimal, book Book, converter Converter) (bool, error) {
+	if f.Genre != "" && !hasGenre(book, f.Genre) {
+		return false, nil
+	}
+	if operator == "" {
+		return true, nil
+	}
+
+	amount := book.Price
+	if f.Currency != "" && book.Money().Currency != f.Currency {
+		if converter == nil {
+			return false, fmt.Errorf("%w: no exchange rates to compare the %s price of book %s", ErrInvalid, book.Money().Currency, book.ID)
+		}
+		converted, err := converter.Convert(book.Money(), f.Currency)
+		if err != nil {
+			return false, fmt.Errorf("%w: book %s: %v", ErrInvalid, book.ID, err)
+		}
+		amount = converted.Amount
+	}
+
+	switch operator {
+	case ">":
+		return amount.Cmp(price) > 0, nil
+	case "<":
+		return amount.Cmp(price) < 0, nil
+	}
+	return true, nil
+}
+
+func hasGenre(book Book, genre string) bool {
+	for _, g := range book.Genres {
+		if strings.EqualFold(g, genre) {
+			return true
+		}
+	}
+	return false
+}
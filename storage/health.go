@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Check describes a single readiness probe of the storage backend
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Checks returns the readiness probes for the backend in use
+func (l *library) Checks() []Check {
+	if l.useSql {
+		return []Check{
+			{"sql_query", l.checkQuery},
+			{"sql_migrations", l.checkMigrations},
+		}
+	}
+	return []Check{
+		{"file_readable", l.checkReadable},
+		{"file_writable", l.checkWritable},
+	}
+}
+
+func (l *library) checkReadable(_ context.Context) error {
+	path, err := filepath.Abs(l.storage)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func (l *library) checkWritable(_ context.Context) error {
+	path, err := filepath.Abs(l.storage)
+	if err != nil {
+		return err
+	}
+
+	// open without O_TRUNC so the data stays untouched
+	file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func (l *library) checkQuery(ctx context.Context) error {
+	db, err := openDB(l.dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.DB().ExecContext(ctx, "SELECT 1")
+	return err
+}
+
+func (l *library) checkMigrations(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db, err := openDB(l.dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, model := range []interface{}{&Book{}, &Change{}} {
+		scope := db.NewScope(model)
+		table := scope.TableName()
+		if !db.HasTable(table) {
+			return fmt.Errorf("table %q doesn't exist", table)
+		}
+		for _, field := range scope.Fields() {
+			if field.IsIgnored {
+				continue
+			}
+			if !db.Dialect().HasColumn(table, field.DBName) {
+				return fmt.Errorf("column %q doesn't exist in table %q", field.DBName, table)
+			}
+		}
+	}
+	return nil
+}
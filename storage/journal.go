@@ -0,0 +1,436 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// defaultCompactAfter is the number of the journal records after which the json storage is compacted
+const defaultCompactAfter = 100
+
+// fileSystem is what the journal and the snapshot files are written through
+type fileSystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (writableFile, error)
+	Rename(oldpath, newpath string) error
+}
+
+// writableFile is the part of os.File the journal is written with
+type writableFile interface {
+	io.Writer
+	Truncate(size int64) error
+	Seek(offset int64, whence int) (int64, error)
+	Sync() error
+	Close() error
+}
+
+// osFS is the file system of the operating system
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (writableFile, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// journalEntry is the record of the committed transaction in the write-ahead journal.
+// The changes carry the books they set, so the books, the change log and the price history
+// are rebuilt from them on top of the snapshot files.
+type journalEntry struct {
+	Changes Changes `json:"changes"`
+}
+
+// jsonState is the snapshot files of the json storage with the journal replayed on top of them
+type jsonState struct {
+	books   Books
+	changes Changes
+	prices  PriceRecords
+	// entries and size are the number and the length of the valid records of the journal,
+	// anything after size is the torn record of the crashed commit
+	entries int
+	size    int64
+}
+
+// SetCompaction sets the number of the journal records after which the json storage
+// is written into the snapshot files and the journal starts over, it's 100 by default
+func (l *library) SetCompaction(entries int) {
+	if entries > 0 {
+		l.compactAfter = entries
+	}
+}
+
+// journalPath returns path of the write-ahead journal kept next to the json storage
+func (l *library) journalPath() (string, error) {
+	return filepath.Abs(l.storage + ".wal")
+}
+
+// viewJSON returns the state of the json storage kept by the library, it has to be called with the lock held.
+// The state is read-only, the reads copy only what they return.
+func (l *library) viewJSON() (*jsonState, error) {
+	if err := l.acquire(); err != nil {
+		return nil, err
+	}
+	if l.state == nil {
+		state, err := l.readState()
+		if err != nil {
+			return nil, err
+		}
+		l.state = &state
+	}
+	return l.state, nil
+}
+
+// loadJSON returns the state of the json storage, it has to be called with the lock held.
+// The state is the copy the transaction can change, the books, the changes and the prices are kept by the library.
+func (l *library) loadJSON() (jsonState, error) {
+	view, err := l.viewJSON()
+	if err != nil {
+		return jsonState{}, err
+	}
+
+	state := *view
+	state.books = copyBooks(view.books)
+	// the appends of the caller go to the new arrays
+	state.changes = state.changes[:len(state.changes):len(state.changes)]
+	state.prices = state.prices[:len(state.prices):len(state.prices)]
+	return state, nil
+}
+
+// copyBooks returns the books which don't share the genres with the given ones
+func copyBooks(books Books) Books {
+	copied := make(Books, len(books))
+	for i, book := range books {
+		if book.Genres != nil {
+			book.Genres = append([]string(nil), book.Genres...)
+		}
+		copied[i] = book
+	}
+	return copied
+}
+
+// readState reads the snapshot files and replays the journal
+func (l *library) readState() (jsonState, error) {
+	path, err := filepath.Abs(l.storage)
+	if err != nil {
+		return jsonState{}, err
+	}
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return jsonState{}, err
+	}
+	var state jsonState
+	if err = json.Unmarshal(file, &state.books); err != nil {
+		return jsonState{}, err
+	}
+	if state.changes, err = l.readChanges(); err != nil {
+		return jsonState{}, err
+	}
+	prices, ok, err := l.readPrices()
+	if err != nil {
+		return jsonState{}, err
+	}
+	state.prices = prices
+	if !ok {
+		// the history is kept since the first compaction after the upgrade
+		state.prices = backfillPrices(state.books, state.changes)
+	}
+
+	entries, size, err := l.readJournal()
+	if err != nil {
+		return jsonState{}, err
+	}
+	for _, entry := range entries {
+		state.replay(entry)
+	}
+	state.entries, state.size = len(entries), size
+	return state, nil
+}
+
+// replay applies the journal entry to the state. The compaction might have crashed after some of the
+// snapshot files were written, so the changes and the prices the files already have are skipped
+// and the books are set to what the changes say, which gives the same books when it's done again.
+func (s *jsonState) replay(entry journalEntry) {
+	lastPrice := lastPriceSeq(s.prices)
+	for _, change := range entry.Changes {
+		if change.Seq > lastSeq(s.changes) {
+			s.changes = append(s.changes, change)
+		}
+		if record, ok := priceRecord(change); ok && change.Seq > lastPrice {
+			s.prices = append(s.prices, record)
+		}
+
+		index := -1
+		for i := range s.books {
+			if s.books[i].ID == change.BookID {
+				index = i
+			}
+		}
+		switch {
+		case change.Book == nil && index >= 0:
+			s.books = append(s.books[:index:index], s.books[index+1:]...)
+		case change.Book != nil && index >= 0:
+			s.books[index] = *change.Book
+		case change.Book != nil:
+			s.books = append(s.books, *change.Book)
+		}
+	}
+}
+
+func lastPriceSeq(prices PriceRecords) uint64 {
+	var seq uint64
+	for _, record := range prices {
+		if record.Seq > seq {
+			seq = record.Seq
+		}
+	}
+	return seq
+}
+
+// readJournal returns the valid records of the journal and their length.
+// Every record is a line with the checksum of its entry, the reading stops at the first line
+// which is cut short or doesn't match its checksum, because only the last commit can be torn by a crash.
+func (l *library) readJournal() ([]journalEntry, int64, error) {
+	path, err := l.journalPath()
+	if err != nil {
+		return nil, 0, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var entries []journalEntry
+	var size int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// the record without the line end was being written when the process stopped
+			return entries, size, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		entry, ok := decodeRecord(line)
+		if !ok {
+			return entries, size, nil
+		}
+		entries = append(entries, entry)
+		size += int64(len(line))
+	}
+}
+
+// encodeRecord returns the journal line of the entry, it's the checksum followed by the entry in json
+func encodeRecord(entry journalEntry) ([]byte, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)), nil
+}
+
+func decodeRecord(line []byte) (journalEntry, bool) {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	if len(line) < 10 || line[8] != ' ' {
+		return journalEntry{}, false
+	}
+	var sum uint32
+	if _, err := fmt.Sscanf(string(line[:8]), "%08x", &sum); err != nil {
+		return journalEntry{}, false
+	}
+	data := line[9:]
+	if crc32.ChecksumIEEE(data) != sum {
+		return journalEntry{}, false
+	}
+	var entry journalEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return journalEntry{}, false
+	}
+	return entry, true
+}
+
+// appendJournal writes the entry after the valid records of the journal and waits till it's on the disk,
+// it returns the length of the valid records with the new one.
+// The torn record of the crashed commit is cut off first, so it can't hide the new one from the replay.
+func (l *library) appendJournal(size int64, entry journalEntry) (int64, error) {
+	path, err := l.journalPath()
+	if err != nil {
+		return 0, err
+	}
+	record, err := encodeRecord(entry)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = os.Stat(path)
+	created := os.IsNotExist(err)
+	file, err := l.fs.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	if created {
+		// the new journal has to be found after the crash as well
+		if err = syncDir(path); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = file.Truncate(size); err != nil {
+		return 0, err
+	}
+	if _, err = file.Seek(size, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if _, err = file.Write(record); err != nil {
+		return 0, err
+	}
+	if err = file.Sync(); err != nil {
+		return 0, err
+	}
+	return size + int64(len(record)), nil
+}
+
+// compact writes the state into the snapshot files and empties the journal, the lock has to be held.
+// Every file is replaced at once, the crash between them is repaired by the replay of the journal,
+// which is emptied only when all of them are written. The state kept in memory is read again from the new files.
+func (l *library) compact(state jsonState) error {
+	booksPath, err := filepath.Abs(l.storage)
+	if err != nil {
+		return err
+	}
+	changesPath, err := l.changesPath()
+	if err != nil {
+		return err
+	}
+	pricesPath, err := l.pricesPath()
+	if err != nil {
+		return err
+	}
+	journalPath, err := l.journalPath()
+	if err != nil {
+		return err
+	}
+
+	snapshots := []struct {
+		path string
+		data interface{}
+	}{
+		{pricesPath, state.prices},
+		{changesPath, state.changes},
+		{booksPath, state.books},
+	}
+	for _, snapshot := range snapshots {
+		data, err := json.MarshalIndent(snapshot.data, "", "    ")
+		if err != nil {
+			return err
+		}
+		if err = l.replaceFile(snapshot.path, data); err != nil {
+			return err
+		}
+	}
+	if err = syncDir(booksPath); err != nil {
+		return err
+	}
+
+	file, err := l.fs.OpenFile(journalPath, os.O_WRONLY, 0644)
+	if os.IsNotExist(err) {
+		l.state = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err = file.Truncate(0); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	l.state = nil
+	return nil
+}
+
+// Recover replays the journal left by the crashed process into the snapshot files of the json storage.
+// The first read replays the journal as well, so it's only about starting with the short journal.
+func (l *library) Recover() error {
+	if l.useSql {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// the second library on the same files fails here rather than at its first change
+	if err := l.acquire(); err != nil {
+		return err
+	}
+	path, err := l.journalPath()
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	state, err := l.viewJSON()
+	if err != nil {
+		return err
+	}
+	if state.entries == 0 && !l.journalTorn(state.size) {
+		return nil
+	}
+	return l.compact(*state)
+}
+
+// journalTorn reports whether the journal has anything after its valid records
+func (l *library) journalTorn(size int64) bool {
+	path, err := l.journalPath()
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Size() > size
+}
+
+// replaceFile writes the data aside and renames it over the file, so the file is either old or new
+func (l *library) replaceFile(path string, data []byte) error {
+	tmp, err := writeTemp(path, data)
+	if err != nil {
+		return err
+	}
+	if err = l.fs.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// syncDir makes the created and renamed files of the directory of the path survive the crash
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if err = dir.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errCrash = errors.New("crash")
+
+// crashFS fails at the step of the commit or the compaction, so the files are left like the crashed process leaves them
+type crashFS struct {
+	osFS
+	step string
+}
+
+func (fs crashFS) OpenFile(name string, flag int, perm os.FileMode) (writableFile, error) {
+	file, err := fs.osFS.OpenFile(name, flag, perm)
+	if err != nil || filepath.Ext(name) != ".wal" {
+		return file, err
+	}
+	return crashFile{file, fs.step}, nil
+}
+
+// Rename fails when the snapshot file of the step would be replaced
+func (fs crashFS) Rename(oldpath, newpath string) error {
+	steps := map[string]string{".prices": "compact.prices", ".changes": "compact.changes", ".json": "compact.books"}
+	if steps[filepath.Ext(newpath)] == fs.step {
+		return errCrash
+	}
+	return fs.osFS.Rename(oldpath, newpath)
+}
+
+// crashFile is the journal of crashFS
+type crashFile struct {
+	writableFile
+	step string
+}
+
+func (f crashFile) Write(p []byte) (int, error) {
+	if f.step == "journal.write" {
+		// the crash in the middle of the write leaves a part of the record
+		n, _ := f.writableFile.Write(p[:len(p)/2])
+		return n, errCrash
+	}
+	return f.writableFile.Write(p)
+}
+
+func (f crashFile) Sync() error {
+	if f.step == "journal.sync" {
+		return errCrash
+	}
+	return f.writableFile.Sync()
+}
+
+// Truncate fails when the compaction empties the journal
+func (f crashFile) Truncate(size int64) error {
+	if f.step == "compact.truncate" && size == 0 {
+		return errCrash
+	}
+	return f.writableFile.Truncate(size)
+}
+
+func newTestLibrary(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "storage.json")
+	if err = ioutil.WriteFile(path, []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// crash drops the lock of the library like the end of its process does, nothing else is cleaned up
+func crash(l *library) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.release()
+}
+
+// restart returns the library of the new process on the files left by the previous one
+func restart(t *testing.T, path string) *library {
+	l := NewLibrary(path, false)
+	l.SetCompaction(2)
+	if err := l.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func newBook(title string) Book {
+	return Book{Title: title, Genres: []string{"novel"}, Pages: 100, Price: MustDecimal("9.99")}
+}
+
+func TestJournal(t *testing.T) {
+	test := assert.New(t)
+	ctx := context.Background()
+	path := newTestLibrary(t)
+	l := NewLibrary(path, false)
+
+	emma, err := l.CreateBook(ctx, newBook("Emma"))
+	test.NoError(err)
+	test.NoError(l.ChangeBook(ctx, emma.ID, Book{Price: MustDecimal("12.5")}))
+	dune, err := l.CreateBook(ctx, newBook("Dune"))
+	test.NoError(err)
+	test.NoError(l.RemoveBook(ctx, dune.ID))
+
+	snapshot, err := ioutil.ReadFile(path)
+	test.NoError(err)
+	test.Equal("[]", string(snapshot), "the changes are only appended to the journal")
+	entries, _, err := l.readJournal()
+	test.NoError(err)
+	test.Len(entries, 4)
+
+	// the new process sees the acknowledged changes without the compaction
+	crash(l)
+	l = NewLibrary(path, false)
+	books, err := l.GetBooks(ctx)
+	test.NoError(err)
+	if test.Len(books, 1) {
+		test.Equal("12.5", books[0].Price.String())
+	}
+
+	// the compaction writes the snapshot files and starts the journal over
+	test.NoError(l.Close())
+	entries, size, err := l.readJournal()
+	test.NoError(err)
+	test.Empty(entries)
+	test.Zero(size)
+	reopened := NewLibrary(path, false)
+	after, err := reopened.GetBooks(ctx)
+	test.NoError(err)
+	test.Equal(books, after)
+	changes, last, err := reopened.Changes(ctx, 1)
+	test.NoError(err)
+	test.Equal(uint64(4), last)
+	test.Len(changes, 3)
+	prices, err := reopened.PriceHistory(ctx, emma.ID)
+	test.NoError(err)
+	test.Len(prices, 2)
+}
+
+func TestStateInMemory(t *testing.T) {
+	test := assert.New(t)
+	ctx := context.Background()
+	path := newTestLibrary(t)
+	l := NewLibrary(path, false)
+	l.SetCompaction(2)
+
+	emma, err := l.CreateBook(ctx, newBook("Emma"))
+	test.NoError(err)
+	// the reads don't replay the journal again, so they don't see the snapshot file
+	test.NoError(ioutil.WriteFile(path, []byte("not json"), 0644))
+	books, err := l.GetBooks(ctx)
+	test.NoError(err)
+	if test.Len(books, 1) {
+		// the returned books don't share the genres with the kept ones
+		books[0].Genres[0] = "changed"
+	}
+	book, err := l.GetBook(ctx, emma.ID)
+	test.NoError(err)
+	test.Equal(emma, book)
+
+	// the compaction writes the snapshot files, which are read after it
+	_, err = l.CreateBook(ctx, newBook("Dune"))
+	test.NoError(err)
+	test.Nil(l.state)
+	books, err = l.GetBooks(ctx)
+	test.NoError(err)
+	test.Len(books, 2)
+}
+
+func TestCrashRecovery(t *testing.T) {
+	steps := []struct {
+		step string
+		// acknowledged tells whether the commit crashed at the step returns without an error
+		acknowledged bool
+	}{
+		{"journal.write", false},
+		{"journal.sync", false},
+		{"compact.prices", true},
+		{"compact.changes", true},
+		{"compact.books", true},
+		{"compact.truncate", true},
+	}
+	for _, s := range steps {
+		t.Run(s.step, func(t *testing.T) {
+			test := assert.New(t)
+			ctx := context.Background()
+			path := newTestLibrary(t)
+
+			l := restart(t, path)
+			emma, err := l.CreateBook(ctx, newBook("Emma"))
+			test.NoError(err)
+
+			// the second record makes the commit compact the journal
+			l.fs = crashFS{step: s.step}
+			dune, err := l.CreateBook(ctx, newBook("Dune"))
+			l.fs = osFS{}
+			if s.acknowledged {
+				test.NoError(err)
+			} else {
+				test.Equal(errCrash, err)
+			}
+
+			crash(l)
+			l = restart(t, path)
+			books, err := l.GetBooks(ctx)
+			test.NoError(err)
+			titles := map[string]int{}
+			for _, book := range books {
+				titles[book.Title]++
+			}
+			if s.acknowledged {
+				test.Equal(map[string]int{"Emma": 1, "Dune": 1}, titles, "the acknowledged book is there once")
+				prices, err := l.PriceHistory(ctx, dune.ID)
+				test.NoError(err)
+				test.Len(prices, 1, "the replayed price isn't doubled")
+			} else {
+				test.Equal(1, titles["Emma"])
+				test.LessOrEqual(titles["Dune"], 1, "the book which wasn't acknowledged is either there or not")
+			}
+			changes, last, err := l.Changes(ctx, 1)
+			test.NoError(err)
+			test.Equal(uint64(len(books)), last, "every book has its change once")
+			test.Len(changes, len(books)-1)
+
+			// the recovered library keeps working and its writes survive the next crash
+			_, err = l.CreateBook(ctx, newBook("Ulysses"))
+			test.NoError(err)
+			crash(l)
+			books, err = restart(t, path).GetBooks(ctx)
+			test.NoError(err)
+			test.Len(books, len(titles)+1)
+			test.Equal(emma.ID, books[0].ID)
+		})
+	}
+}
+
+func TestTornJournal(t *testing.T) {
+	test := assert.New(t)
+	ctx := context.Background()
+	path := newTestLibrary(t)
+	l := NewLibrary(path, false)
+
+	_, err := l.CreateBook(ctx, newBook("Emma"))
+	test.NoError(err)
+	journal, err := l.journalPath()
+	test.NoError(err)
+	file, err := os.OpenFile(journal, os.O_APPEND|os.O_WRONLY, 0644)
+	test.NoError(err)
+	// the record with the wrong checksum and the record without the line end
+	_, err = file.WriteString("00000000 {\"changes\": []}\n" + "1234abcd {\"chan")
+	test.NoError(err)
+	test.NoError(file.Close())
+
+	books, err := l.GetBooks(ctx)
+	test.NoError(err)
+	test.Len(books, 1)
+
+	// the next commit cuts the torn records off, so they don't hide it
+	_, err = l.CreateBook(ctx, newBook("Dune"))
+	test.NoError(err)
+	crash(l)
+	books, err = NewLibrary(path, false).GetBooks(ctx)
+	test.NoError(err)
+	test.Len(books, 2)
+}
+
+func TestStorageLock(t *testing.T) {
+	test := assert.New(t)
+	ctx := context.Background()
+	path := newTestLibrary(t)
+
+	l := restart(t, path)
+	_, err := l.CreateBook(ctx, newBook("Emma"))
+	test.NoError(err)
+
+	// the second library would write over the journal records of the first one
+	second := NewLibrary(path, false)
+	test.True(errors.Is(second.Recover(), ErrLocked))
+	_, err = second.GetBooks(ctx)
+	test.True(errors.Is(err, ErrLocked))
+
+	test.NoError(l.Close())
+	books, err := restart(t, path).GetBooks(ctx)
+	test.NoError(err)
+	test.Len(books, 1)
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrLocked describe the json storage which is used by another library
+var ErrLocked = errors.New("storage is used by another library")
+
+// lockPath returns path of the lock file kept next to the json storage
+func (l *library) lockPath() (string, error) {
+	return filepath.Abs(l.storage + ".lock")
+}
+
+// acquire locks the json storage for the library, it has to be called with the lock held.
+// The library keeps the state and the journal size in memory, so the second library on the same files
+// would overwrite the records of the first one; it fails with ErrLocked instead.
+// The lock is released by Close or by the end of the process, so the crash doesn't leave it behind.
+func (l *library) acquire() error {
+	if l.lock != nil {
+		return nil
+	}
+	path, err := l.lockPath()
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err = lockFile(file); err != nil {
+		file.Close()
+		if errors.Is(err, errWouldBlock) {
+			return fmt.Errorf("%w: %s", ErrLocked, l.storage)
+		}
+		return err
+	}
+	l.lock = file
+	return nil
+}
+
+// release unlocks the json storage, it has to be called with the lock held
+func (l *library) release() error {
+	if l.lock == nil {
+		return nil
+	}
+	// closing the file drops the lock
+	err := l.lock.Close()
+	l.lock = nil
+	return err
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+// errWouldBlock is returned by lockFile when another file holds the lock
+var errWouldBlock = errors.New("file is locked")
+
+// lockFile doesn't lock the file on the systems without flock, the storage isn't guarded there
+func lockFile(*os.File) error {
+	return nil
+}
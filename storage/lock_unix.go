@@ -0,0 +1,16 @@
+//go:build unix
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// errWouldBlock is returned by lockFile when another file holds the lock
+var errWouldBlock = syscall.EWOULDBLOCK
+
+// lockFile takes the exclusive lock of the file without waiting for it
+func lockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// operationDuration tracks how long every library method takes per backend
+var operationDuration = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "library_storage_operation_duration_seconds",
+		Help:    "Duration of storage operations by backend and method.",
+		Buckets: prometheus.DefBuckets,
+	},
+	[]string{"backend", "method"},
+)
+
+func init() {
+	prometheus.MustRegister(operationDuration)
+}
+
+// backend returns the label of the storage in use
+func (l *library) backend() string {
+	if l.useSql {
+		return "sql"
+	}
+	return "json"
+}
+
+// observe records the duration of the storage method started at start.
+// It's supposed to be used with defer at the beginning of the method.
+func (l *library) observe(method string, start time.Time) {
+	operationDuration.WithLabelValues(l.backend(), method).Observe(time.Since(start).Seconds())
+}
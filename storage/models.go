@@ -11,7 +11,9 @@ type Book struct {
 	Title  string         `gorm:"type:varchar(100)" json:"title, omitempty"`
 	Genres pq.StringArray `gorm:"type:varchar(64)" json:"genres, omitempty"`
 	Pages  int            `gorm:"type:int" json:"pages, omitempty"`
-	Price  float64        `gorm:"type:real" json:"price, omitempty"`
+	Price  Decimal        `gorm:"type:decimal(19,6)" json:"price, omitempty"`
+	// Currency is the ISO 4217 code of the price, DefaultCurrency when it's empty
+	Currency string `gorm:"type:varchar(3)" json:"currency,omitempty"`
 }
 
 // Books contains book objects
@@ -20,4 +22,8 @@ type Books []Book
 //Filter describes filter indicator
 type BookFilter struct {
 	Price string `gorm:"type:varchar(100)" json:"price, omitempty"`
+	// Genre limits the filter to the books of the genre, the price can be left out then
+	Genre string `gorm:"type:varchar(64)" json:"genre,omitempty"`
+	// Currency of the filter price, the prices of the books are converted into it before they are compared
+	Currency string `gorm:"type:varchar(3)" json:"currency,omitempty"`
 }
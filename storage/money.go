@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// decimalPlaces is the number of the fractional digits Decimal keeps,
+// it's enough for the minor units of every ISO 4217 currency and for the published exchange rates
+const decimalPlaces = 6
+
+const decimalScale = 1000000
+
+// ErrDecimal describe the number which can't be kept exactly by Decimal
+var ErrDecimal = errors.New("not a decimal with up to 6 fractional digits")
+
+// Decimal is the exact decimal number with up to six fractional digits.
+// Prices are kept in it, so they add up without the rounding errors of float64.
+// It's written to JSON as a number and to the sql database as a string of the digits.
+type Decimal struct {
+	// units are millionths
+	units int64
+}
+
+// ParseDecimal reads the decimal written like 12, -0.5 or 12.4300, the digits which Decimal can't keep are rejected
+func ParseDecimal(s string) (Decimal, error) {
+	text := strings.TrimSpace(s)
+	negative := strings.HasPrefix(text, "-")
+	text = strings.TrimPrefix(strings.TrimPrefix(text, "-"), "+")
+	whole, fraction := text, ""
+	if i := strings.IndexByte(text, '.'); i >= 0 {
+		whole, fraction = text[:i], text[i+1:]
+	}
+	fraction = strings.TrimRight(fraction, "0")
+	if whole == "" && fraction == "" || len(fraction) > decimalPlaces || !digits(whole) || !digits(fraction) {
+		return Decimal{}, fmt.Errorf("%w: %q", ErrDecimal, s)
+	}
+
+	fraction += strings.Repeat("0", decimalPlaces-len(fraction))
+	units, err := strconv.ParseInt(strings.TrimLeft(whole, "0")+fraction, 10, 64)
+	if err != nil {
+		return Decimal{}, fmt.Errorf("%w: %q", ErrDecimal, s)
+	}
+	if negative {
+		units = -units
+	}
+	return Decimal{units: units}, nil
+}
+
+func digits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// MustDecimal is ParseDecimal for the constants, it panics when the number isn't valid
+func MustDecimal(s string) Decimal {
+	d, err := ParseDecimal(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// DecimalFromFloat rounds the float to six fractional digits
+func DecimalFromFloat(f float64) (Decimal, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) || math.Abs(f) >= math.MaxInt64/decimalScale {
+		return Decimal{}, fmt.Errorf("%w: %v", ErrDecimal, f)
+	}
+	return ParseDecimal(strconv.FormatFloat(f, 'f', decimalPlaces, 64))
+}
+
+// String writes the decimal without the trailing zeros
+func (d Decimal) String() string {
+	units := d.units
+	sign := ""
+	if units < 0 {
+		sign = "-"
+	}
+	whole := new(big.Int).Abs(big.NewInt(units))
+	fraction := new(big.Int)
+	whole.QuoRem(whole, big.NewInt(decimalScale), fraction)
+	if fraction.Sign() == 0 {
+		return sign + whole.String()
+	}
+	digits := fmt.Sprintf("%0*d", decimalPlaces, fraction.Int64())
+	return sign + whole.String() + "." + strings.TrimRight(digits, "0")
+}
+
+// Float64 returns the nearest float, it's meant for the metrics and the clients which need a float
+func (d Decimal) Float64() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+// Cmp returns -1, 0 or 1 when the decimal is less than, equal to or greater than the other one
+func (d Decimal) Cmp(other Decimal) int {
+	switch {
+	case d.units < other.units:
+		return -1
+	case d.units > other.units:
+		return 1
+	}
+	return 0
+}
+
+// Sign returns -1, 0 or 1 for the negative, zero and positive decimal
+func (d Decimal) Sign() int {
+	return d.Cmp(Decimal{})
+}
+
+// IsZero reports whether the decimal is zero
+func (d Decimal) IsZero() bool {
+	return d.units == 0
+}
+
+// Add returns the sum of the decimals
+func (d Decimal) Add(other Decimal) Decimal {
+	return Decimal{units: d.units + other.units}
+}
+
+// Sub returns the difference of the decimals
+func (d Decimal) Sub(other Decimal) Decimal {
+	return Decimal{units: d.units - other.units}
+}
+
+// Mul returns the product rounded to six fractional digits, half away from zero
+func (d Decimal) Mul(other Decimal) Decimal {
+	return Decimal{units: mulDiv(d.units, other.units, decimalScale)}
+}
+
+// MulDiv returns the decimal multiplied by mul and divided by div in one step,
+// so only the result is rounded to six fractional digits. The div must not be zero.
+func (d Decimal) MulDiv(mul, div Decimal) Decimal {
+	return Decimal{units: mulDiv(d.units, mul.units, div.units)}
+}
+
+// Percent returns the given percent of the decimal rounded to six fractional digits
+func (d Decimal) Percent(percent Decimal) Decimal {
+	return Decimal{units: mulDiv(d.units, percent.units, 100*decimalScale)}
+}
+
+// Round rounds the decimal to the fractional digits, half away from zero
+func (d Decimal) Round(places int) Decimal {
+	if places >= decimalPlaces {
+		return d
+	}
+	unit := int64(math.Pow10(decimalPlaces - places))
+	return Decimal{units: mulDiv(d.units, 1, unit) * unit}
+}
+
+// Places returns the number of the fractional digits the decimal needs
+func (d Decimal) Places() int {
+	places := decimalPlaces
+	for units := d.units; places > 0 && units%10 == 0; units /= 10 {
+		places--
+	}
+	return places
+}
+
+// mulDiv returns a*b/c rounded half away from zero, the product doesn't overflow
+func mulDiv(a, b, c int64) int64 {
+	product := new(big.Int).Mul(big.NewInt(a), big.NewInt(b))
+	quotient, remainder := new(big.Int).QuoRem(product, big.NewInt(c), new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(remainder), big.NewInt(2)).Cmp(big.NewInt(c)) >= 0 {
+		if product.Sign() < 0 {
+			quotient.Sub(quotient, big.NewInt(1))
+		} else {
+			quotient.Add(quotient, big.NewInt(1))
+		}
+	}
+	return quotient.Int64()
+}
+
+// MarshalJSON writes the decimal as a JSON number with its exact digits
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalJSON reads the decimal from a JSON number or a string, the digits aren't passed through float64
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	text := string(data)
+	if text == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(text); err == nil {
+		text = unquoted
+	} else if strings.ContainsAny(text, "eE") {
+		// the exponent is written by the clients which encode floats, it's read like one
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return err
+		}
+		parsed, err := DecimalFromFloat(f)
+		*d = parsed
+		return err
+	}
+	parsed, err := ParseDecimal(text)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// Value stores the decimal as a string, so it's exact in any sql column
+func (d Decimal) Value() (driver.Value, error) {
+	return d.String(), nil
+}
+
+// Scan reads the decimal from the sql column, the old real columns give floats
+func (d *Decimal) Scan(src interface{}) error {
+	var err error
+	switch value := src.(type) {
+	case nil:
+		*d = Decimal{}
+	case int64:
+		*d = Decimal{units: value * decimalScale}
+	case float64:
+		*d, err = DecimalFromFloat(value)
+	case []byte:
+		*d, err = ParseDecimal(string(value))
+	case string:
+		*d, err = ParseDecimal(value)
+	default:
+		err = fmt.Errorf("can't scan %T into Decimal", src)
+	}
+	return err
+}
+
+// DefaultCurrency is the currency of the prices stored without one, like the ones stored before the currency was kept
+const DefaultCurrency = "USD"
+
+// Money is the amount in the ISO 4217 currency
+type Money struct {
+	Amount   Decimal `gorm:"type:decimal(19,6)" json:"amount"`
+	Currency string  `gorm:"type:varchar(3)" json:"currency"`
+}
+
+func (m Money) String() string {
+	return m.Amount.String() + " " + m.Currency
+}
+
+// Money returns the price of the book with its currency
+func (b Book) Money() Money {
+	currency := b.Currency
+	if currency == "" {
+		currency = DefaultCurrency
+	}
+	return Money{Amount: b.Price, Currency: currency}
+}
+
+// CurrencyPlaces returns the digits of the minor unit of the ISO 4217 currency, ok is false for the unknown code
+func CurrencyPlaces(code string) (int, bool) {
+	places, ok := currencyPlaces[code]
+	return places, ok
+}
+
+// CheckPrice rejects the price which isn't positive, the unknown currency
+// and the amount which is more precise than the minor unit of its currency
+func CheckPrice(price Money) error {
+	places, ok := CurrencyPlaces(price.Currency)
+	switch {
+	case !ok:
+		return fmt.Errorf("%w: %q isn't an ISO 4217 currency", ErrInvalid, price.Currency)
+	case price.Amount.Sign() <= 0:
+		return fmt.Errorf("%w: price must be positive", ErrInvalid)
+	case price.Amount.Places() > places:
+		return fmt.Errorf("%w: %s has more than %d fractional digits", ErrInvalid, price, places)
+	}
+	return nil
+}
+
+// currencyPlaces are the active ISO 4217 currencies with the digits of their minor units
+var currencyPlaces = func() map[string]int {
+	codes := map[int]string{
+		0: "BIF CLP DJF GNF ISK JPY KMF KRW PYG RWF UGX UYI VND VUV XAF XOF XPF",
+		2: "AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BMD BND BOB BOV BRL BSD BTN BWP BYN BZD " +
+			"CAD CDF CHE CHF CHW CNY COP COU CRC CUC CUP CVE CZK DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS " +
+			"GIP GMD GTQ GYD HKD HNL HTG HUF IDR ILS INR IRR JMD KES KGS KHR KPW KYD KZT LAK LBP LKR LRD LSL MAD " +
+			"MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN MXV MYR MZN NAD NGN NIO NOK NPR NZD PAB PEN PGK PHP PKR " +
+			"PLN QAR RON RSD RUB SAR SBD SCR SDG SEK SGD SHP SLE SLL SOS SRD SSP STN SVC SYP SZL THB TJS TMT TOP " +
+			"TRY TTD TWD TZS UAH USD USN UYU UZS VED VES WST XCD YER ZAR ZMW ZWL",
+		3: "BHD IQD JOD KWD LYD OMR TND",
+		4: "CLF UYW",
+	}
+	places := map[string]int{}
+	for digits, list := range codes {
+		for _, code := range strings.Fields(list) {
+			places[code] = digits
+		}
+	}
+	return places
+}()
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// PriceRecord is the price of the book which took effect at EffectiveAt and lasted till the next record
+type PriceRecord struct {
+	ID          uint64    `gorm:"primary_key" json:"-"`
+	BookID      string    `gorm:"type:varchar(100);index" json:"book_id"`
+	Price       Money     `gorm:"embedded;embedded_prefix:price_" json:"price"`
+	EffectiveAt time.Time `json:"effective_at"`
+	// Seq is the change which set the price, it's zero for the prices older than the change log
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// PriceRecords contains the price history ordered from the oldest price
+type PriceRecords []PriceRecord
+
+// priceRecord returns the record of the price set by the change, ok is false when the change leaves the price as it was
+func priceRecord(change Change) (PriceRecord, bool) {
+	if change.Book == nil {
+		return PriceRecord{}, false
+	}
+	for _, field := range change.Fields {
+		if field == "price" {
+			return PriceRecord{
+				BookID:      change.BookID,
+				Price:       change.Book.Money(),
+				EffectiveAt: change.Time,
+				Seq:         change.Seq,
+			}, true
+		}
+	}
+	return PriceRecord{}, false
+}
+
+// backfillPrices builds the history of the library which didn't keep it yet.
+// The prices come from the change log, the books older than the change log get their current price.
+func backfillPrices(books Books, changes Changes) PriceRecords {
+	var prices PriceRecords
+	known := map[string]bool{}
+	for _, change := range changes {
+		if record, ok := priceRecord(change); ok {
+			prices = append(prices, record)
+			known[record.BookID] = true
+		}
+	}
+	var older PriceRecords
+	for _, book := range books {
+		if !known[book.ID] {
+			older = append(older, PriceRecord{BookID: book.ID, Price: book.Money()})
+		}
+	}
+	return append(older, prices...)
+}
+
+// pricesPath returns path of the price history file kept next to the json storage
+func (l *library) pricesPath() (string, error) {
+	return filepath.Abs(l.storage + ".prices")
+}
+
+// readPrices reads the price history of the json storage, ok is false when the file isn't there yet
+func (l *library) readPrices() (PriceRecords, bool, error) {
+	path, err := l.pricesPath()
+	if err != nil {
+		return nil, false, err
+	}
+
+	file, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	var prices PriceRecords
+	return prices, true, json.Unmarshal(file, &prices)
+}
+
+// recordSqlPrice saves the price set by the change which is already saved in the sql transaction
+func recordSqlPrice(tx *gorm.DB, change Change) error {
+	record, ok := priceRecord(change)
+	if !ok {
+		return nil
+	}
+	return tx.Create(&record).Error
+}
+
+// backfillSqlPrices fills the price history table which was just created
+func backfillSqlPrices(db *gorm.DB) error {
+	var books Books
+	if err := db.Find(&books).Error; err != nil {
+		return err
+	}
+	var changes Changes
+	if err := db.Order("seq").Find(&changes).Error; err != nil {
+		return err
+	}
+	if err := decodeBooks(changes); err != nil {
+		return err
+	}
+	for _, record := range backfillPrices(books, changes) {
+		if err := db.Create(&record).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PriceHistory returns the prices of the book from the oldest one, the last one is the current price
+func (l *library) PriceHistory(ctx context.Context, id string) (PriceRecords, error) {
+	defer l.observe("PriceHistory", time.Now())
+	if l.useSql {
+		// Connection to the database
+		db, err := InitDB(l.dsn)
+		if err != nil {
+			return nil, err
+		}
+		// Close connection database
+		defer db.Close()
+
+		tx := begin(ctx, db)
+		defer tx.Rollback()
+		if _, err = sqlFind(tx, id); err != nil {
+			return nil, err
+		}
+		var prices PriceRecords
+		err = tx.Where("book_id = ?", id).Order("effective_at, seq").Find(&prices).Error
+		return prices, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	state, err := l.viewJSON()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = l.wantedIndex(id, state.books); err != nil {
+		return nil, err
+	}
+	var prices PriceRecords
+	for _, record := range state.prices {
+		if record.BookID == id {
+			prices = append(prices, record)
+		}
+	}
+	// the replicated changes keep the time they were made at, so they might come out of order
+	sort.SliceStable(prices, func(i, j int) bool {
+		return prices[i].EffectiveAt.Before(prices[j].EffectiveAt)
+	})
+	return prices, nil
+}
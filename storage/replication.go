@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// bookFields are the fields of the book which are versioned separately for the replication
+var bookFields = []string{"title", "genres", "pages", "price"}
+
+// diffFields returns the fields which differ in the books
+func diffFields(old, changed Book) []string {
+	var fields []string
+	if old.Title != changed.Title {
+		fields = append(fields, "title")
+	}
+	if !reflect.DeepEqual([]string(old.Genres), []string(changed.Genres)) {
+		fields = append(fields, "genres")
+	}
+	if old.Pages != changed.Pages {
+		fields = append(fields, "pages")
+	}
+	// the currency is a part of the price, so they are always replicated together
+	if old.Money() != changed.Money() {
+		fields = append(fields, "price")
+	}
+	return fields
+}
+
+// setField copies the field from src to dst
+func setField(dst *Book, src Book, field string) {
+	switch field {
+	case "title":
+		dst.Title = src.Title
+	case "genres":
+		dst.Genres = src.Genres
+	case "pages":
+		dst.Pages = src.Pages
+	case "price":
+		dst.Price = src.Price
+		dst.Currency = src.Currency
+	}
+}
+
+// version is the Lamport timestamp of the change, the node breaks ties so the order is total
+type version struct {
+	Clock uint64
+	Node  string
+}
+
+func (v version) after(other version) bool {
+	if v.Clock != other.Clock {
+		return v.Clock > other.Clock
+	}
+	return v.Node > other.Node
+}
+
+// versions describes what the history of a single book tells about its fields
+type versions struct {
+	fields    map[string]version
+	tombstone version
+	deleted   bool
+}
+
+func newVersions(history Changes) versions {
+	v := versions{fields: map[string]version{}}
+	for _, change := range history {
+		stamp := version{change.Clock, change.Node}
+		if change.Type == EventBookDeleted {
+			if stamp.after(v.tombstone) {
+				v.tombstone = stamp
+			}
+			v.deleted = true
+			continue
+		}
+		for _, field := range change.Fields {
+			if stamp.after(v.fields[field]) {
+				v.fields[field] = stamp
+			}
+		}
+	}
+	return v
+}
+
+// latest returns the newest version among the fields
+func (v versions) latest() version {
+	var latest version
+	for _, stamp := range v.fields {
+		if stamp.after(latest) {
+			latest = stamp
+		}
+	}
+	return latest
+}
+
+// merge resolves the remote change against the local state of the book.
+// Every field is decided separately by the last writer, the deletion wins over all older fields.
+// It returns the change which has to be applied locally or false when the local state is newer.
+func merge(local *Book, v versions, remote Change) (Change, bool) {
+	stamp := version{remote.Clock, remote.Node}
+	applied := remote
+	applied.Seq = 0
+
+	if remote.Type == EventBookDeleted {
+		if !stamp.after(v.tombstone) || !stamp.after(v.latest()) {
+			return applied, false
+		}
+		applied.Book = nil
+		applied.Fields = nil
+		return applied, true
+	}
+	if remote.Book == nil {
+		return applied, false
+	}
+
+	if local == nil {
+		// the book has been deleted here after the remote change was made
+		if v.deleted && !stamp.after(v.tombstone) {
+			return applied, false
+		}
+		book := *remote.Book
+		book.ID = remote.BookID
+		applied.Type = EventBookCreated
+		applied.Book = &book
+		applied.Fields = bookFields
+		return applied, true
+	}
+
+	merged := *local
+	var won []string
+	for _, field := range remote.Fields {
+		if stamp.after(v.fields[field]) {
+			setField(&merged, *remote.Book, field)
+			won = append(won, field)
+		}
+	}
+	if len(won) == 0 {
+		return applied, false
+	}
+	applied.Type = EventBookUpdated
+	applied.Book = &merged
+	applied.Fields = won
+	return applied, true
+}
+
+// Apply merges the change pulled from another library into this one.
+// The change is recorded with its original clock and node, so it's passed further.
+// It returns false when the change lost to the local state and nothing was changed.
+func (l *library) Apply(ctx context.Context, remote Change) (bool, error) {
+	defer l.observe("Apply", time.Now())
+	if l.useSql {
+		if l.isClosed() {
+			return false, ErrClosed
+		}
+		// Connection to the database
+		db, err := InitDB(l.dsn)
+		if err != nil {
+			return false, err
+		}
+		// Close connection database
+		defer db.Close()
+
+		tx := begin(ctx, db)
+		defer tx.Rollback()
+
+		var history Changes
+		if err = tx.Where("book_id = ?", remote.BookID).Order("seq").Find(&history).Error; err != nil {
+			return false, err
+		}
+
+		var local *Book
+		var book Book
+		err = tx.Where("id = ?", remote.BookID).First(&book).Error
+		switch {
+		case err == nil:
+			local = &book
+		case !gorm.IsRecordNotFoundError(err):
+			return false, err
+		}
+
+		applied, ok := merge(local, newVersions(history), remote)
+		if !ok {
+			return false, nil
+		}
+
+		switch {
+		case applied.Type == EventBookDeleted && local != nil:
+			err = tx.Delete(local).Error
+		case applied.Type == EventBookCreated:
+			err = tx.Create(applied.Book).Error
+		case applied.Type == EventBookUpdated:
+			err = tx.Save(applied.Book).Error
+		}
+		if err != nil {
+			return false, err
+		}
+		if err = l.recordSqlChange(tx, applied); err != nil {
+			return false, err
+		}
+		if err = tx.Commit().Error; err != nil {
+			return false, err
+		}
+		l.notifyApplied(applied, local)
+		return true, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tx, err := l.beginJSON(ctx)
+	if err != nil {
+		return false, err
+	}
+	var history Changes
+	for _, change := range tx.changes {
+		if change.BookID == remote.BookID {
+			history = append(history, change)
+		}
+	}
+
+	var local *Book
+	index, err := tx.index(remote.BookID)
+	if err == nil {
+		book := tx.books[index]
+		local = &book
+	}
+
+	applied, ok := merge(local, newVersions(history), remote)
+	if !ok {
+		return false, nil
+	}
+
+	switch {
+	case applied.Type == EventBookDeleted && local != nil:
+		tx.books = append(tx.books[:index:index], tx.books[index+1:]...)
+	case applied.Type == EventBookCreated:
+		tx.books = append(tx.books, *applied.Book)
+	case applied.Type == EventBookUpdated:
+		tx.books[index] = *applied.Book
+	}
+	tx.record(applied)
+	tx.notifications = append(tx.notifications, func() { l.notifyApplied(applied, local) })
+	if err = tx.commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// notifyApplied tells the listeners about the applied change like the local changes do
+func (l *library) notifyApplied(applied Change, local *Book) {
+	switch {
+	case applied.Book != nil:
+		l.notify(applied.Type, *applied.Book)
+	case local != nil:
+		l.notify(applied.Type, *local)
+	default:
+		l.notify(applied.Type, Book{ID: applied.BookID})
+	}
+}
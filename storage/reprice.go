@@ -0,0 +1,272 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Kinds of the price adjustments
+const (
+	// AdjustPercent changes the price by Value percent, e.g. 5 or -10
+	AdjustPercent = "percent"
+	// AdjustAmount adds Value to the price, it's negative for the discount
+	AdjustAmount = "amount"
+	// AdjustSet sets the price to Value
+	AdjustSet = "set"
+	// AdjustMin raises the lower prices to Value
+	AdjustMin = "min"
+	// AdjustMax lowers the higher prices to Value
+	AdjustMax = "max"
+)
+
+// ErrConflict describe the change which was prepared for the catalog version which isn't the current one
+var ErrConflict = errors.New("catalog has changed since the given version")
+
+// Adjustment is the rule the new price is computed by
+type Adjustment struct {
+	Kind  string  `json:"kind"`
+	Value Decimal `json:"value"`
+}
+
+// Validate checks the rule itself, the result for the particular price is checked by Price
+func (a Adjustment) Validate() error {
+	switch a.Kind {
+	case AdjustPercent:
+		if a.Value.Cmp(MustDecimal("-100")) <= 0 {
+			return fmt.Errorf("%w: percent must be above -100", ErrInvalid)
+		}
+	case AdjustAmount:
+	case AdjustSet, AdjustMin, AdjustMax:
+		if a.Value.Sign() <= 0 {
+			return fmt.Errorf("%w: %s price must be positive", ErrInvalid, a.Kind)
+		}
+	default:
+		return fmt.Errorf("%w: unknown adjustment %q", ErrInvalid, a.Kind)
+	}
+	return nil
+}
+
+// Price returns the adjusted price rounded to the minor unit of its currency.
+// The amounts of the rule are in the currency of the price.
+func (a Adjustment) Price(price Money) (Money, error) {
+	if err := a.Validate(); err != nil {
+		return Money{}, err
+	}
+	places, ok := CurrencyPlaces(price.Currency)
+	if !ok {
+		return Money{}, CheckPrice(price)
+	}
+	amount := price.Amount
+	switch a.Kind {
+	case AdjustPercent:
+		amount = amount.Add(amount.Percent(a.Value))
+	case AdjustAmount:
+		amount = amount.Add(a.Value)
+	case AdjustSet:
+		amount = a.Value
+	case AdjustMin:
+		if amount.Cmp(a.Value) < 0 {
+			amount = a.Value
+		}
+	case AdjustMax:
+		if amount.Cmp(a.Value) > 0 {
+			amount = a.Value
+		}
+	}
+	price.Amount = amount.Round(places)
+	if price.Amount.Sign() <= 0 {
+		return Money{}, fmt.Errorf("%w: adjusted price %s isn't positive", ErrInvalid, price)
+	}
+	return price, nil
+}
+
+// Reprice describes the price adjustment of the books matching the filter
+type Reprice struct {
+	Filter     BookFilter `json:"filter"`
+	Adjustment Adjustment `json:"adjustment"`
+	// Apply stores the new prices, without it they are only previewed
+	Apply bool `json:"apply"`
+	// Version is the catalog version of the preview, the apply fails with ErrConflict
+	// when the catalog has changed since then. Zero skips the check.
+	Version uint64 `json:"version,omitempty"`
+}
+
+// PriceChange is the price of the book before and after the adjustment
+type PriceChange struct {
+	ID       string  `json:"id"`
+	Title    string  `json:"title"`
+	OldPrice Decimal `json:"old_price"`
+	NewPrice Decimal `json:"new_price"`
+	Currency string  `json:"currency"`
+}
+
+// RepriceResult lists the books whose price is changed by the adjustment
+type RepriceResult struct {
+	Changes []PriceChange `json:"changes"`
+	Applied bool          `json:"applied"`
+	// Version is the catalog version the preview was made at or the one after the apply
+	Version uint64 `json:"version"`
+}
+
+// priceChanges computes the new prices of the books matching the filter, the unchanged books are left out
+func priceChanges(books Books, r Reprice, converter Converter) ([]PriceChange, error) {
+	operator, price, err := r.Filter.parse()
+	if err != nil {
+		return nil, err
+	}
+	if err = r.Adjustment.Validate(); err != nil {
+		return nil, err
+	}
+
+	changes := []PriceChange{}
+	for _, book := range books {
+		matched, err := r.Filter.match(operator, price, book, converter)
+		if err != nil {
+			return nil, err
+		}
+		if !matched {
+			continue
+		}
+		newPrice, err := r.Adjustment.Price(book.Money())
+		if err != nil {
+			return nil, fmt.Errorf("book %s: %w", book.ID, err)
+		}
+		if newPrice == book.Money() {
+			continue
+		}
+		changes = append(changes, PriceChange{
+			ID:       book.ID,
+			Title:    book.Title,
+			OldPrice: book.Price,
+			NewPrice: newPrice.Amount,
+			Currency: newPrice.Currency,
+		})
+	}
+	return changes, nil
+}
+
+// Reprice adjusts the prices of the books matching the filter in one transaction.
+// Every new price is recorded in the change log like the single change of the book,
+// so it's part of the price history. Without Apply nothing is changed and the result is the preview.
+func (l *library) Reprice(ctx context.Context, r Reprice) (RepriceResult, error) {
+	defer l.observe("Reprice", time.Now())
+	if l.useSql {
+		if r.Apply && l.isClosed() {
+			return RepriceResult{}, ErrClosed
+		}
+		// Connection to the database
+		db, err := InitDB(l.dsn)
+		if err != nil {
+			return RepriceResult{}, err
+		}
+		// Close connection database
+		defer db.Close()
+
+		tx := begin(ctx, db)
+		defer tx.Rollback()
+		return l.sqlReprice(tx, r)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var tx *jsonTx
+	var err error
+	if r.Apply {
+		tx, err = l.beginJSON(ctx)
+	} else {
+		// the preview only reads, so it's answered by the closed library as well
+		tx, err = l.readJSON(ctx)
+	}
+	if err != nil {
+		return RepriceResult{}, err
+	}
+	version := lastSeq(tx.changes)
+	if r.Apply && r.Version != 0 && r.Version != version {
+		return RepriceResult{}, ErrConflict
+	}
+	changes, err := priceChanges(tx.books, r, l.converter)
+	if err != nil {
+		return RepriceResult{}, err
+	}
+	if !r.Apply {
+		return RepriceResult{Changes: changes, Version: version}, nil
+	}
+
+	for _, change := range changes {
+		index, err := tx.index(change.ID)
+		if err != nil {
+			return RepriceResult{}, err
+		}
+		book := tx.books[index]
+		book.Price = change.NewPrice
+		if _, err = tx.update(change.ID, book); err != nil {
+			return RepriceResult{}, err
+		}
+	}
+	if err = tx.commit(); err != nil {
+		return RepriceResult{}, err
+	}
+	return RepriceResult{Changes: changes, Applied: true, Version: lastSeq(tx.changes)}, nil
+}
+
+// sqlReprice does the reprice in the sql transaction, the caller rolls the transaction back
+// unless it's committed here
+func (l *library) sqlReprice(tx *gorm.DB, r Reprice) (RepriceResult, error) {
+	version, err := sqlVersion(tx)
+	if err != nil {
+		return RepriceResult{}, err
+	}
+	if r.Apply && r.Version != 0 && r.Version != version {
+		return RepriceResult{}, ErrConflict
+	}
+
+	var books Books
+	if err = tx.Find(&books).Error; err != nil {
+		return RepriceResult{}, err
+	}
+	changes, err := priceChanges(books, r, l.converter)
+	if err != nil {
+		return RepriceResult{}, err
+	}
+	if !r.Apply {
+		return RepriceResult{Changes: changes, Version: version}, nil
+	}
+
+	updated := make(Books, 0, len(changes))
+	for _, change := range changes {
+		book, err := sqlFind(tx, change.ID)
+		if err != nil {
+			return RepriceResult{}, err
+		}
+		book.Price = change.NewPrice
+		if book, err = l.sqlUpdate(tx, change.ID, book); err != nil {
+			return RepriceResult{}, err
+		}
+		updated = append(updated, book)
+	}
+	if version, err = sqlVersion(tx); err != nil {
+		return RepriceResult{}, err
+	}
+	if err = tx.Commit().Error; err != nil {
+		return RepriceResult{}, err
+	}
+	for _, book := range updated {
+		l.notify(EventBookUpdated, book)
+	}
+	return RepriceResult{Changes: changes, Applied: true, Version: version}, nil
+}
+
+// sqlVersion returns the sequence number of the last change in the sql transaction
+func sqlVersion(tx *gorm.DB) (uint64, error) {
+	var last Change
+	err := tx.Order("seq desc").First(&last).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return 0, err
+	}
+	return last.Seq, nil
+}
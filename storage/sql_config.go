@@ -5,9 +5,10 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func InitDB() (*gorm.DB, error) {
+// openDB opens the database file without touching the schema
+func openDB(dsn string) (*gorm.DB, error) {
 	// Openning file
-	db, err := gorm.Open("sqlite3", "storage/data.db")
+	db, err := gorm.Open("sqlite3", dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -15,6 +16,16 @@ func InitDB() (*gorm.DB, error) {
 	if err = db.LogMode(true).Error; err != nil {
 		return nil, err
 	}
+	traceStatements(db)
+	return db, nil
+}
+
+// InitDB opens the database and creates the tables which are missing
+func InitDB(dsn string) (*gorm.DB, error) {
+	db, err := openDB(dsn)
+	if err != nil {
+		return nil, err
+	}
 	// Creating the table
 	if !db.HasTable(&Book{}) {
 
@@ -25,6 +36,18 @@ func InitDB() (*gorm.DB, error) {
 			return nil, err
 		}
 	}
+	// AutoMigrate adds the columns which appeared in newer versions of the books and the change log
+	if err = db.AutoMigrate(&Book{}, &Change{}).Error; err != nil {
+		return nil, err
+	}
+	if !db.HasTable(&PriceRecord{}) {
+		if err = db.CreateTable(&PriceRecord{}).Error; err != nil {
+			return nil, err
+		}
+		if err = backfillSqlPrices(db); err != nil {
+			return nil, err
+		}
+	}
 
 	return db, nil
 }
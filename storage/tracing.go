@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/jinzhu/gorm"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans, the tracer is taken from the global provider
+// for every span, so the provider which is set after the package is loaded is used as well
+const tracerName = "github.com/ssOlexBaiko/library/storage"
+
+// keys of the values the tracing callbacks keep in the gorm scope
+const (
+	contextKey = "library:context"
+	spanKey    = "library:span"
+)
+
+// begin starts the transaction bound to the context,
+// the context is kept in the transaction so its statements are traced as children of the caller
+func begin(ctx context.Context, db *gorm.DB) *gorm.DB {
+	return db.BeginTx(ctx, nil).Set(contextKey, ctx)
+}
+
+// traceStatements registers callbacks which wrap every sql statement into the span
+func traceStatements(db *gorm.DB) {
+	db.Callback().Create().Before("gorm:create").Register("library:start_span", startSpan("INSERT"))
+	db.Callback().Create().After("gorm:create").Register("library:end_span", endSpan)
+	db.Callback().Query().Before("gorm:query").Register("library:start_span", startSpan("SELECT"))
+	db.Callback().Query().After("gorm:query").Register("library:end_span", endSpan)
+	db.Callback().Update().Before("gorm:update").Register("library:start_span", startSpan("UPDATE"))
+	db.Callback().Update().After("gorm:update").Register("library:end_span", endSpan)
+	db.Callback().Delete().Before("gorm:delete").Register("library:start_span", startSpan("DELETE"))
+	db.Callback().Delete().After("gorm:delete").Register("library:end_span", endSpan)
+}
+
+func startSpan(operation string) func(*gorm.Scope) {
+	return func(scope *gorm.Scope) {
+		value, ok := scope.Get(contextKey)
+		if !ok {
+			return
+		}
+		_, span := otel.Tracer(tracerName).Start(value.(context.Context), "sql "+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.system", "sqlite"),
+				attribute.String("db.operation", operation),
+				attribute.String("db.sql.table", scope.TableName()),
+			),
+		)
+		scope.InstanceSet(spanKey, span)
+	}
+}
+
+func endSpan(scope *gorm.Scope) {
+	value, ok := scope.InstanceGet(spanKey)
+	if !ok {
+		return
+	}
+	span := value.(trace.Span)
+	span.SetAttributes(attribute.String("db.statement", scope.SQL))
+	if scope.HasError() {
+		span.RecordError(scope.DB().Error)
+		span.SetStatus(codes.Error, scope.DB().Error.Error())
+	}
+	span.End()
+}
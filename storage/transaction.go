@@ -0,0 +1,228 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/jinzhu/gorm"
+	"github.com/twinj/uuid"
+)
+
+// jsonTx is the transaction of the json storage. The operations change the copies of the books
+// and the change log the library keeps, commit appends the new changes to the journal and keeps the result,
+// so the failed transaction leaves the storage as it was. It has to be used with the lock held.
+type jsonTx struct {
+	l       *library
+	books   Books
+	changes Changes
+	prices  PriceRecords
+	// base is the number of the changes before the transaction, the later ones are committed
+	base int
+	// entries and size describe the journal the transaction was read from
+	entries int
+	size    int64
+	// notifications are sent to the listeners after the commit
+	notifications []func()
+}
+
+// beginJSON starts the transaction of the json storage, the lock has to be held
+func (l *library) beginJSON(ctx context.Context) (*jsonTx, error) {
+	if err := l.writable(ctx); err != nil {
+		return nil, err
+	}
+	return l.readJSON(ctx)
+}
+
+// readJSON reads the books and the change log into the transaction without checking the library is writable
+func (l *library) readJSON(ctx context.Context) (*jsonTx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	state, err := l.loadJSON()
+	if err != nil {
+		return nil, err
+	}
+	return &jsonTx{
+		l:       l,
+		books:   state.books,
+		changes: state.changes,
+		prices:  state.prices,
+		base:    len(state.changes),
+		entries: state.entries,
+		size:    state.size,
+	}, nil
+}
+
+// record adds the change with the next sequence number to the change log
+// and the price it sets to the price history.
+// Local changes, which don't have Node yet, get the next tick of the Lamport clock.
+func (tx *jsonTx) record(change Change) {
+	if change.Node == "" {
+		change.Clock = maxClock(tx.changes) + 1
+		change.Node = tx.l.node
+	}
+	change.Seq = lastSeq(tx.changes) + 1
+	tx.changes = append(tx.changes, change)
+	if record, ok := priceRecord(change); ok {
+		tx.prices = append(tx.prices, record)
+	}
+}
+
+// notify sends the event to the listeners once the transaction is committed
+func (tx *jsonTx) notify(eventType string, book Book) {
+	tx.notifications = append(tx.notifications, func() { tx.l.notify(eventType, book) })
+}
+
+// index returns the position of the book in the transaction
+func (tx *jsonTx) index(id string) (int, error) {
+	return tx.l.wantedIndex(id, tx.books)
+}
+
+// create adds the book with a new ID
+func (tx *jsonTx) create(book Book) (Book, error) {
+	book, err := checkNewBook(book)
+	if err != nil {
+		return Book{}, err
+	}
+	book.ID = uuid.NewV4().String()
+	tx.books = append(tx.books, book)
+	tx.record(newChange(EventBookCreated, book, bookFields))
+	tx.notify(EventBookCreated, book)
+	return book, nil
+}
+
+// update replaces the fields of the book
+func (tx *jsonTx) update(id string, changedBook Book) (Book, error) {
+	index, err := tx.index(id)
+	if err != nil {
+		return Book{}, err
+	}
+	book := &tx.books[index]
+	old := *book
+	if changedBook, err = checkChangedBook(old, changedBook); err != nil {
+		return Book{}, err
+	}
+	book.Price = changedBook.Price
+	book.Currency = changedBook.Currency
+	book.Title = changedBook.Title
+	book.Pages = changedBook.Pages
+	book.Genres = changedBook.Genres
+	tx.record(newChange(EventBookUpdated, *book, diffFields(old, *book)))
+	tx.notify(EventBookUpdated, *book)
+	return *book, nil
+}
+
+// remove deletes the book and returns it
+func (tx *jsonTx) remove(id string) (Book, error) {
+	index, err := tx.index(id)
+	if err != nil {
+		return Book{}, err
+	}
+	book := tx.books[index]
+	tx.books = append(tx.books[:index:index], tx.books[index+1:]...)
+	tx.record(newChange(EventBookDeleted, book, nil))
+	tx.notify(EventBookDeleted, book)
+	return book, nil
+}
+
+// commit appends the changes of the transaction to the journal as one record and tells the listeners about them.
+// The record is on the disk when commit returns, after compactAfter records the journal is compacted
+// into the snapshot files. The failed compaction doesn't fail the commit, it's done again by the next one.
+func (tx *jsonTx) commit() error {
+	if len(tx.changes) > tx.base {
+		size, err := tx.l.appendJournal(tx.size, journalEntry{Changes: tx.changes[tx.base:]})
+		if err != nil {
+			return err
+		}
+		state := jsonState{books: tx.books, changes: tx.changes, prices: tx.prices, entries: tx.entries + 1, size: size}
+		tx.l.state = &state
+		if state.entries >= tx.l.compactAfter {
+			if err := tx.l.compact(state); err != nil {
+				log.Println("compaction of the json storage:", err)
+			}
+		}
+	}
+
+	for _, notify := range tx.notifications {
+		notify()
+	}
+	return nil
+}
+
+// writeTemp writes the data to a new file next to the path and returns its name
+func writeTemp(path string, data []byte) (string, error) {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return "", err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err = file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), file.Close()
+}
+
+// sqlCreate adds the book with a new ID in the sql transaction and records the change
+func (l *library) sqlCreate(tx *gorm.DB, book Book) (Book, error) {
+	book, err := checkNewBook(book)
+	if err != nil {
+		return Book{}, err
+	}
+	book.ID = uuid.NewV4().String()
+	if err := tx.Create(&book).Error; err != nil {
+		return Book{}, err
+	}
+	return book, l.recordSqlChange(tx, newChange(EventBookCreated, book, bookFields))
+}
+
+// sqlFind returns the book in the sql transaction
+func sqlFind(tx *gorm.DB, id string) (Book, error) {
+	var book Book
+	err := tx.Where("id = ?", id).First(&book).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return book, ErrNotFound
+	}
+	return book, err
+}
+
+// sqlUpdate replaces the fields of the book in the sql transaction and records the change
+func (l *library) sqlUpdate(tx *gorm.DB, id string, changedBook Book) (Book, error) {
+	book, err := sqlFind(tx, id)
+	if err != nil {
+		return Book{}, err
+	}
+	if changedBook, err = checkChangedBook(book, changedBook); err != nil {
+		return Book{}, err
+	}
+	changedBook.ID = id
+	if err = tx.Save(&changedBook).Error; err != nil {
+		return Book{}, err
+	}
+	return changedBook, l.recordSqlChange(tx, newChange(EventBookUpdated, changedBook, diffFields(book, changedBook)))
+}
+
+// sqlRemove deletes the book in the sql transaction, records the change and returns the book
+func (l *library) sqlRemove(tx *gorm.DB, id string) (Book, error) {
+	book, err := sqlFind(tx, id)
+	if err != nil {
+		return Book{}, err
+	}
+	if err = tx.Delete(&book).Error; err != nil {
+		return Book{}, err
+	}
+	return book, l.recordSqlChange(tx, newChange(EventBookDeleted, book, nil))
+}
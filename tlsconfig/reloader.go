@@ -0,0 +1,187 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Client authentication modes
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+// Reloader keeps the certificate of the server and the CA of the clients
+// and loads them again when their files change, so the certificates can be rotated without restart
+type Reloader struct {
+	certFile, keyFile, caFile string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modified map[string]time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewReloader constructor for Reloader struct, caFile is empty when the clients aren't verified
+func NewReloader(certFile, keyFile, caFile string) (*Reloader, error) {
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+	return files
+}
+
+// load reads all the files, the old ones are kept in use when any of them is broken
+func (r *Reloader) load() error {
+	modified := map[string]time.Time{}
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modified[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCA *x509.CertPool
+	if r.caFile != "" {
+		data, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		clientCA = x509.NewCertPool()
+		if !clientCA.AppendCertsFromPEM(data) {
+			return fmt.Errorf("%s doesn't contain any certificate", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCA = clientCA
+	r.modified = modified
+	return nil
+}
+
+// changed reports whether any of the files has been modified since it was loaded
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			// the file is being replaced, it's checked again next time
+			return false
+		}
+		if !info.ModTime().Equal(r.modified[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload loads the files again when they have changed
+func (r *Reloader) Reload() error {
+	if !r.changed() {
+		return nil
+	}
+	if err := r.load(); err != nil {
+		return err
+	}
+	log.Println("tls certificates reloaded")
+	return nil
+}
+
+// TLSConfig returns the server configuration which always uses the last loaded files
+func (r *Reloader) TLSConfig(clientAuth string) (*tls.Config, error) {
+	var authType tls.ClientAuthType
+	switch clientAuth {
+	case ClientAuthNone, "":
+		authType = tls.NoClientCert
+	case ClientAuthOptional:
+		authType = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		authType = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client auth %q", clientAuth)
+	}
+	if authType != tls.NoClientCert && r.caFile == "" {
+		return nil, errors.New("client certificates can't be verified without the client CA")
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientAuth:   authType,
+				ClientCAs:    r.clientCA,
+				NextProtos:   []string{"h2", "http/1.1"},
+			}, nil
+		},
+	}, nil
+}
+
+// Start checks the files in the background every interval
+func (r *Reloader) Start(interval time.Duration) {
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				if err := r.Reload(); err != nil {
+					log.Println("tls reload", err)
+				}
+			}
+		}
+	}()
+}
+
+// Close stops the background checks
+func (r *Reloader) Close() error {
+	if r.stop == nil {
+		return nil
+	}
+	close(r.stop)
+	<-r.done
+	r.stop = nil
+	return nil
+}
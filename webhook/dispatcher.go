@@ -0,0 +1,477 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ssOlexBaiko/library/storage"
+	"github.com/twinj/uuid"
+)
+
+// Headers sent with every delivery
+const (
+	HeaderEvent     = "X-Library-Event"
+	HeaderDelivery  = "X-Library-Delivery"
+	HeaderSignature = "X-Library-Signature"
+)
+
+var (
+	// ErrNotFound describe the state when the subscription or the delivery is not found
+	ErrNotFound = errors.New("can't find the object with given ID")
+	// ErrInvalidSubscription describe the subscription without valid URL or secret
+	ErrInvalidSubscription = errors.New("subscription needs an absolute http(s) URL and a secret")
+)
+
+const (
+	// defaultMaxAttempts after which the delivery is moved to the dead letters
+	defaultMaxAttempts = 8
+	// defaultBackoff is the delay before the second attempt, it's doubled for every next one
+	defaultBackoff = 5 * time.Second
+	// keepDelivered is the number of delivered deliveries which are kept for replaying
+	keepDelivered = 100
+	// keepDead is the number of dead deliveries which are kept, the oldest ones are dropped above it
+	keepDead = 100
+	// deadRetention is how long the dead delivery is kept for replaying
+	deadRetention = 7 * 24 * time.Hour
+	// pollInterval is how often the dispatcher looks for the due deliveries
+	pollInterval = time.Second
+)
+
+// ChangeLog is the source of the delivered events, it's the library
+type ChangeLog interface {
+	Changes(ctx context.Context, since uint64) (storage.Changes, uint64, error)
+	Version(ctx context.Context) (uint64, time.Time, error)
+}
+
+// Dispatcher keeps webhook subscriptions and delivers catalog events to them.
+// The events are read from the change log after the cursor, the deliveries are stored in the file
+// together with the moved cursor before they are sent, so a change is delivered at least once:
+// the changes made right before a crash are collected again after the restart.
+// Receivers can tell the repeated delivery by its ID.
+type Dispatcher struct {
+	log         ChangeLog
+	path        string
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+
+	mu    sync.Mutex
+	state state
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewDispatcher constructor for Dispatcher struct, it reads the state from the given file.
+// The dispatcher without the state starts with the changes made after its creation.
+// Call Start to begin deliveries and Close to stop them.
+func NewDispatcher(changeLog ChangeLog, path string) (*Dispatcher, error) {
+	d := &Dispatcher{
+		log:         changeLog,
+		path:        path,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		maxAttempts: defaultMaxAttempts,
+		backoff:     defaultBackoff,
+	}
+
+	file, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err = json.Unmarshal(file, &d.state); err != nil {
+			return nil, err
+		}
+	}
+
+	if d.state.Cursor == nil {
+		seq, _, err := changeLog.Version(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		d.state.Cursor = &seq
+		if err = d.writeData(); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// writeData saves the state, it has to be called with the lock held.
+// The file and the directory are synced, so the renamed file survives the crash of the machine.
+func (d *Dispatcher) writeData() error {
+	path, err := filepath.Abs(d.path)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(d.state, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	// write into the temporary file first so the crash doesn't leave the half-written state
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Subscriptions returns all subscriptions without their secrets
+func (d *Dispatcher) Subscriptions() (Subscriptions, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	subs := make(Subscriptions, 0, len(d.state.Subscriptions))
+	for _, sub := range d.state.Subscriptions {
+		sub.Secret = ""
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+// Subscribe adds the subscription and returns it with the generated ID
+func (d *Dispatcher) Subscribe(sub Subscription) (Subscription, error) {
+	u, err := url.Parse(sub.URL)
+	if err != nil || !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") || sub.Secret == "" {
+		return Subscription{}, ErrInvalidSubscription
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sub.ID = uuid.NewV4().String()
+	d.state.Subscriptions = append(d.state.Subscriptions, sub)
+	if err = d.writeData(); err != nil {
+		d.state.Subscriptions = d.state.Subscriptions[:len(d.state.Subscriptions)-1]
+		return Subscription{}, err
+	}
+
+	sub.Secret = ""
+	return sub, nil
+}
+
+// Unsubscribe removes the subscription with its pending deliveries
+func (d *Dispatcher) Unsubscribe(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	index := -1
+	for i, sub := range d.state.Subscriptions {
+		if sub.ID == id {
+			index = i
+		}
+	}
+	if index < 0 {
+		return ErrNotFound
+	}
+
+	d.state.Subscriptions = append(d.state.Subscriptions[:index], d.state.Subscriptions[index+1:]...)
+	deliveries := d.state.Deliveries[:0]
+	for _, delivery := range d.state.Deliveries {
+		if delivery.SubscriptionID != id {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	d.state.Deliveries = deliveries
+	return d.writeData()
+}
+
+// DeadLetters returns deliveries which have run out of attempts
+func (d *Dispatcher) DeadLetters() (Deliveries, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dead := Deliveries{}
+	for _, delivery := range d.state.Deliveries {
+		if delivery.Status == StatusDead {
+			dead = append(dead, delivery)
+		}
+	}
+	return dead, nil
+}
+
+// Replay schedules the delivery with given ID to be sent again from the first attempt
+func (d *Dispatcher) Replay(id string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i := range d.state.Deliveries {
+		delivery := &d.state.Deliveries[i]
+		if delivery.ID != id {
+			continue
+		}
+		delivery.Status = StatusPending
+		delivery.Attempts = 0
+		delivery.NextAttempt = time.Now()
+		delivery.LastError = ""
+		return d.writeData()
+	}
+	return ErrNotFound
+}
+
+// collect stores the deliveries of the changes logged after the cursor for every interested subscription.
+// The cursor is moved in the same write, so the changes are either collected once or collected again
+// after the restart. The log which is behind the cursor was started over, it's followed from its end then.
+func (d *Dispatcher) collect(ctx context.Context) error {
+	d.mu.Lock()
+	cursor := *d.state.Cursor
+	d.mu.Unlock()
+
+	changes, last, err := d.log.Changes(ctx, cursor)
+	if errors.Is(err, storage.ErrInvalidSince) {
+		log.Printf("change log is behind the webhook cursor %d, it's followed from its end", cursor)
+		if last, _, err = d.log.Version(ctx); err != nil {
+			return err
+		}
+		changes = nil
+	} else if err != nil {
+		return err
+	}
+	if last == cursor && len(changes) == 0 {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	previous := d.state
+	d.state.Deliveries = append(Deliveries{}, previous.Deliveries...)
+	for _, change := range changes {
+		event := storage.Event{Type: change.Type, Book: storage.Book{ID: change.BookID}, Time: change.Time}
+		if change.Book != nil {
+			event.Book = *change.Book
+		}
+		payload, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+
+		for _, sub := range d.state.Subscriptions {
+			if !sub.wants(event.Type) {
+				continue
+			}
+			d.state.Deliveries = append(d.state.Deliveries, Delivery{
+				ID:             uuid.NewV4().String(),
+				SubscriptionID: sub.ID,
+				Seq:            change.Seq,
+				Event:          event.Type,
+				Payload:        payload,
+				Status:         StatusPending,
+				Created:        time.Now().UTC(),
+				NextAttempt:    time.Now(),
+			})
+		}
+	}
+	d.state.Cursor = &last
+	d.prune(time.Now())
+	if err = d.writeData(); err != nil {
+		d.state = previous
+		return err
+	}
+	return nil
+}
+
+func (s Subscription) wants(event string) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Start runs the delivery loop in the background
+func (d *Dispatcher) Start() {
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				if err := d.collect(context.Background()); err != nil {
+					log.Println(err)
+				}
+				d.deliverDue()
+			}
+		}
+	}()
+}
+
+// Close stops the delivery loop and waits for the current deliveries to finish
+func (d *Dispatcher) Close() error {
+	if d.stop == nil {
+		return nil
+	}
+	close(d.stop)
+	<-d.done
+	d.stop = nil
+	return nil
+}
+
+// deliverDue sends every pending delivery whose next attempt is due
+func (d *Dispatcher) deliverDue() {
+	now := time.Now()
+
+	d.mu.Lock()
+	var due Deliveries
+	subs := map[string]Subscription{}
+	for _, sub := range d.state.Subscriptions {
+		subs[sub.ID] = sub
+	}
+	for _, delivery := range d.state.Deliveries {
+		if delivery.Status == StatusPending && !delivery.NextAttempt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, delivery := range due {
+		sub, ok := subs[delivery.SubscriptionID]
+		if !ok {
+			continue
+		}
+		d.finish(delivery.ID, d.send(sub, delivery))
+	}
+}
+
+// send makes a single attempt to deliver the payload
+func (d *Dispatcher) send(sub Subscription, delivery Delivery) error {
+	req, err := http.NewRequest("POST", sub.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderDelivery, delivery.ID)
+	req.Header.Set(HeaderSignature, Sign(sub.Secret, delivery.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// finish records the result of the attempt and schedules the next one
+func (d *Dispatcher) finish(id string, sendErr error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i := range d.state.Deliveries {
+		delivery := &d.state.Deliveries[i]
+		if delivery.ID != id {
+			continue
+		}
+
+		delivery.Attempts++
+		switch {
+		case sendErr == nil:
+			delivery.Status = StatusDelivered
+			delivery.LastError = ""
+		case delivery.Attempts >= d.maxAttempts:
+			delivery.Status = StatusDead
+			delivery.LastError = sendErr.Error()
+		default:
+			delivery.NextAttempt = time.Now().Add(d.backoff << uint(delivery.Attempts-1))
+			delivery.LastError = sendErr.Error()
+		}
+		break
+	}
+
+	d.prune(time.Now())
+	if err := d.writeData(); err != nil {
+		log.Println(err)
+	}
+}
+
+// prune drops the oldest delivered deliveries above keepDelivered and the oldest dead ones
+// above keepDead or older than deadRetention
+func (d *Dispatcher) prune(now time.Time) {
+	delivered, dead := 0, 0
+	for _, delivery := range d.state.Deliveries {
+		switch delivery.Status {
+		case StatusDelivered:
+			delivered++
+		case StatusDead:
+			dead++
+		}
+	}
+
+	deliveries := d.state.Deliveries[:0]
+	for _, delivery := range d.state.Deliveries {
+		switch {
+		case delivery.Status == StatusDelivered && delivered > keepDelivered:
+			delivered--
+			continue
+		case delivery.Status == StatusDead && (dead > keepDead || expired(delivery, now)):
+			dead--
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	d.state.Deliveries = deliveries
+}
+
+// expired reports whether the dead delivery is kept longer than deadRetention,
+// the deliveries stored before they had the creation time aren't expired
+func expired(delivery Delivery, now time.Time) bool {
+	return !delivery.Created.IsZero() && now.Sub(delivery.Created) > deadRetention
+}
+
+// Sign returns the value of the signature header for the payload.
+// Receivers should calculate HMAC-SHA256 of the body with their secret and compare.
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
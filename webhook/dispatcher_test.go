@@ -0,0 +1,190 @@
+package webhook
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ssOlexBaiko/library/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// changeLog keeps the changes in memory like the change log of the library
+type changeLog struct {
+	changes storage.Changes
+}
+
+func (c *changeLog) append(eventType string, book storage.Book) {
+	change := storage.Change{Seq: uint64(len(c.changes)) + 1, Type: eventType, BookID: book.ID, Time: time.Now()}
+	if eventType != storage.EventBookDeleted {
+		change.Book = &book
+	}
+	c.changes = append(c.changes, change)
+}
+
+func (c *changeLog) Changes(_ context.Context, since uint64) (storage.Changes, uint64, error) {
+	last := uint64(len(c.changes))
+	if since > last {
+		return nil, 0, storage.ErrInvalidSince
+	}
+	return c.changes[since:], last, nil
+}
+
+func (c *changeLog) Version(context.Context) (uint64, time.Time, error) {
+	return uint64(len(c.changes)), time.Time{}, nil
+}
+
+func newTestDispatcher(t *testing.T, log *changeLog) *Dispatcher {
+	dir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	d, err := NewDispatcher(log, filepath.Join(dir, "webhooks.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDelivery(t *testing.T) {
+	test := assert.New(t)
+
+	var signature, event string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get(HeaderSignature)
+		event = r.Header.Get(HeaderEvent)
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	log := &changeLog{}
+	log.append(storage.EventBookCreated, storage.Book{Title: "Before"})
+	d := newTestDispatcher(t, log)
+	_, err := d.Subscribe(Subscription{URL: server.URL, Secret: "secret"})
+	test.NoError(err)
+
+	log.append(storage.EventBookCreated, storage.Book{Title: "TestBook"})
+	test.NoError(d.collect(context.Background()))
+	test.Len(d.state.Deliveries, 1, "the changes made before the dispatcher aren't delivered")
+	d.deliverDue()
+
+	test.Equal(storage.EventBookCreated, event)
+	test.Contains(string(body), "TestBook")
+	test.Equal(Sign("secret", body), signature)
+	test.Equal(StatusDelivered, d.state.Deliveries[0].Status)
+	test.Equal(uint64(2), d.state.Deliveries[0].Seq)
+
+	// the state survives the restart
+	restarted, err := NewDispatcher(log, d.path)
+	test.NoError(err)
+	test.Len(restarted.state.Subscriptions, 1)
+	test.Len(restarted.state.Deliveries, 1)
+	test.Equal(uint64(2), *restarted.state.Cursor)
+}
+
+func TestDeliveryAfterCrash(t *testing.T) {
+	test := assert.New(t)
+
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get(HeaderEvent))
+	}))
+	defer server.Close()
+
+	log := &changeLog{}
+	d := newTestDispatcher(t, log)
+	_, err := d.Subscribe(Subscription{URL: server.URL, Secret: "secret"})
+	test.NoError(err)
+
+	// the process stops after the changes are logged but before they are collected
+	log.append(storage.EventBookCreated, storage.Book{ID: "1"})
+	log.append(storage.EventBookDeleted, storage.Book{ID: "1"})
+
+	restarted, err := NewDispatcher(log, d.path)
+	test.NoError(err)
+	test.NoError(restarted.collect(context.Background()))
+	restarted.deliverDue()
+	test.Equal([]string{storage.EventBookCreated, storage.EventBookDeleted}, received)
+
+	// nothing is collected twice
+	test.NoError(restarted.collect(context.Background()))
+	test.Len(restarted.state.Deliveries, 2)
+
+	// the log which was started over is followed from its end
+	log.changes = nil
+	test.NoError(restarted.collect(context.Background()))
+	test.Equal(uint64(0), *restarted.state.Cursor)
+}
+
+func TestDeadLetters(t *testing.T) {
+	test := assert.New(t)
+
+	fail := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	log := &changeLog{}
+	d := newTestDispatcher(t, log)
+	d.maxAttempts = 2
+	d.backoff = 0
+	_, err := d.Subscribe(Subscription{URL: server.URL, Secret: "secret", Events: []string{storage.EventBookDeleted}})
+	test.NoError(err)
+
+	log.append(storage.EventBookCreated, storage.Book{ID: "1"})
+	test.NoError(d.collect(context.Background()))
+	test.Empty(d.state.Deliveries, "subscription doesn't want this event")
+
+	log.append(storage.EventBookDeleted, storage.Book{ID: "1"})
+	test.NoError(d.collect(context.Background()))
+	d.deliverDue()
+	test.Equal(StatusPending, d.state.Deliveries[0].Status)
+	test.Equal(1, d.state.Deliveries[0].Attempts)
+	d.deliverDue()
+
+	dead, err := d.DeadLetters()
+	test.NoError(err)
+	test.Len(dead, 1)
+
+	fail = false
+	test.NoError(d.Replay(dead[0].ID))
+	d.deliverDue()
+
+	dead, err = d.DeadLetters()
+	test.NoError(err)
+	test.Empty(dead)
+	test.Equal(StatusDelivered, d.state.Deliveries[0].Status)
+}
+
+func TestPruneDeadLetters(t *testing.T) {
+	test := assert.New(t)
+	d := newTestDispatcher(t, &changeLog{})
+
+	now := time.Now()
+	d.state.Deliveries = Deliveries{
+		{ID: "expired", Status: StatusDead, Created: now.Add(-deadRetention - time.Hour)},
+		{ID: "legacy", Status: StatusDead},
+		{ID: "pending", Status: StatusPending, Created: now.Add(-deadRetention - time.Hour)},
+	}
+	for i := 0; i < keepDead+1; i++ {
+		d.state.Deliveries = append(d.state.Deliveries, Delivery{ID: "dead", Status: StatusDead, Created: now})
+	}
+	d.prune(now)
+
+	dead, err := d.DeadLetters()
+	test.NoError(err)
+	test.Len(dead, keepDead)
+	test.NotEqual("expired", dead[0].ID)
+	test.Equal("pending", d.state.Deliveries[0].ID, "only the dead deliveries expire")
+}
@@ -0,0 +1,51 @@
+package webhook
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Statuses of the delivery
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusDead      = "dead"
+)
+
+// Subscription describes the receiver of the catalog events
+type Subscription struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Secret is used for signing payloads, it's never returned back to the clients
+	Secret string `json:"secret,omitempty"`
+	// Events the subscription is interested in, all events are sent when it's empty
+	Events []string `json:"events"`
+}
+
+// Subscriptions contains subscription objects
+type Subscriptions []Subscription
+
+// Delivery describes sending of a single event to a single subscription
+type Delivery struct {
+	ID             string          `json:"id"`
+	SubscriptionID string          `json:"subscription_id"`
+	Seq            uint64          `json:"seq"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Created        time.Time       `json:"created"`
+	Attempts       int             `json:"attempts"`
+	NextAttempt    time.Time       `json:"next_attempt"`
+	LastError      string          `json:"last_error,omitempty"`
+}
+
+// Deliveries contains delivery objects
+type Deliveries []Delivery
+
+// state is what the dispatcher keeps in the storage file
+type state struct {
+	Subscriptions Subscriptions `json:"subscriptions"`
+	Deliveries    Deliveries    `json:"deliveries"`
+	// Cursor is the sequence number of the last change the deliveries are made for
+	Cursor *uint64 `json:"cursor,omitempty"`
+}